@@ -12,6 +12,7 @@ import (
 	"github.com/KushBlazingJudah/feditext"
 	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/KushBlazingJudah/feditext/fedi"
 )
 
 var loaded = false
@@ -105,13 +106,98 @@ func createUser(args []string) {
 	os.Exit(0)
 }
 
+func rotateKey(args []string) {
+	fls := flag.NewFlagSet(fmt.Sprintf("%s rotate-key", os.Args[0]), flag.ExitOnError)
+
+	var (
+		cfg   = fls.String("config", "./feditext.config", "location of feditext's config")
+		board = fls.String("board", "", "board to give a new key")
+	)
+	fls.Parse(args)
+
+	load(*cfg)
+	defer feditext.DB.Close()
+
+	if *board == "" {
+		fmt.Println("Need a board to work with. Check out -help.")
+		os.Exit(1)
+	}
+
+	b, err := feditext.DB.Board(context.Background(), *board)
+	if err != nil {
+		fatal("Failed finding board %s: %v\n", *board, err)
+	}
+
+	fedi.DB = feditext.DB
+
+	if err := fedi.RotateKey(context.Background(), b.ID); err != nil {
+		fatal("Failed rotating key: %v\n", err)
+	}
+
+	fmt.Printf("Rotated the key of /%s/. Telling followers...\n", b.ID)
+
+	fedi.Proxy, err = fedi.NewProxy(config.ProxyUrl, config.Routes)
+	if err != nil {
+		fatal("Failed setting up proxy: %v\n", err)
+	}
+
+	if err := fedi.ActorUpdate(context.Background(), b); err != nil {
+		fatal("Failed sending new actor: %v\n", err)
+	}
+}
+
+func rerender(args []string) {
+	fls := flag.NewFlagSet(fmt.Sprintf("%s rerender", os.Args[0]), flag.ExitOnError)
+
+	var (
+		cfg   = fls.String("config", "./feditext.config", "location of feditext's config")
+		board = fls.String("board", "", "board to format posts of; every board if not specified")
+	)
+	fls.Parse(args)
+
+	load(*cfg)
+	defer feditext.DB.Close()
+
+	boards := []string{*board}
+	if *board == "" {
+		bs, err := feditext.DB.Boards(context.Background())
+		if err != nil {
+			fatal("Failed listing boards: %v\n", err)
+		}
+
+		boards = boards[:0]
+		for _, b := range bs {
+			boards = append(boards, b.ID)
+		}
+	} else if _, err := feditext.DB.Board(context.Background(), *board); err != nil {
+		fatal("Failed finding board %s: %v\n", *board, err)
+	}
+
+	for _, b := range boards {
+		n, err := feditext.DB.RenderPosts(context.Background(), b)
+		if err != nil {
+			fatal("Failed formatting posts of /%s/: %v\n", b, err)
+		}
+
+		fmt.Printf("Formatted %d posts on /%s/.\n", n, b)
+	}
+}
+
 func opts() {
 	switch strings.ToLower(os.Args[1]) {
 	case "create": // Create a user.
 		createUser(os.Args[2:])
+	case "rotate-key": // Give a board a new key.
+		rotateKey(os.Args[2:])
+		os.Exit(0)
+	case "rerender": // Format posts again.
+		rerender(os.Args[2:])
+		os.Exit(0)
 	case "-help":
 		fmt.Printf("%s [-config ...]\n", os.Args[0])
 		fmt.Printf("%s create -username ... [-password ...] [-priv 0,1,2]\n", os.Args[0])
+		fmt.Printf("%s rotate-key -board ...\n", os.Args[0])
+		fmt.Printf("%s rerender [-board ...]\n", os.Args[0])
 		// drops to os.Exit(1)
 	case "-config":
 		if len(os.Args) > 2 {
@@ -123,7 +209,7 @@ func opts() {
 		}
 	default:
 		fmt.Println("Unknown action.")
-		fmt.Println("Available are: create.")
+		fmt.Println("Available are: create, rotate-key, rerender.")
 		// drops to os.Exit(1)
 	}
 
@@ -21,12 +21,38 @@ const (
 	RequestTimeout = 30 * time.Second
 	MaxReqTime     = 60 * time.Second
 
+	// MaxResponseSize is the largest response body, in bytes, that we will
+	// read from another server.
+	MaxResponseSize = 16 << 20
+
 	MaxRetries      = 5
 	RetryDelay      = 10 * time.Second
 	RetryMultiplyer = 3
 
 	ThreadsPerPage = 10
 
+	// BackfillDepth is how many posts up a reply chain we will go to find the
+	// thread that an incoming reply belongs to.
+	BackfillDepth = 4
+
+	// BackfillRate is how many posts we will fetch from a single host in
+	// BackfillWindow to find threads we don't have.
+	BackfillRate   = 30
+	BackfillWindow = 10 * time.Minute
+
+	// KeyGracePeriod is how long the old key of a board is kept after it has
+	// been rotated, for servers that still have it cached; see
+	// RetiredKeyRetry.
+	KeyGracePeriod = 72 * time.Hour
+
+	// KeyRefetchInterval is how often the key of one actor may be fetched
+	// again because a signature didn't check out against the one we have.
+	KeyRefetchInterval = time.Minute
+
+	// MaxPollBackoff is the longest we will wait to poll an outbox again after
+	// failing to fetch it several times in a row.
+	MaxPollBackoff = 24 * time.Hour
+
 	Major = 0
 	Minor = 1
 	Patch = 2
@@ -66,6 +92,12 @@ var (
 	// This is 16 random bytes generated upon startup and pulled from ./tripsecret.
 	TripSecret []byte = make([]byte, 16)
 
+	// KeySecret encrypts the private keys of boards stored in the database.
+	// It can also be set with the FEDITEXT_KEYSECRET environment variable,
+	// which is preferred over the config file.
+	// If it is empty, keys are stored unencrypted.
+	KeySecret string = ""
+
 	// RandAdmin sets the "admin" user in the database to a random password that is printed in the console.
 	RandAdmin bool = false
 
@@ -97,6 +129,46 @@ var (
 	// You should only use this if you accept Tor connections.
 	ProxyUrl string = ""
 
+	// Routes send requests to some hosts through a different proxy than
+	// ProxyUrl, or none at all.
+	// The route with the longest matching suffix is used.
+	Routes []Route
+
+	// SecureMode requires a valid HTTP signature from an instance that isn't
+	// blocked on requests for board outboxes, posts, and follower collections.
+	// This is sometimes called "authorized fetch" elsewhere.
+	// Instances that don't sign their requests, like older versions of
+	// Feditext, will be unable to read anything from us.
+	SecureMode bool = false
+
+	// CompatFollow considers follows sent by our boards accepted as soon as
+	// they are sent, instead of waiting for an Accept activity.
+	// FChannel never sends an Accept, so you will need this to follow boards
+	// on FChannel instances.
+	CompatFollow bool = false
+
+	// RetiredKeyRetry sends requests that were refused with 401 or 403 again,
+	// signed with the key a board had before it was rotated, while that key
+	// is still kept.
+	// This helps servers that cached the old key, but a key is often rotated
+	// because it leaked, so it is off by default.
+	RetiredKeyRetry bool = false
+
+	// PollInterval is how often the outboxes of everything our boards follow
+	// are fetched, to pick up posts that never made it to our inbox.
+	// Set to zero to turn it off.
+	PollInterval time.Duration = 30 * time.Minute
+
+	// PollIntervals overrides PollInterval for specific Actors.
+	// A zero duration stops them from being polled.
+	PollIntervals map[string]time.Duration = map[string]time.Duration{}
+
+	// InboxWorkers is how many activities received in our inboxes are
+	// processed at once.
+	// Activities from the same host are always processed one at a time, in
+	// the order they came in.
+	InboxWorkers = 4
+
 	// Debug prints out extra information on ActivityPub requests.
 	Debug bool = false
 
@@ -150,6 +222,19 @@ var (
 	UnstableUnfollow bool = false
 )
 
+// Route says how requests to hosts ending in Suffix are made.
+type Route struct {
+	// Suffix is matched against the host name, such as ".onion" or
+	// "example.com". A suffix matches itself and all of its subdomains.
+	Suffix string
+
+	// Proxy is the URL of the proxy to use, or empty to connect directly.
+	Proxy string
+
+	// Timeout is how long requests may take; zero means RequestTimeout.
+	Timeout time.Duration
+}
+
 func init() {
 	// Most of everything here is fatal anyway so just panic
 
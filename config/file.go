@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Load loads a configuration file using a simple key value format.
@@ -62,10 +63,64 @@ func Load(path string) error {
 			AllowLocal = value == "true"
 		case "onion":
 			AllowOnion = value == "true"
+		case "secure":
+			SecureMode = value == "true"
+		case "poll":
+			var err error
+			PollInterval, err = time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("Error parsing poll: %s", err)
+			}
+		case "pollpeer":
+			toks := strings.SplitN(value, " ", 2)
+			if len(toks) != 2 {
+				log.Fatalf("Error: bad value for pollpeer. Expected two values, got %d.", len(toks))
+			}
+
+			d, err := time.ParseDuration(strings.TrimSpace(toks[1]))
+			if err != nil {
+				log.Fatalf("Error parsing pollpeer: %s", err)
+			}
+
+			PollIntervals[toks[0]] = d
+		case "inboxworkers":
+			var err error
+			InboxWorkers, err = strconv.Atoi(value)
+			if err != nil {
+				log.Fatalf("Error parsing inboxworkers: %s", err)
+			} else if InboxWorkers <= 0 {
+				log.Fatalf("Error: inboxworkers must be above zero.")
+			}
+		case "compatfollow":
+			CompatFollow = value == "true"
+		case "retiredkeyretry":
+			RetiredKeyRetry = value == "true"
 		case "debug":
 			Debug = value == "true"
 		case "proxy":
 			ProxyUrl = value
+		case "keysecret":
+			KeySecret = value
+		case "route":
+			toks := strings.Fields(value)
+			if len(toks) != 2 && len(toks) != 3 {
+				log.Fatalf("Error: bad value for route. Expected two or three values, got %d.", len(toks))
+			}
+
+			r := Route{Suffix: toks[0], Proxy: toks[1]}
+			if r.Proxy == "direct" {
+				r.Proxy = ""
+			}
+
+			if len(toks) == 3 {
+				var err error
+				r.Timeout, err = time.ParseDuration(toks[2])
+				if err != nil {
+					log.Fatalf("Error parsing route timeout: %s", err)
+				}
+			}
+
+			Routes = append(Routes, r)
 		case "pprof":
 			Pprof = true
 		case "textlimit":
@@ -132,5 +187,9 @@ func Load(path string) error {
 		EmailUsername = EmailAddress
 	}
 
+	if v := os.Getenv("FEDITEXT_KEYSECRET"); v != "" {
+		KeySecret = v
+	}
+
 	return nil
 }
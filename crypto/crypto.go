@@ -1,15 +1,25 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/scrypt"
 )
 
+// ErrNoSecret is returned by Seal and Open when KeySecret is not set.
+var ErrNoSecret = errors.New("no key secret is set")
+
 func JwtKeyfunc(t *jwt.Token) (interface{}, error) {
 	if t.Method.Alg() != "HS256" {
 		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
@@ -62,3 +72,130 @@ func Trip(pass string) string {
 	hash := sha1.Sum([]byte(pass))
 	return "!" + base64.URLEncoding.EncodeToString(hash[:])[:10]
 }
+
+// sealMagic starts everything sealed by Seal, to tell it apart from what older
+// versions sealed with an unsalted key.
+var sealMagic = []byte("fts1")
+
+// saltSize is the size of the salt that keys are derived from KeySecret with.
+const saltSize = 16
+
+// scrypt parameters for deriving keys from KeySecret.
+// Keys are only opened every few minutes, so this can afford to be slow.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// secretAEAD makes an AES-256-GCM cipher keyed with KeySecret and salt.
+// A nil salt gives the unsalted key used by older versions.
+func secretAEAD(salt []byte) (cipher.AEAD, error) {
+	if config.KeySecret == "" {
+		return nil, ErrNoSecret
+	}
+
+	var key []byte
+	if salt == nil {
+		sum := sha256.Sum256([]byte(config.KeySecret))
+		key = sum[:]
+	} else {
+		var err error
+		key, err = scrypt.Key([]byte(config.KeySecret), salt, scryptN, scryptR, scryptP, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts data with KeySecret.
+// ad is authenticated along with it, and must be given again to Open; it ties
+// what was sealed to what it is, so that it can't be swapped for something
+// else that was sealed.
+// The result starts with sealMagic, then the salt and the nonce.
+func Seal(data, ad []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := secretAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(sealMagic)+saltSize+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(out, sealMagic...)
+	out = append(out, salt...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, data, ad), nil
+}
+
+// Open decrypts data sealed by Seal with the same ad.
+// Data sealed by older versions is understood too; see Outdated.
+func Open(data, ad []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, sealMagic) {
+		rest := data[len(sealMagic):]
+		if len(rest) < saltSize {
+			return nil, fmt.Errorf("sealed data is too short")
+		}
+
+		aead, err := secretAEAD(rest[:saltSize])
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := open(aead, rest[saltSize:], ad)
+		if err == nil {
+			return out, nil
+		}
+
+		// Possibly an old nonce that happened to start with sealMagic.
+		if old, oerr := openLegacy(data); oerr == nil {
+			return old, nil
+		}
+
+		return nil, err
+	}
+
+	return openLegacy(data)
+}
+
+// Outdated reports whether data was sealed by an older version, and should be
+// sealed again.
+func Outdated(data []byte) bool {
+	return !bytes.HasPrefix(data, sealMagic)
+}
+
+// openLegacy decrypts data sealed by older versions, which had no salt or
+// additional data.
+func openLegacy(data []byte) ([]byte, error) {
+	aead, err := secretAEAD(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, data, nil)
+}
+
+func open(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, ad)
+}
@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/markup"
 	"github.com/KushBlazingJudah/feditext/util"
 )
 
@@ -27,6 +32,16 @@ type ModerationActionType uint8
 // ModType is an enum for moderator types
 type ModType uint8
 
+// FollowState is the state of a follow request sent by one of our boards.
+type FollowState uint8
+
+// ActivityState is how far along an activity we received is in being
+// processed.
+type ActivityState uint8
+
+// TokenScope is a set of things an API token may be used for.
+type TokenScope uint8
+
 // InitFunc is a function signature to make it easier to use any arbitrary
 // database.
 // Those who wish to implement a new database should create a new file in this
@@ -38,6 +53,7 @@ const (
 	ModActionBan ModerationActionType = iota
 	ModActionWarn
 	ModActionDelete
+	ModActionEdit
 )
 
 const (
@@ -46,25 +62,71 @@ const (
 	ModTypeAdmin
 )
 
+const (
+	FollowPending FollowState = iota
+	FollowAccepted
+	FollowRejected
+)
+
+const (
+	ActivityPending ActivityState = iota
+	ActivityDone
+	ActivityFailed
+)
+
+const (
+	ScopePost TokenScope = 1 << iota
+	ScopeReport
+	ScopeDelete
+)
+
 const (
 	saltLength = 16
+
+	// tokenLength is how many random bytes make up an API token.
+	tokenLength = 24
 )
 
 const (
 	flagSage = 1 << iota
 	flagSJIS
+	flagEdited
 )
 
 var (
 	ErrPostContents = errors.New("invalid post contents")
 	ErrPostRejected = errors.New("post was rejected")
+	ErrPostDeleted  = errors.New("post was deleted")
+
+	// ErrActivityExists is returned by SaveActivity when the activity was
+	// already received.
+	ErrActivityExists = errors.New("activity was already received")
 )
 
 var Engines = map[string]InitFunc{}
 
+// renderVersion is the version of formatPost that content is made by.
+// Bump it whenever the HTML it makes changes; posts made by an older version
+// are formatted again when they're read.
+const renderVersion = 1
+
 var citeRegex = regexp.MustCompile(`>>(\d+)`)
-var apCiteRegex = regexp.MustCompile(`>>(https?:\/\/[0-9a-z\-\.]*\.[0-9a-z]+(?::\d+)?\/[0-9A-Za-z]+\/[0-9A-Za-z]+)`)
-var quoteRegex = regexp.MustCompile("(?m)^&gt;(.+?)$")
+
+// Hosts don't need a dot, so that cites of posts on an instance running on
+// localhost work too.
+var apCiteRegex = regexp.MustCompile(`>>(https?:\/\/[0-9a-z\-\.]*[0-9a-z](?::\d+)?\/[0-9A-Za-z]+\/[0-9A-Za-z]+)`)
+
+// anyCiteRegex matches every kind of cite formatPost understands:
+//
+//	>>>@example.com/b/ABCDEF1      a post on another instance
+//	>>>/b/123                      a post on a board of this instance
+//	>>>/b/                         a board of this instance
+//	>>https://example.com/b/ABC    a post, by its ActivityPub ID
+//	>>123                          a post on the same board
+var anyCiteRegex = regexp.MustCompile(`>>>@([0-9a-z\-\.]*\.[0-9a-z]+(?::\d+)?)\/([0-9A-Za-z]+)\/([0-9A-Za-z]+)|>>>\/([0-9A-Za-z]+)\/(\d+)?|` + apCiteRegex.String() + `|` + citeRegex.String())
+
+// leadingCiteRegex is anyCiteRegex, but only at the start of text.
+var leadingCiteRegex = regexp.MustCompile(`^(?:` + anyCiteRegex.String() + `)`)
 
 // Post contains data related to a single post.
 // If this is a thread opening post, ID will be equal to Thread.
@@ -96,6 +158,10 @@ type Post struct {
 	// SJIS is true when the post is considered to be SJIS art.
 	// The "sjis" class will be added to the post's content if this is true.
 	SJIS bool `json:"sjis"`
+
+	// Edited is true when the post has been changed since it was made.
+	// Previous versions can be found with Database.Revisions.
+	Edited bool `json:"edited"`
 }
 
 // ModerationAction records any moderation action taken.
@@ -110,9 +176,78 @@ type ModerationAction struct {
 	Date time.Time
 }
 
+// Revision is a previous version of a post, saved when it is edited.
+type Revision struct {
+	ID   int
+	Post PostID
+
+	// Editor is the moderator, or the Actor, that replaced this version.
+	Editor  string
+	Subject string
+	Raw     string
+	Content string
+
+	// Date is when this version was replaced.
+	Date time.Time
+}
+
+// ThreadActivity is how many replies a thread has and when it last changed,
+// as returned by Database.ThreadActivity.
+type ThreadActivity struct {
+	ID           PostID
+	Replies      int
+	LastModified time.Time
+}
+
+// Tombstone is what remains of a deleted post.
+type Tombstone struct {
+	Board  string
+	Post   PostID
+	APID   string
+	Reason string
+	Date   time.Time
+}
+
+// Key is a key used to sign requests for a board or the instance.
+type Key struct {
+	Name string
+
+	// Private is the private key, PEM encoded.
+	// If Sealed is set, it has been encrypted with crypto.Seal.
+	Private []byte
+	Sealed  bool
+
+	// Public is the public key, PEM encoded.
+	Public string
+
+	// Date is when the key was created, or retired.
+	Date time.Time
+}
+
+// Sync is the result of fetching the outbox of an Actor that a board follows.
+type Sync struct {
+	ID     int
+	Board  string
+	Target string
+
+	Date     time.Time
+	Duration time.Duration
+
+	// Posts is how many new posts were imported.
+	Posts int
+
+	// Error is empty if the sync was successful.
+	Error string
+}
+
 type Board struct {
 	ID, Title, Description string
 	Threads                int
+
+	// Push is how many of the most recently bumped threads are sent to a
+	// board when it starts following this one.
+	// Zero turns this off.
+	Push int
 }
 
 type Report struct {
@@ -155,6 +290,98 @@ type Regexp struct {
 	Pattern string
 }
 
+// Follow is a follow request sent by a board to an Actor.
+type Follow struct {
+	Board  string
+	Target string
+	State  FollowState
+}
+
+// Relay is a subscription to a relay, which sends us posts from everyone else
+// subscribed to it.
+type Relay struct {
+	// Board is the board that is subscribed, or empty if the whole instance
+	// is.
+	Board  string
+	Target string
+	State  FollowState
+	Date   time.Time
+}
+
+// Activity is an activity received in one of our inboxes.
+type Activity struct {
+	ID int
+
+	// Board is the board whose inbox it was sent to, or empty if it was sent
+	// to the instance.
+	Board string
+
+	// APID identifies the activity, and is what duplicates are found by.
+	APID  string
+	Actor string
+	Type  string
+	Body  string
+
+	State ActivityState
+
+	// Error is why processing failed, if it did.
+	Error string
+	Date  time.Time
+
+	// Attempts is how many times it has been processed.
+	Attempts int
+}
+
+// Token is a key to the write API, handed out by an admin.
+// The token itself is only known when it's made; only a hash of it is kept.
+type Token struct {
+	ID int
+
+	// Name is who or what the token was given to.
+	Name string
+
+	// Boards are the boards the token can be used on, or every board if
+	// empty.
+	Boards []string
+	Scopes TokenScope
+
+	// Rate is how many requests may be made with the token a minute.
+	Rate int
+
+	Date     time.Time
+	LastUsed time.Time
+}
+
+// Peer is how talking to another instance has been going.
+type Peer struct {
+	Host string
+
+	// Requests is how many requests we made to the host, and Failures is how
+	// many of those failed, by status code.
+	// Requests that never got an answer are counted under 0.
+	Requests int
+	Failures map[int]int
+
+	// Latency is how long every request took in total.
+	Latency time.Duration
+
+	// LastDelivery is when an activity was last delivered successfully.
+	LastDelivery time.Time
+
+	// Inbound is how many activities the host sent us, and LastInbound is
+	// when the last one arrived.
+	Inbound     int
+	LastInbound time.Time
+}
+
+// Block is an instance that we refuse to federate with.
+// Blocking a host also blocks all of its subdomains.
+type Block struct {
+	Host   string
+	Reason string
+	Date   time.Time
+}
+
 // Database implements everything you might need in a textboard database.
 // This should be generic enough to port to whatever engine you may like.
 type Database interface {
@@ -173,12 +400,28 @@ type Database interface {
 	// ThreadStat returns the number of posts and unique posters in any given thread.
 	ThreadStat(ctx context.Context, board string, thread PostID) (int, int, error)
 
+	// LastModified returns when a post was last made, bumped, edited or deleted
+	// on a thread, or anywhere on the board if thread is 0.
+	LastModified(ctx context.Context, board string, thread PostID) (time.Time, error)
+
+	// ThreadActivity returns the reply count and LastModified of every thread
+	// on a board, in the same order as Threads.
+	ThreadActivity(ctx context.Context, board string) ([]ThreadActivity, error)
+
+	// PostCount returns the number of posts on a board.
+	// If local is set, posts from other instances aren't counted.
+	PostCount(ctx context.Context, board string, local bool) (int, error)
+
 	// Post fetches a single post from a thread.
 	Post(ctx context.Context, board string, post PostID) (Post, error)
 
 	// FindAPID finds a post given its ActivityPub ID.
 	FindAPID(ctx context.Context, board string, apid string) (Post, error)
 
+	// Tombstone finds what remains of a deleted post given its ActivityPub ID
+	// or its post number.
+	Tombstone(ctx context.Context, board string, match string) (Tombstone, error)
+
 	// Privilege returns the type of moderator username is.
 	Privilege(ctx context.Context, username string) (ModType, error)
 
@@ -206,30 +449,90 @@ type Database interface {
 	// Captcha returns a captcha.
 	Captcha(ctx context.Context, id string) ([]byte, string, error)
 
+	// Revisions returns the previous versions of a post, oldest first.
+	Revisions(ctx context.Context, board string, post PostID) ([]Revision, error)
+
 	// Replies returns a list of replies to a post.
 	Replies(ctx context.Context, board string, id PostID, reverse bool) ([]Post, error)
 
 	// Following returns a list of Actors a board is following.
+	// Only accepted follows are returned.
 	Following(ctx context.Context, board string) ([]string, error)
 
+	// FollowRequests returns every follow a board has sent, regardless of
+	// state.
+	FollowRequests(ctx context.Context, board string) ([]Follow, error)
+
 	// Followers returns a list of Actors a board is being followed by.
 	Followers(ctx context.Context, board string) ([]string, error)
 
+	// Syncs returns the most recent outbox syncs, newest first.
+	Syncs(ctx context.Context, limit int) ([]Sync, error)
+
+	// Key returns a signing key by name.
+	Key(ctx context.Context, name string) (Key, error)
+
+	// Keys returns every signing key.
+	Keys(ctx context.Context) ([]Key, error)
+
+	// LastSync returns the last successful sync of target's outbox on board.
+	LastSync(ctx context.Context, board string, target string) (Sync, error)
+
 	// Regexps returns a list of regular expressions for filtering posts.
 	Regexps(ctx context.Context) ([]Regexp, error)
 
+	// Blocks returns a list of blocked instances.
+	Blocks(ctx context.Context) ([]Block, error)
+
+	// Relays returns every subscription to a relay.
+	Relays(ctx context.Context) ([]Relay, error)
+
+	// Relay returns the subscription of a board to a relay.
+	// An empty board is the instance.
+	Relay(ctx context.Context, board string, target string) (Relay, error)
+
+	// Activities returns the most recently received activities, newest first.
+	Activities(ctx context.Context, limit int) ([]Activity, error)
+
+	// Tokens returns every API token.
+	Tokens(ctx context.Context) ([]Token, error)
+
+	// Peers returns what we know about every instance we have talked to.
+	Peers(ctx context.Context) ([]Peer, error)
+
+	// UseToken returns the API token secret belongs to, and records that it
+	// was used.
+	// sql.ErrNoRows is returned if there is none.
+	UseToken(ctx context.Context, secret string) (Token, error)
+
+	// PendingActivities returns every activity that hasn't been processed yet,
+	// oldest first.
+	PendingActivities(ctx context.Context) ([]Activity, error)
+
+	// FailedActivities returns every activity that failed to be processed in
+	// fewer than attempts attempts, oldest first.
+	FailedActivities(ctx context.Context, attempts int) ([]Activity, error)
+
 	// Banned checks to see if a user is banned.
 	Banned(ctx context.Context, source string) (bool, time.Time, string, error)
 
-	// AddFollow records an Actor as following a board.
-	AddFollow(ctx context.Context, source string, board string) error
+	// Blocked checks to see if a host, or any domain above it, is blocked.
+	Blocked(ctx context.Context, host string) (bool, error)
+
+	// AddFollow records an Actor as following a board, and reports whether it
+	// wasn't following it already.
+	AddFollow(ctx context.Context, source string, board string) (bool, error)
 
-	// AddFollowing records a board is following an Actor.
-	AddFollowing(ctx context.Context, board string, target string) error
+	// AddFollowing records a board is following an Actor, or updates the state
+	// of an existing follow.
+	AddFollowing(ctx context.Context, board string, target string, state FollowState) error
 
 	// AddRegexp adds a regular expression to the post filter.
 	AddRegexp(ctx context.Context, regexp string) error
 
+	// AddBlock blocks an instance.
+	AddBlock(ctx context.Context, block Block) error
+
 	// Ban bans a user.
 	Ban(ctx context.Context, ban Ban, by string) error
 
@@ -239,8 +542,50 @@ type Database interface {
 	// SavePost saves a post to the database.
 	// If Post.ID is 0, one will be generated.
 	// If Post.Thread is 0, it is considered a thread.
+	// Posts with the ActivityPub ID of a deleted post are refused with
+	// ErrPostDeleted.
 	SavePost(ctx context.Context, board string, post *Post) error
 
+	// EditPost replaces the subject and contents of an existing post with
+	// those of post, keeping the old version as a revision, and records a
+	// moderation action.
+	// The post is formatted again and its replies are updated.
+	EditPost(ctx context.Context, board string, post *Post, editor string) error
+
+	// RenderPosts formats every post on board again from its raw text, and
+	// updates their replies.
+	// Posts are done a few at a time so the board can still be used in the
+	// meantime.
+	// It returns how many posts were formatted.
+	RenderPosts(ctx context.Context, board string) (int, error)
+
+	// SaveSync records the result of an outbox sync.
+	SaveSync(ctx context.Context, sync Sync) error
+
+	// SaveToken makes a new API token, and returns the token itself.
+	// Token.ID is filled in.
+	SaveToken(ctx context.Context, token *Token) (string, error)
+
+	// SaveRelay subscribes to a relay, or updates the state of a subscription.
+	SaveRelay(ctx context.Context, relay Relay) error
+
+	// SavePeers saves what we know about other instances, replacing what was
+	// saved for them before.
+	SavePeers(ctx context.Context, peers []Peer) error
+
+	// SaveActivity records an activity that was received, and sets its ID.
+	// Activities already received by the same inbox are refused with
+	// ErrActivityExists, unless processing them failed; those are pending
+	// again, and keep their ID.
+	SaveActivity(ctx context.Context, act *Activity) error
+
+	// SetActivityState records how processing an activity went.
+	// Setting it to anything but pending counts as an attempt.
+	SetActivityState(ctx context.Context, id int, state ActivityState, reason string) error
+
+	// SaveKey saves a signing key, replacing any other with the same name.
+	SaveKey(ctx context.Context, key Key) error
+
 	// SaveModerator saves a moderator to the database, or updates an existing entry.
 	SaveModerator(ctx context.Context, username, email, password string, priv ModType) error
 
@@ -264,9 +609,11 @@ type Database interface {
 
 	// DeleteThread deletes a thread from the database and records a moderation action.
 	// It will also delete all posts.
+	// A tombstone is left behind for every post deleted.
 	DeleteThread(ctx context.Context, board string, thread PostID, modAction ModerationAction) error
 
 	// DeletePost deletes a post from the database and records a moderation action.
+	// A tombstone is left behind.
 	DeletePost(ctx context.Context, board string, post PostID, modAction ModerationAction) error
 
 	// DeleteNews deletes news.
@@ -284,6 +631,21 @@ type Database interface {
 	// DeleteRegexp removes a regular expression from the post filter.
 	DeleteRegexp(ctx context.Context, id int) error
 
+	// DeleteBlock unblocks an instance.
+	DeleteBlock(ctx context.Context, host string) error
+
+	// DeleteRelay removes a subscription to a relay.
+	DeleteRelay(ctx context.Context, board string, target string) error
+
+	// DeleteToken revokes an API token.
+	DeleteToken(ctx context.Context, id int) error
+
+	// DeletePeer forgets what we know about an instance.
+	DeletePeer(ctx context.Context, host string) error
+
+	// PruneActivities deletes processed activities received before t.
+	PruneActivities(ctx context.Context, t time.Time) error
+
 	// PasswordCheck checks a moderator's password.
 	PasswordCheck(ctx context.Context, username string, password string) (bool, error)
 
@@ -294,6 +656,68 @@ type Database interface {
 	Close() error
 }
 
+func (s FollowState) String() string {
+	switch s {
+	case FollowPending:
+		return "pending"
+	case FollowAccepted:
+		return "accepted"
+	case FollowRejected:
+		return "rejected"
+	}
+
+	return "unknown"
+}
+
+func (s ActivityState) String() string {
+	switch s {
+	case ActivityPending:
+		return "pending"
+	case ActivityDone:
+		return "done"
+	case ActivityFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+func (s TokenScope) String() string {
+	names := []string{}
+	if s&ScopePost != 0 {
+		names = append(names, "post")
+	}
+	if s&ScopeReport != 0 {
+		names = append(names, "report")
+	}
+	if s&ScopeDelete != 0 {
+		names = append(names, "delete")
+	}
+
+	if len(names) == 0 {
+		return "nothing"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Can checks if the token may be used for scope on board.
+func (t Token) Can(scope TokenScope, board string) bool {
+	if t.Scopes&scope != scope {
+		return false
+	} else if len(t.Boards) == 0 {
+		return true
+	}
+
+	for _, b := range t.Boards {
+		if b == board {
+			return true
+		}
+	}
+
+	return false
+}
+
 // IsLocal checks if a post was made from this instance or not.
 func (p Post) IsLocal() bool {
 	return !strings.HasPrefix(p.Source, "http")
@@ -308,6 +732,9 @@ func (p Post) flags() int {
 	if p.SJIS {
 		o |= flagSJIS
 	}
+	if p.Edited {
+		o |= flagEdited
+	}
 	return o
 }
 
@@ -315,6 +742,7 @@ func (p Post) flags() int {
 func (p *Post) readFlags(f int) {
 	p.Sage = f&flagSage > 0
 	p.SJIS = f&flagSJIS > 0
+	p.Edited = f&flagEdited > 0
 }
 
 func modMails(db Database) ([]string, error) {
@@ -355,6 +783,12 @@ InReplyTo: /%s/%d
 	util.SendMail(context.Background(), mm, subject, contents)
 }
 
+// IsRemote returns true if the report was sent to us by another instance, in
+// which case Source is the actor that sent it.
+func (r Report) IsRemote() bool {
+	return strings.HasPrefix(r.Source, "http")
+}
+
 func (r *Report) Notify(db Database) {
 	if config.EmailAddress == "" {
 		return
@@ -403,74 +837,192 @@ func check(password []byte, salt []byte, target []byte) bool {
 	return bytes.Equal(hash[:], target)
 }
 
-func findReplies(p *Post) map[string]string {
-	s := p.Raw
+// newToken makes a new API token, and returns it along with the hash that is
+// kept of it.
+// Tokens are long and random, so unlike passwords they don't need a salt.
+func newToken() (string, string) {
+	buf := make([]byte, tokenLength)
+	rand.Read(buf)
 
-	repmap := map[string]string{}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashToken(secret)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// citeFinder finds a post on a board for a cite, by either its number or its
+// ActivityPub ID.
+// An empty match only checks that the board exists.
+type citeFinder func(board, match string) (Post, error)
+
+// resolveCite finds what a cite in a post made on board points to.
+// group returns a submatch of anyCiteRegex.
+// It returns the board the post is on, which is empty for cites of a board.
+func resolveCite(board string, group func(i int) string, fn citeFinder) (string, Post, error) {
+	switch {
+	case group(1) != "": // >>>@host/board/id
+		host, b, id := group(1), group(2), group(3)
+		if host == config.FQDN {
+			post, err := fn(b, fmt.Sprintf("%s://%s/%s/%s", config.TransportProtocol, host, b, id))
+			return b, post, err
+		}
+
+		// Posts from other instances are on this board if we have them at
+		// all, but we don't know if they were sent with http or https.
+		var post Post
+		var err error
+		for _, proto := range []string{"https", "http"} {
+			post, err = fn(board, fmt.Sprintf("%s://%s/%s/%s", proto, host, b, id))
+			if !errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+		}
+
+		return board, post, err
+	case group(4) != "": // >>>/board/ or >>>/board/123
+		b := group(4)
+		if group(5) == "" {
+			_, err := fn(b, "")
+			return "", Post{}, err
+		}
 
-	// Database functionality in here isn't implemented greatly but it'll work more or less
-	// Don't bother with local cites from external sources
-	if p.IsLocal() {
-		for _, v := range citeRegex.FindAllString(s, -1) {
-			repmap[v] = v[len(">>"):]
+		post, err := fn(b, group(5))
+		return b, post, err
+	case group(6) != "": // >>https://host/board/id
+		apid := group(6)
+		post, err := fn(board, apid)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Posts made on our other boards are only found on them.
+			if u, uerr := url.Parse(apid); uerr == nil && u.Host == config.FQDN {
+				if b := strings.Split(strings.Trim(u.Path, "/"), "/")[0]; b != board {
+					post, err = fn(b, apid)
+					return b, post, err
+				}
+			}
 		}
+
+		return board, post, err
 	}
 
-	for _, v := range apCiteRegex.FindAllString(s, -1) {
-		repmap[v] = v[len(">>"):]
+	post, err := fn(board, group(7))
+	return board, post, err
+}
+
+// formatCite works out what the cite m in a post made on board points to.
+// It returns what the cite should be in the raw text of the post, the HTML to
+// show in its place, and the post it replies to, if any.
+// Posts on other boards are never replied to, since replies are kept per board
+// and a post can only be in the replies of posts on its own board.
+func formatCite(board string, p *Post, m []string, fn citeFinder) (string, string, PostID, error) {
+	match := m[0]
+	group := func(i int) string { return m[i] }
+	matchEscHtml := html.EscapeString(match)
+
+	refBoard, ref, err := resolveCite(board, group, fn)
+	if errors.Is(err, sql.ErrNoRows) {
+		// bad cite
+		return match, fmt.Sprintf(`<a href="#" class="cite invalid">%s</a>`, matchEscHtml), 0, nil
+	} else if errors.Is(err, ErrPostDeleted) {
+		return match, fmt.Sprintf(`<a href="#" class="cite deleted">%s</a>`, matchEscHtml), 0, nil
+	} else if err != nil {
+		return match, "", 0, err
 	}
 
-	return repmap
+	if refBoard == "" {
+		// Link to a board
+		return match, fmt.Sprintf(`<a href="/%s/" class="cite board">%s</a>`, group(4), matchEscHtml), 0, nil
+	}
+
+	// Rewrite the raw representation since it gets served through ActivityPub.
+	// I don't expect anything to understand anything but ActivityPub IDs.
+	raw := match
+	if group(6) == "" {
+		raw = ">>" + ref.APID
+	}
+
+	if refBoard != board {
+		// Post on another board; not a reply, see above
+		if ref.Thread == 0 {
+			return raw, fmt.Sprintf(`<a href="/%s/%d" class="cite cross">&gt;&gt;&gt;/%s/%d</a>`, refBoard, ref.ID, refBoard, ref.ID), 0, nil
+		}
+		return raw, fmt.Sprintf(`<a href="/%s/%d#p%d" class="cite cross">&gt;&gt;&gt;/%s/%d</a>`, refBoard, ref.Thread, ref.ID, refBoard, ref.ID), 0, nil
+	} else if ref.Thread == p.Thread {
+		// Reply to another post on this thread
+		return raw, fmt.Sprintf(`<a href="#p%d" class="cite">&gt;&gt;%d</a>`, ref.ID, ref.ID), ref.ID, nil
+	} else if ref.Thread == 0 && p.Thread == ref.ID {
+		// OP
+		return raw, fmt.Sprintf(`<a href="/%s/%d#p%d" class="cite">&gt;&gt;%d (OP)</a>`, board, ref.ID, ref.ID, ref.ID), ref.ID, nil
+	}
+
+	// Cross-cite
+	if ref.Thread == 0 {
+		return raw, fmt.Sprintf(`<a href="/%s/%d" class="cite cross">&gt;&gt;%d (Cross-thread)</a>`, board, ref.ID, ref.ID), 0, nil
+	}
+	return raw, fmt.Sprintf(`<a href="/%s/%d#p%d" class="cite cross">&gt;&gt;%d (Cross-thread)</a>`, board, ref.Thread, ref.ID, ref.ID), 0, nil
 }
 
-func formatPost(board string, p *Post, repmap map[string]string, fn func(match string) (Post, error)) ([]PostID, error) {
-	s := html.EscapeString(p.Raw)
-	reps := make([]PostID, 0, len(repmap))
+// formatPost renders the raw text of p into its content, and returns the
+// posts it replies to.
+// Cites are rewritten in the raw text to ActivityPub IDs; nothing else in it
+// is touched.
+func formatPost(board string, p *Post, fn citeFinder) ([]PostID, error) {
+	src := strings.ReplaceAll(p.Raw, "\r\n", "\n")
+	reps := []PostID{}
+	var ferr error
+
+	// Rewrites of cites in the raw text, by where they start in src
+	type rewrite struct {
+		start, end int
+		raw        string
+	}
+	rewrites := []rewrite{}
 
-	for match, target := range repmap {
-		repl := ""
+	p.Content = markup.Render(src, func(s string) (string, int) {
+		if ferr != nil {
+			return "", 0
+		}
 
-		ref, err := fn(target)
-		targetEscHtml := html.EscapeString(target)
-		if errors.Is(err, sql.ErrNoRows) {
-			// bad cite
-			repl = fmt.Sprintf(`<a href="#" class="cite invalid">&gt;&gt;%s</a>`, targetEscHtml)
-			goto repl
-		} else if err != nil {
-			return reps, err
+		m := leadingCiteRegex.FindStringSubmatch(s)
+		if m == nil {
+			return "", 0
 		}
 
-		// Rewrite the raw representation since it gets served through ActivityPub.
-		// This is only necessary if this is an ID cite.
-		// I don't expect anything to understand numeric cites.
-		if target[0] != 'h' { // h(ttp)... AP cite
-			p.Raw = strings.ReplaceAll(p.Raw, match, ">>"+ref.APID)
+		// Numbers and short forms mean nothing coming from other instances
+		if !p.IsLocal() && m[6] == "" {
+			return "", 0
 		}
 
-		if ref.Thread == p.Thread {
-			// Reply to another post on this thread
-			reps = append(reps, ref.ID)
-			repl = fmt.Sprintf(`<a href="#p%d" class="cite">&gt;&gt;%d</a>`, ref.ID, ref.ID)
-		} else if ref.Thread == 0 && p.Thread == ref.ID {
-			// OP
-			reps = append(reps, ref.ID)
-			repl = fmt.Sprintf(`<a href="/%s/%d#p%d" class="cite">&gt;&gt;%d (OP)</a>`, board, ref.ID, ref.ID, ref.ID)
-		} else {
-			// Cross-cite
-			if ref.Thread == 0 {
-				repl = fmt.Sprintf(`<a href="/%s/%d" class="cite cross">&gt;&gt;%d (Cross-thread)</a>`, board, ref.ID, ref.ID)
-			} else {
-				repl = fmt.Sprintf(`<a href="/%s/%d#p%d" class="cite cross">&gt;&gt;%d (Cross-thread)</a>`, board, ref.Thread, ref.ID, ref.ID)
-			}
+		raw, h, rep, err := formatCite(board, p, m, fn)
+		if err != nil {
+			ferr = err
+			return "", 0
+		}
+
+		if rep != 0 {
+			reps = append(reps, rep)
 		}
 
-	repl:
-		s = strings.ReplaceAll(s, html.EscapeString(match), repl)
+		start := len(src) - len(s)
+		rewrites = append(rewrites, rewrite{start, start + len(m[0]), raw})
+		return h, len(m[0])
+	})
+
+	if ferr != nil {
+		return reps, ferr
 	}
 
-	s = quoteRegex.ReplaceAllString(s, `<span class="quote">&gt;$1</span>`)
-	s = strings.ReplaceAll(s, "\n", "<br/>")
+	raw := &strings.Builder{}
+	last := 0
+	for _, r := range rewrites {
+		raw.WriteString(src[last:r.start])
+		raw.WriteString(r.raw)
+		last = r.end
+	}
+	raw.WriteString(src[last:])
+	p.Raw = raw.String()
 
-	p.Content = s
 	return reps, nil
 }
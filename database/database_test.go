@@ -0,0 +1,190 @@
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// testBoards are the posts testCite knows about, by board.
+var testBoards = map[string][]Post{
+	"prog": {
+		{ID: 1, APID: "http://localhost/prog/AAA1"},
+		{ID: 2, Thread: 1, APID: "http://localhost/prog/AAA2"},
+		{ID: 3, APID: "http://localhost/prog/AAA3"},
+		{ID: 4, Thread: 1, APID: "https://fchan.xyz/prog/F00D", Source: "https://fchan.xyz/prog"},
+	},
+	"tech": {
+		{ID: 5, APID: "http://localhost/tech/BBB5"},
+		{ID: 6, Thread: 5, APID: "http://localhost/tech/BBB6"},
+	},
+}
+
+// testCite finds posts in testBoards.
+// Post 9 on prog was deleted.
+func testCite(board, match string) (Post, error) {
+	posts, ok := testBoards[board]
+	if !ok {
+		return Post{}, sql.ErrNoRows
+	} else if match == "" {
+		return Post{}, nil
+	}
+
+	for _, p := range posts {
+		if p.APID == match || strconv.Itoa(int(p.ID)) == match {
+			return p, nil
+		}
+	}
+
+	if board == "prog" && match == "9" {
+		return Post{}, ErrPostDeleted
+	}
+
+	return Post{}, sql.ErrNoRows
+}
+
+func TestFormatPost(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  bool
+		in      string
+		raw     string
+		content string
+		reps    []PostID
+	}{
+		{
+			name:    "reply",
+			in:      ">>2 yes",
+			raw:     ">>http://localhost/prog/AAA2 yes",
+			content: `<a href="#p2" class="cite">&gt;&gt;2</a> yes`,
+			reps:    []PostID{2},
+		},
+		{
+			name:    "op",
+			in:      ">>1",
+			raw:     ">>http://localhost/prog/AAA1",
+			content: `<a href="/prog/1#p1" class="cite">&gt;&gt;1 (OP)</a>`,
+			reps:    []PostID{1},
+		},
+		{
+			name:    "other thread",
+			in:      ">>3",
+			raw:     ">>http://localhost/prog/AAA3",
+			content: `<a href="/prog/3" class="cite cross">&gt;&gt;3 (Cross-thread)</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "by apid",
+			in:      ">>http://localhost/prog/AAA2",
+			raw:     ">>http://localhost/prog/AAA2",
+			content: `<a href="#p2" class="cite">&gt;&gt;2</a>`,
+			reps:    []PostID{2},
+		},
+		{
+			name:    "other board",
+			in:      ">>>/tech/6",
+			raw:     ">>http://localhost/tech/BBB6",
+			content: `<a href="/tech/5#p6" class="cite cross">&gt;&gt;&gt;/tech/6</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "other board by apid",
+			in:      ">>http://localhost/tech/BBB5",
+			raw:     ">>http://localhost/tech/BBB5",
+			content: `<a href="/tech/5" class="cite cross">&gt;&gt;&gt;/tech/5</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "board",
+			in:      ">>>/tech/",
+			raw:     ">>>/tech/",
+			content: `<a href="/tech/" class="cite board">&gt;&gt;&gt;/tech/</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "missing board",
+			in:      ">>>/nope/",
+			raw:     ">>>/nope/",
+			content: `<a href="#" class="cite invalid">&gt;&gt;&gt;/nope/</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "other instance",
+			in:      ">>>@fchan.xyz/prog/F00D",
+			raw:     ">>https://fchan.xyz/prog/F00D",
+			content: `<a href="#p4" class="cite">&gt;&gt;4</a>`,
+			reps:    []PostID{4},
+		},
+		{
+			name:    "deleted",
+			in:      ">>9",
+			raw:     ">>9",
+			content: `<a href="#" class="cite deleted">&gt;&gt;9</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "missing",
+			in:      ">>99",
+			raw:     ">>99",
+			content: `<a href="#" class="cite invalid">&gt;&gt;99</a>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "around text",
+			in:      "a >>2\r\n>b >>>/tech/5 c",
+			raw:     "a >>http://localhost/prog/AAA2\n>b >>http://localhost/tech/BBB5 c",
+			content: `a <a href="#p2" class="cite">&gt;&gt;2</a><br/><span class="quote">&gt;b <a href="/tech/5" class="cite cross">&gt;&gt;&gt;/tech/5</a> c</span>`,
+			reps:    []PostID{2},
+		},
+		{
+			name:    "not in code",
+			in:      "`>>2`",
+			raw:     "`>>2`",
+			content: "<code>&gt;&gt;2</code>",
+			reps:    []PostID{},
+		},
+		{
+			name:    "number from another instance",
+			remote:  true,
+			in:      ">>2",
+			raw:     ">>2",
+			content: `<span class="quote">&gt;&gt;2</span>`,
+			reps:    []PostID{},
+		},
+		{
+			name:    "apid from another instance",
+			remote:  true,
+			in:      ">>http://localhost/prog/AAA2",
+			raw:     ">>http://localhost/prog/AAA2",
+			content: `<a href="#p2" class="cite">&gt;&gt;2</a>`,
+			reps:    []PostID{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Post{ID: 10, Thread: 1, Raw: tt.in, Source: "127.0.0.1"}
+			if tt.remote {
+				p.Source = "https://fchan.xyz/prog"
+			}
+
+			reps, err := formatPost("prog", &p, testCite)
+			if err != nil {
+				t.Fatalf("formatPost: %v", err)
+			}
+
+			if p.Raw != tt.raw {
+				t.Errorf("raw = %q, want %q", p.Raw, tt.raw)
+			}
+
+			if p.Content != tt.content {
+				t.Errorf("content = %q, want %q", p.Content, tt.content)
+			}
+
+			if !reflect.DeepEqual(reps, tt.reps) {
+				t.Errorf("reps = %v, want %v", reps, tt.reps)
+			}
+		})
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/util"
 	_ "github.com/mattn/go-sqlite3"
 
 	"math/rand"
@@ -24,8 +26,25 @@ import (
 type SqliteDatabase struct {
 	conn    *sql.DB
 	regexps map[int]*regexp.Regexp
+
+	// Posts formatted by an older version of formatPost are sent to stale
+	// when they're read, and formatted again by freshen.
+	stale       chan stalePost
+	staleQueued map[stalePost]bool
+	staleLock   sync.Mutex
+	done        chan struct{}
+}
+
+// stalePost is a post that needs to be formatted again.
+type stalePost struct {
+	board string
+	id    PostID
 }
 
+// staleQueueSize is how many posts may wait to be formatted again.
+// Posts read while it's full are queued the next time they're read.
+const staleQueueSize = 1000
+
 func init() {
 	Engines["sqlite3"] = func(arg string) (Database, error) {
 		db, err := sql.Open("sqlite3", arg+"?cache=shared")
@@ -40,7 +59,13 @@ func init() {
 			return nil, fmt.Errorf("upgrade database: %w", err)
 		}
 
-		sdb := &SqliteDatabase{conn: db, regexps: make(map[int]*regexp.Regexp)}
+		sdb := &SqliteDatabase{
+			conn:        db,
+			regexps:     make(map[int]*regexp.Regexp),
+			stale:       make(chan stalePost, staleQueueSize),
+			staleQueued: make(map[stalePost]bool),
+			done:        make(chan struct{}),
+		}
 
 		// Fetch regexps and compile them
 		regexps, err := sdb.Regexps(context.Background())
@@ -58,6 +83,8 @@ func init() {
 			sdb.regexps[rexp.ID] = re
 		}
 
+		go sdb.freshen()
+
 		return sdb, nil
 	}
 }
@@ -73,12 +100,25 @@ func (db *SqliteDatabase) audit(ctx context.Context, modAction ModerationAction)
 	return err
 }
 
+// auditTx records a moderation action.
+// Keep in sync with audit.
+func (db *SqliteDatabase) auditTx(ctx context.Context, tx *sql.Tx, modAction ModerationAction) error {
+	if modAction.Date.IsZero() {
+		modAction.Date = time.Now().UTC()
+	}
+
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO auditlog(type, date, author, board, post, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		modAction.Type, modAction.Date.Unix(), modAction.Author, modAction.Board, modAction.Post, modAction.Reason)
+	return err
+}
+
 // Board gets data about a board.
 func (db *SqliteDatabase) Board(ctx context.Context, id string) (Board, error) {
 	id = safeBoardId(id)
 	board := Board{}
 
-	if err := db.conn.QueryRowContext(ctx, `SELECT id, title, description FROM boards WHERE id = ?`, id).Scan(&board.ID, &board.Title, &board.Description); err != nil {
+	if err := db.conn.QueryRowContext(ctx, `SELECT id, title, description, push FROM boards WHERE id = ?`, id).Scan(&board.ID, &board.Title, &board.Description, &board.Push); err != nil {
 		return board, err
 	}
 
@@ -91,7 +131,7 @@ func (db *SqliteDatabase) Board(ctx context.Context, id string) (Board, error) {
 
 // Boards returns a list of all boards.
 func (db *SqliteDatabase) Boards(ctx context.Context) ([]Board, error) {
-	rows, err := db.conn.QueryContext(ctx, "SELECT id, title, description FROM boards ORDER BY id")
+	rows, err := db.conn.QueryContext(ctx, "SELECT id, title, description, push FROM boards ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +142,7 @@ func (db *SqliteDatabase) Boards(ctx context.Context) ([]Board, error) {
 	for rows.Next() {
 		board := Board{}
 
-		if err := rows.Scan(&board.ID, &board.Title, &board.Description); err != nil {
+		if err := rows.Scan(&board.ID, &board.Title, &board.Description, &board.Push); err != nil {
 			return boards, err
 		}
 
@@ -124,9 +164,9 @@ func (db *SqliteDatabase) Threads(ctx context.Context, board string, page int) (
 	if page > 0 {
 		offset := (page - 1) * config.ThreadsPerPage
 		limit := config.ThreadsPerPage
-		rows, err = db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags FROM posts_%s WHERE thread IS 0 ORDER BY bumpdate DESC LIMIT ? OFFSET ?`, board), limit, offset)
+		rows, err = db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered FROM posts_%s WHERE thread IS 0 ORDER BY bumpdate DESC LIMIT ? OFFSET ?`, board), limit, offset)
 	} else {
-		rows, err = db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags FROM posts_%s WHERE thread IS 0 ORDER BY bumpdate DESC`, board))
+		rows, err = db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered FROM posts_%s WHERE thread IS 0 ORDER BY bumpdate DESC`, board))
 	}
 
 	if err != nil {
@@ -135,14 +175,15 @@ func (db *SqliteDatabase) Threads(ctx context.Context, board string, page int) (
 	defer rows.Close()
 
 	posts := []Post{}
+	stale := []int{}
 
 	for rows.Next() {
 		post := Post{}
 		var ttime int64
 		var btime int64 // Should never be nil
-		flags := 0
+		flags, rendered := 0, 0
 
-		if err := rows.Scan(&post.ID, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags); err != nil {
+		if err := rows.Scan(&post.ID, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags, &rendered); err != nil {
 			return posts, err
 		}
 
@@ -151,10 +192,20 @@ func (db *SqliteDatabase) Threads(ctx context.Context, board string, page int) (
 		post.Thread = post.ID
 		post.readFlags(flags)
 
+		if rendered < renderVersion {
+			stale = append(stale, len(posts))
+		}
+
 		posts = append(posts, post)
 	}
 
-	return posts, rows.Err()
+	if err := rows.Err(); err != nil {
+		return posts, err
+	}
+	rows.Close()
+
+	db.queueStale(board, posts, stale)
+	return posts, nil
 }
 
 // Thread fetches all posts on a thread.
@@ -169,9 +220,9 @@ func (db *SqliteDatabase) Thread(ctx context.Context, board string, thread PostI
 
 	var rows *sql.Rows
 	if tail > 0 {
-		rows, err = tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags FROM posts_%s WHERE id = :thread OR id IN (SELECT id FROM posts_%s WHERE thread = :thread ORDER BY id DESC LIMIT :tail);`, board, board), sql.Named("thread", thread), sql.Named("tail", tail))
+		rows, err = tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered FROM posts_%s WHERE id = :thread OR id IN (SELECT id FROM posts_%s WHERE thread = :thread ORDER BY id DESC LIMIT :tail);`, board, board), sql.Named("thread", thread), sql.Named("tail", tail))
 	} else {
-		rows, err = tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags FROM posts_%s WHERE thread IS ? OR id IS ? ORDER BY id ASC`, board), thread, thread)
+		rows, err = tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered FROM posts_%s WHERE thread IS ? OR id IS ? ORDER BY id ASC`, board), thread, thread)
 	}
 	if err != nil {
 		return nil, err
@@ -179,14 +230,15 @@ func (db *SqliteDatabase) Thread(ctx context.Context, board string, thread PostI
 	defer rows.Close()
 
 	posts := []Post{}
+	stale := []int{}
 
 	for rows.Next() {
 		post := Post{Thread: thread}
 		var ttime int64
 		var btime *int64 // Will most likely be nil
-		flags := 0
+		flags, rendered := 0, 0
 
-		if err := rows.Scan(&post.ID, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags); err != nil {
+		if err := rows.Scan(&post.ID, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags, &rendered); err != nil {
 			return posts, err
 		}
 
@@ -196,6 +248,10 @@ func (db *SqliteDatabase) Thread(ctx context.Context, board string, thread PostI
 		}
 		post.readFlags(flags)
 
+		if rendered < renderVersion {
+			stale = append(stale, len(posts))
+		}
+
 		if replies {
 			post.Replies, err = db.repliesTx(ctx, tx, board, post.ID)
 			if err != nil {
@@ -212,6 +268,8 @@ func (db *SqliteDatabase) Thread(ctx context.Context, board string, thread PostI
 		err = sql.ErrNoRows
 	}
 
+	db.queueStale(board, posts, stale)
+
 	tx.Commit() // TODO: Unsure how to handle this error, should be non-fatal anyway.
 
 	return posts, err
@@ -229,18 +287,100 @@ func (db *SqliteDatabase) ThreadStat(ctx context.Context, board string, thread P
 	return posts, posters, row.Scan(&posts, &posters)
 }
 
+// LastModified returns when a post was last made, bumped, edited or deleted
+// on a thread, or anywhere on the board if thread is 0.
+func (db *SqliteDatabase) LastModified(ctx context.Context, board string, thread PostID) (time.Time, error) {
+	board = safeBoardId(board)
+
+	// Keep in sync with ThreadActivity
+	var q string
+	if thread == 0 {
+		q = fmt.Sprintf(`SELECT max(
+	ifnull((SELECT max(max(date, ifnull(bumpdate, 0))) FROM posts_%s), 0),
+	ifnull((SELECT max(date) FROM revisions_%s), 0),
+	ifnull((SELECT max(date) FROM tombstones WHERE board = :board), 0))`, board, board)
+	} else {
+		q = fmt.Sprintf(`SELECT max(
+	ifnull((SELECT max(max(date, ifnull(bumpdate, 0))) FROM posts_%s WHERE id = :thread OR thread = :thread), 0),
+	ifnull((SELECT max(date) FROM revisions_%s WHERE post IN (SELECT id FROM posts_%s WHERE id = :thread OR thread = :thread)), 0),
+	ifnull((SELECT max(date) FROM tombstones WHERE board = :board AND thread = :thread), 0))`, board, board, board)
+	}
+
+	var t int64
+	if err := db.conn.QueryRowContext(ctx, q, sql.Named("board", board), sql.Named("thread", thread)).Scan(&t); err != nil {
+		return time.Time{}, err
+	} else if t == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(t, 0).UTC(), nil
+}
+
+// ThreadActivity returns the reply count and LastModified of every thread
+// on a board, in the same order as Threads.
+func (db *SqliteDatabase) ThreadActivity(ctx context.Context, board string) ([]ThreadActivity, error) {
+	board = safeBoardId(board)
+
+	// Keep in sync with LastModified
+	rows, err := db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT t.id,
+	(SELECT count(id) FROM posts_%[1]s WHERE thread = t.id),
+	max(
+		ifnull((SELECT max(max(date, ifnull(bumpdate, 0))) FROM posts_%[1]s WHERE id = t.id OR thread = t.id), 0),
+		ifnull((SELECT max(date) FROM revisions_%[1]s WHERE post IN (SELECT id FROM posts_%[1]s WHERE id = t.id OR thread = t.id)), 0),
+		ifnull((SELECT max(date) FROM tombstones WHERE board = ? AND thread = t.id), 0))
+FROM posts_%[1]s t WHERE t.thread IS 0 ORDER BY t.bumpdate DESC`, board), board)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []ThreadActivity{}
+	for rows.Next() {
+		t := ThreadActivity{}
+		var mtime int64
+
+		if err := rows.Scan(&t.ID, &t.Replies, &mtime); err != nil {
+			return threads, err
+		}
+
+		if mtime != 0 {
+			t.LastModified = time.Unix(mtime, 0).UTC()
+		}
+
+		threads = append(threads, t)
+	}
+
+	return threads, rows.Err()
+}
+
+// PostCount returns the number of posts on a board.
+// If local is set, posts from other instances aren't counted.
+func (db *SqliteDatabase) PostCount(ctx context.Context, board string, local bool) (int, error) {
+	board = safeBoardId(board)
+
+	q := fmt.Sprintf(`SELECT count(id) FROM posts_%s`, board)
+	if local {
+		// Keep in sync with Post.IsLocal
+		q += ` WHERE source NOT LIKE 'http%'`
+	}
+
+	n := 0
+	err := db.conn.QueryRowContext(ctx, q).Scan(&n)
+	return n, err
+}
+
 // Post fetches a single post from a thread.
 func (db *SqliteDatabase) Post(ctx context.Context, board string, id PostID) (Post, error) {
 	board = safeBoardId(board)
 
-	row := db.conn.QueryRowContext(ctx, fmt.Sprintf(`SELECT thread, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags FROM posts_%s WHERE id = ?`, board), id)
+	row := db.conn.QueryRowContext(ctx, fmt.Sprintf(`SELECT thread, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered FROM posts_%s WHERE id = ?`, board), id)
 	post := Post{ID: id}
 
 	var ttime int64
 	var btime *int64
-	flags := 0
+	flags, rendered := 0, 0
 
-	err := row.Scan(&post.Thread, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags)
+	err := row.Scan(&post.Thread, &post.Name, &post.Tripcode, &post.Subject, &ttime, &post.Raw, &post.Content, &post.Source, &btime, &post.APID, &flags, &rendered)
 	if err != nil {
 		return post, err
 	}
@@ -251,6 +391,10 @@ func (db *SqliteDatabase) Post(ctx context.Context, board string, id PostID) (Po
 	}
 	post.readFlags(flags)
 
+	if rendered < renderVersion {
+		db.queueStale(board, []Post{post}, []int{0})
+	}
+
 	return post, err
 }
 
@@ -331,6 +475,47 @@ func (db *SqliteDatabase) findAPIDTx(ctx context.Context, tx *sql.Tx, board stri
 	return post, err
 }
 
+// Tombstone finds what remains of a deleted post given its ActivityPub ID or
+// its post number.
+func (db *SqliteDatabase) Tombstone(ctx context.Context, board string, match string) (Tombstone, error) {
+	board = safeBoardId(board)
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Tombstone{}, err
+	}
+	defer tx.Rollback()
+
+	return db.tombstoneTx(ctx, tx, board, match)
+}
+
+// tombstoneTx finds what remains of a deleted post.
+// Keep in sync with Tombstone.
+func (db *SqliteDatabase) tombstoneTx(ctx context.Context, tx *sql.Tx, board string, match string) (Tombstone, error) {
+	board = safeBoardId(board)
+
+	var row *sql.Row
+	if strings.HasPrefix(match, "http") {
+		row = tx.QueryRowContext(ctx, `SELECT post, apid, date, reason FROM tombstones WHERE board = ? AND apid = ?`, board, match)
+	} else {
+		id, err := strconv.Atoi(match)
+		if err != nil {
+			return Tombstone{}, sql.ErrNoRows
+		}
+
+		row = tx.QueryRowContext(ctx, `SELECT post, apid, date, reason FROM tombstones WHERE board = ? AND post = ?`, board, id)
+	}
+
+	t := Tombstone{Board: board}
+	var date int64
+	if err := row.Scan(&t.Post, &t.APID, &date, &t.Reason); err != nil {
+		return t, err
+	}
+
+	t.Date = time.Unix(date, 0).UTC()
+	return t, nil
+}
+
 // Privilege returns the type of moderator username is.
 func (db *SqliteDatabase) Privilege(ctx context.Context, username string) (ModType, error) {
 	row := db.conn.QueryRowContext(ctx, `SELECT type FROM moderators WHERE username = ?`, username)
@@ -591,11 +776,37 @@ func (db *SqliteDatabase) Replies(ctx context.Context, board string, id PostID,
 	return posts, rows.Err()
 }
 
+// Revisions returns the previous versions of a post, oldest first.
+func (db *SqliteDatabase) Revisions(ctx context.Context, board string, post PostID) ([]Revision, error) {
+	board = safeBoardId(board)
+
+	rows, err := db.conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, date, editor, subject, raw, content FROM revisions_%s WHERE post = ? ORDER BY id`, board), post)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []Revision{}
+
+	for rows.Next() {
+		r := Revision{Post: post}
+		var date int64
+		if err := rows.Scan(&r.ID, &date, &r.Editor, &r.Subject, &r.Raw, &r.Content); err != nil {
+			return revs, err
+		}
+
+		r.Date = time.Unix(date, 0).UTC()
+		revs = append(revs, r)
+	}
+
+	return revs, rows.Err()
+}
+
 // Following returns a list of Actors a board is following.
 func (db *SqliteDatabase) Following(ctx context.Context, board string) ([]string, error) {
 	board = safeBoardId(board)
 
-	rows, err := db.conn.QueryContext(ctx, `SELECT target FROM following WHERE board = ?`, board)
+	rows, err := db.conn.QueryContext(ctx, `SELECT target FROM following WHERE board = ? AND state = ?`, board, FollowAccepted)
 	if err != nil {
 		return nil, err
 	}
@@ -615,6 +826,30 @@ func (db *SqliteDatabase) Following(ctx context.Context, board string) ([]string
 	return following, rows.Err()
 }
 
+// FollowRequests returns every follow a board has sent, regardless of state.
+func (db *SqliteDatabase) FollowRequests(ctx context.Context, board string) ([]Follow, error) {
+	board = safeBoardId(board)
+
+	rows, err := db.conn.QueryContext(ctx, `SELECT target, state FROM following WHERE board = ?`, board)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+
+	for rows.Next() {
+		f := Follow{Board: board}
+		if err := rows.Scan(&f.Target, &f.State); err != nil {
+			return follows, err
+		}
+
+		follows = append(follows, f)
+	}
+
+	return follows, rows.Err()
+}
+
 // Followers returns a list of Actors a board is being followed by.
 func (db *SqliteDatabase) Followers(ctx context.Context, board string) ([]string, error) {
 	board = safeBoardId(board)
@@ -639,178 +874,569 @@ func (db *SqliteDatabase) Followers(ctx context.Context, board string) ([]string
 	return followers, rows.Err()
 }
 
-// Regexps returns a list of regular expressions for filtering posts.
-func (db *SqliteDatabase) Regexps(ctx context.Context) ([]Regexp, error) {
-	rows, err := db.conn.QueryContext(ctx, `SELECT id,pattern FROM regexps`)
+// Syncs returns the most recent outbox syncs, newest first.
+func (db *SqliteDatabase) Syncs(ctx context.Context, limit int) ([]Sync, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, board, target, date, duration, posts, error FROM syncs ORDER BY id DESC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	regexps := []Regexp{}
+	syncs := []Sync{}
 
 	for rows.Next() {
-		f := Regexp{}
-		if err := rows.Scan(&f.ID, &f.Pattern); err != nil {
-			return regexps, err
+		s := Sync{}
+		var date, dur int64
+		if err := rows.Scan(&s.ID, &s.Board, &s.Target, &date, &dur, &s.Posts, &s.Error); err != nil {
+			return syncs, err
 		}
 
-		regexps = append(regexps, f)
+		s.Date = time.Unix(date, 0).UTC()
+		s.Duration = time.Duration(dur) * time.Millisecond
+		syncs = append(syncs, s)
 	}
 
-	return regexps, rows.Err()
+	return syncs, rows.Err()
 }
 
-// Banned checks to see if a user is banned.
-func (db *SqliteDatabase) Banned(ctx context.Context, source string) (bool, time.Time, string, error) {
-	row := db.conn.QueryRowContext(ctx, "SELECT expires, reason FROM bans WHERE source = ?", source)
+// LastSync returns the last successful sync of target's outbox on board.
+func (db *SqliteDatabase) LastSync(ctx context.Context, board string, target string) (Sync, error) {
+	board = safeBoardId(board)
 
-	var ttime *int64
-	reason := ""
+	row := db.conn.QueryRowContext(ctx, `SELECT id, date, duration, posts FROM syncs WHERE board = ? AND target = ? AND error = '' ORDER BY id DESC LIMIT 1`, board, target)
 
-	if err := row.Scan(&ttime, &reason); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return false, time.Time{}, reason, err
-	} else if errors.Is(err, sql.ErrNoRows) {
-		// Not banned
-		return true, time.Time{}, "", nil
+	s := Sync{Board: board, Target: target}
+	var date, dur int64
+	if err := row.Scan(&s.ID, &date, &dur, &s.Posts); err != nil {
+		return s, err
 	}
 
-	if ttime != nil {
-		exp := time.Unix(*ttime, 0).UTC()
+	s.Date = time.Unix(date, 0).UTC()
+	s.Duration = time.Duration(dur) * time.Millisecond
+	return s, nil
+}
 
-		if time.Now().UTC().After(exp) {
-			// Delete
-			_, err := db.conn.ExecContext(ctx, "DELETE FROM bans WHERE source = ?", source)
-			return true, exp, "", err
-		}
+// Key returns a signing key by name.
+func (db *SqliteDatabase) Key(ctx context.Context, name string) (Key, error) {
+	key := Key{Name: name}
+	var date int64
 
-		return false, exp, reason, nil
+	if err := db.conn.QueryRowContext(ctx, `SELECT private, public, sealed, date FROM keys WHERE name = ?`, name).Scan(&key.Private, &key.Public, &key.Sealed, &date); err != nil {
+		return key, err
 	}
 
-	return false, time.Time{}, reason, nil
+	key.Date = time.Unix(date, 0).UTC()
+	return key, nil
 }
 
-// AddFollow records an Actor as following a board.
-func (db *SqliteDatabase) AddFollow(ctx context.Context, source string, board string) error {
-	board = safeBoardId(board)
+// Keys returns every signing key.
+func (db *SqliteDatabase) Keys(ctx context.Context) ([]Key, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT name, private, public, sealed, date FROM keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	_, err := db.conn.ExecContext(ctx, "INSERT OR IGNORE INTO followers(source, board) VALUES(?, ?)", source, board)
-	return err
-}
+	keys := []Key{}
 
-// AddFollowing records a board is following an Actor.
-func (db *SqliteDatabase) AddFollowing(ctx context.Context, board string, target string) error {
-	board = safeBoardId(board)
+	for rows.Next() {
+		key := Key{}
+		var date int64
 
-	_, err := db.conn.ExecContext(ctx, "INSERT OR IGNORE INTO following(board, target) VALUES(?, ?)", board, target)
-	return err
-}
+		if err := rows.Scan(&key.Name, &key.Private, &key.Public, &key.Sealed, &date); err != nil {
+			return keys, err
+		}
 
-// AddRegexp adds a regular expression to the post filter.
-func (db *SqliteDatabase) AddRegexp(ctx context.Context, pattern string) error {
-	// Compile it first
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return err
+		key.Date = time.Unix(date, 0).UTC()
+		keys = append(keys, key)
 	}
 
-	n, err := db.conn.ExecContext(ctx, "INSERT OR IGNORE INTO regexps(pattern) VALUES(?)", pattern)
+	return keys, rows.Err()
+}
+
+// Regexps returns a list of regular expressions for filtering posts.
+func (db *SqliteDatabase) Regexps(ctx context.Context) ([]Regexp, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id,pattern FROM regexps`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	var id int64
-	if id, err = n.LastInsertId(); err == nil {
-		db.regexps[int(id)] = re
-	}
+	regexps := []Regexp{}
 
-	return err
-}
+	for rows.Next() {
+		f := Regexp{}
+		if err := rows.Scan(&f.ID, &f.Pattern); err != nil {
+			return regexps, err
+		}
 
-// Ban bans a user.
-func (db *SqliteDatabase) Ban(ctx context.Context, ban Ban, by string) error {
-	// This is used to prevent passing an absurdly large amount of arguments.
-	// Of course, we still do that, this just looks nicer :)
-	args := []interface{}{
-		sql.Named("source", ban.Target),
-		sql.Named("placed", time.Now().UTC().Unix()),
-		sql.Named("expires", ban.Expires.Unix()),
-		sql.Named("reason", ban.Reason),
+		regexps = append(regexps, f)
 	}
 
-	_, err := db.conn.ExecContext(ctx, `INSERT INTO bans(source, placed, expires, reason) VALUES(:source, :placed, :expires, :reason) ON CONFLICT(source) DO UPDATE SET expires = excluded.expires, reason = excluded.reason`, args...)
+	return regexps, rows.Err()
+}
+
+// Blocks returns a list of blocked instances.
+func (db *SqliteDatabase) Blocks(ctx context.Context) ([]Block, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT host, reason, date FROM blocks ORDER BY host`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Create audit entry
-	return db.audit(ctx, ModerationAction{
-		Author: by,
-		Type:   ModActionBan,
-		Reason: fmt.Sprintf("banned %s until %s: %s", ban.Target, ban.Expires.String(), ban.Reason),
-		Date:   time.Now().UTC(),
-	})
-}
+	blocks := []Block{}
 
-// SaveBoard updates data about a board, or creates a new one.
-func (db *SqliteDatabase) SaveBoard(ctx context.Context, board Board) error {
-	// This is used to prevent passing an absurdly large amount of arguments.
-	// Of course, we still do that, this just looks nicer :)
-	args := []interface{}{
-		sql.Named("id", board.ID),
-		sql.Named("title", board.Title),
-		sql.Named("description", board.Description),
+	for rows.Next() {
+		b := Block{}
+		var date int64
+		if err := rows.Scan(&b.Host, &b.Reason, &date); err != nil {
+			return blocks, err
+		}
+
+		b.Date = time.Unix(date, 0).UTC()
+		blocks = append(blocks, b)
 	}
 
-	board.ID = safeBoardId(board.ID)
+	return blocks, rows.Err()
+}
 
-	_, err := db.conn.ExecContext(ctx, `INSERT INTO boards(id, title, description) VALUES(:id, :title, :description) ON CONFLICT(id) DO UPDATE SET title = excluded.title, description = excluded.description`, args...)
+// Relays returns every subscription to a relay.
+func (db *SqliteDatabase) Relays(ctx context.Context) ([]Relay, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT board, target, state, date FROM relays ORDER BY board, target`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Create posts table
-	_, err = db.conn.ExecContext(ctx, strings.ReplaceAll(sqliteNewBoard, "{board}", board.ID))
-	return err
-}
-
-func (db *SqliteDatabase) findPost(ctx context.Context, tx *sql.Tx, board string) func(match string) (Post, error) {
-	board = safeBoardId(board)
+	relays := []Relay{}
 
-	return func(match string) (Post, error) {
-		if match[0] == 'h' { // AP
-			return db.findAPIDTx(ctx, tx, board, match)
+	for rows.Next() {
+		r := Relay{}
+		var date int64
+		if err := rows.Scan(&r.Board, &r.Target, &r.State, &date); err != nil {
+			return relays, err
 		}
 
-		id, _ := strconv.Atoi(match) // Won't fail
-		return db.postTx(ctx, tx, board, PostID(id))
+		r.Date = time.Unix(date, 0).UTC()
+		relays = append(relays, r)
 	}
+
+	return relays, rows.Err()
 }
 
-// SavePostTx saves a post to the database, in a transaction.
-// If Post.ID is 0, one will be generated. If not, it will update an existing post.
-// If Post.Thread is 0, it is considered a thread.
-func (db *SqliteDatabase) SavePostTx(ctx context.Context, tx *sql.Tx, board string, post *Post) error {
+// Relay returns the subscription of a board to a relay.
+func (db *SqliteDatabase) Relay(ctx context.Context, board string, target string) (Relay, error) {
 	board = safeBoardId(board)
 
-	if post.Date.IsZero() {
-		post.Date = time.Now().UTC()
+	r := Relay{Board: board, Target: target}
+	var date int64
+	if err := db.conn.QueryRowContext(ctx, `SELECT state, date FROM relays WHERE board = ? AND target = ?`, board, target).Scan(&r.State, &date); err != nil {
+		return r, err
 	}
 
-	// Forbid empty posting
-	if strings.TrimSpace(post.Raw) == "" {
-		return ErrPostContents
+	r.Date = time.Unix(date, 0).UTC()
+	return r, nil
+}
+
+// Activities returns the most recently received activities, newest first.
+func (db *SqliteDatabase) Activities(ctx context.Context, limit int) ([]Activity, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, board, apid, actor, type, body, state, error, attempts, date FROM activities ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Check to see if this post is hit by the filter
-	for _, regexp := range db.regexps {
-		if regexp.MatchString(post.Raw) {
-			return ErrPostRejected
-		}
+	return scanActivities(rows)
+}
+
+// PendingActivities returns every activity that hasn't been processed yet,
+// oldest first.
+func (db *SqliteDatabase) PendingActivities(ctx context.Context) ([]Activity, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, board, apid, actor, type, body, state, error, attempts, date FROM activities WHERE state = ? ORDER BY id ASC`, ActivityPending)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Generate APID
-	// Random hex number for now
+	return scanActivities(rows)
+}
+
+// FailedActivities returns every activity that failed to be processed in
+// fewer than attempts attempts, oldest first.
+func (db *SqliteDatabase) FailedActivities(ctx context.Context, attempts int) ([]Activity, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, board, apid, actor, type, body, state, error, attempts, date FROM activities WHERE state = ? AND attempts < ? ORDER BY id ASC`, ActivityFailed, attempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanActivities(rows)
+}
+
+func scanActivities(rows *sql.Rows) ([]Activity, error) {
+	acts := []Activity{}
+
+	for rows.Next() {
+		a := Activity{}
+		var date int64
+		if err := rows.Scan(&a.ID, &a.Board, &a.APID, &a.Actor, &a.Type, &a.Body, &a.State, &a.Error, &a.Attempts, &date); err != nil {
+			return acts, err
+		}
+
+		a.Date = time.Unix(date, 0).UTC()
+		acts = append(acts, a)
+	}
+
+	return acts, rows.Err()
+}
+
+// Tokens returns every API token.
+func (db *SqliteDatabase) Tokens(ctx context.Context) ([]Token, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, name, boards, scopes, rate, date, lastused FROM tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// UseToken returns the API token secret belongs to, and records that it was
+// used.
+// sql.ErrNoRows is returned if there is none.
+func (db *SqliteDatabase) UseToken(ctx context.Context, secret string) (Token, error) {
+	h := hashToken(secret)
+
+	t, err := scanToken(db.conn.QueryRowContext(ctx, `SELECT id, name, boards, scopes, rate, date, lastused FROM tokens WHERE hash = ?`, h))
+	if err != nil {
+		return t, err
+	}
+
+	_, err = db.conn.ExecContext(ctx, `UPDATE tokens SET lastused = ? WHERE id = ?`, time.Now().UTC().Unix(), t.ID)
+	return t, err
+}
+
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	t := Token{}
+	var boards string
+	var date, lastused int64
+
+	if err := row.Scan(&t.ID, &t.Name, &boards, &t.Scopes, &t.Rate, &date, &lastused); err != nil {
+		return t, err
+	}
+
+	if boards != "" {
+		t.Boards = strings.Split(boards, ",")
+	}
+
+	t.Date = time.Unix(date, 0).UTC()
+	if lastused != 0 {
+		t.LastUsed = time.Unix(lastused, 0).UTC()
+	}
+
+	return t, nil
+}
+
+// Peers returns what we know about every instance we have talked to.
+func (db *SqliteDatabase) Peers(ctx context.Context) ([]Peer, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT host, requests, failures, latency, lastdelivery, inbound, lastinbound FROM peers ORDER BY host`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := []Peer{}
+
+	for rows.Next() {
+		p := Peer{Failures: map[int]int{}}
+		var failures string
+		var latency, lastdelivery, lastinbound int64
+
+		if err := rows.Scan(&p.Host, &p.Requests, &failures, &latency, &lastdelivery, &p.Inbound, &lastinbound); err != nil {
+			return peers, err
+		}
+
+		// Failures are stored as "status:count,status:count"
+		for _, f := range strings.Split(failures, ",") {
+			status, count, ok := strings.Cut(f, ":")
+			if !ok {
+				continue
+			}
+
+			s, err := strconv.Atoi(status)
+			if err != nil {
+				continue
+			}
+
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				continue
+			}
+
+			p.Failures[s] = n
+		}
+
+		p.Latency = time.Duration(latency) * time.Millisecond
+		if lastdelivery != 0 {
+			p.LastDelivery = time.Unix(lastdelivery, 0).UTC()
+		}
+		if lastinbound != 0 {
+			p.LastInbound = time.Unix(lastinbound, 0).UTC()
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, rows.Err()
+}
+
+// Banned checks to see if a user is banned.
+func (db *SqliteDatabase) Banned(ctx context.Context, source string) (bool, time.Time, string, error) {
+	row := db.conn.QueryRowContext(ctx, "SELECT expires, reason FROM bans WHERE source = ?", source)
+
+	var ttime *int64
+	reason := ""
+
+	if err := row.Scan(&ttime, &reason); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, reason, err
+	} else if errors.Is(err, sql.ErrNoRows) {
+		// Not banned
+		return true, time.Time{}, "", nil
+	}
+
+	if ttime != nil {
+		exp := time.Unix(*ttime, 0).UTC()
+
+		if time.Now().UTC().After(exp) {
+			// Delete
+			_, err := db.conn.ExecContext(ctx, "DELETE FROM bans WHERE source = ?", source)
+			return true, exp, "", err
+		}
+
+		return false, exp, reason, nil
+	}
+
+	return false, time.Time{}, reason, nil
+}
+
+// Blocked checks to see if a host, or any domain above it, is blocked.
+func (db *SqliteDatabase) Blocked(ctx context.Context, host string) (bool, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// Check example.com for foo.bar.example.com, and so on.
+	// This is also going to check "com", but that's fine.
+	hosts := []interface{}{}
+	for host != "" {
+		hosts = append(hosts, host)
+
+		i := strings.IndexByte(host, '.')
+		if i == -1 {
+			break
+		}
+		host = host[i+1:]
+	}
+
+	if len(hosts) == 0 {
+		return false, nil
+	}
+
+	count := 0
+	q := "SELECT COUNT(*) FROM blocks WHERE host IN (?" + strings.Repeat(",?", len(hosts)-1) + ")"
+	err := db.conn.QueryRowContext(ctx, q, hosts...).Scan(&count)
+	return count > 0, err
+}
+
+// AddFollow records an Actor as following a board, and reports whether it
+// wasn't following it already.
+func (db *SqliteDatabase) AddFollow(ctx context.Context, source string, board string) (bool, error) {
+	board = safeBoardId(board)
+
+	res, err := db.conn.ExecContext(ctx, "INSERT OR IGNORE INTO followers(source, board) VALUES(?, ?)", source, board)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// AddFollowing records a board is following an Actor, or updates the state of
+// an existing follow.
+func (db *SqliteDatabase) AddFollowing(ctx context.Context, board string, target string, state FollowState) error {
+	board = safeBoardId(board)
+
+	_, err := db.conn.ExecContext(ctx, "INSERT INTO following(board, target, state) VALUES(?, ?, ?) ON CONFLICT(board, target) DO UPDATE SET state = excluded.state", board, target, state)
+	return err
+}
+
+// AddRegexp adds a regular expression to the post filter.
+func (db *SqliteDatabase) AddRegexp(ctx context.Context, pattern string) error {
+	// Compile it first
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	n, err := db.conn.ExecContext(ctx, "INSERT OR IGNORE INTO regexps(pattern) VALUES(?)", pattern)
+	if err != nil {
+		return err
+	}
+
+	var id int64
+	if id, err = n.LastInsertId(); err == nil {
+		db.regexps[int(id)] = re
+	}
+
+	return err
+}
+
+// AddBlock blocks an instance.
+func (db *SqliteDatabase) AddBlock(ctx context.Context, block Block) error {
+	host := strings.ToLower(strings.TrimSuffix(block.Host, "."))
+	if block.Date.IsZero() {
+		block.Date = time.Now().UTC()
+	}
+
+	_, err := db.conn.ExecContext(ctx, "INSERT OR REPLACE INTO blocks(host, reason, date) VALUES(?, ?, ?)", host, block.Reason, block.Date.Unix())
+	return err
+}
+
+// Ban bans a user.
+func (db *SqliteDatabase) Ban(ctx context.Context, ban Ban, by string) error {
+	// This is used to prevent passing an absurdly large amount of arguments.
+	// Of course, we still do that, this just looks nicer :)
+	args := []interface{}{
+		sql.Named("source", ban.Target),
+		sql.Named("placed", time.Now().UTC().Unix()),
+		sql.Named("expires", ban.Expires.Unix()),
+		sql.Named("reason", ban.Reason),
+	}
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO bans(source, placed, expires, reason) VALUES(:source, :placed, :expires, :reason) ON CONFLICT(source) DO UPDATE SET expires = excluded.expires, reason = excluded.reason`, args...)
+	if err != nil {
+		return err
+	}
+
+	// Create audit entry
+	return db.audit(ctx, ModerationAction{
+		Author: by,
+		Type:   ModActionBan,
+		Reason: fmt.Sprintf("banned %s until %s: %s", ban.Target, ban.Expires.String(), ban.Reason),
+		Date:   time.Now().UTC(),
+	})
+}
+
+// SaveBoard updates data about a board, or creates a new one.
+func (db *SqliteDatabase) SaveBoard(ctx context.Context, board Board) error {
+	// This is used to prevent passing an absurdly large amount of arguments.
+	// Of course, we still do that, this just looks nicer :)
+	args := []interface{}{
+		sql.Named("id", board.ID),
+		sql.Named("title", board.Title),
+		sql.Named("description", board.Description),
+		sql.Named("push", board.Push),
+	}
+
+	board.ID = safeBoardId(board.ID)
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO boards(id, title, description, push) VALUES(:id, :title, :description, :push) ON CONFLICT(id) DO UPDATE SET title = excluded.title, description = excluded.description, push = excluded.push`, args...)
+	if err != nil {
+		return err
+	}
+
+	// Create posts table
+	_, err = db.conn.ExecContext(ctx, strings.ReplaceAll(sqliteNewBoard, "{board}", board.ID))
+	return err
+}
+
+func (db *SqliteDatabase) findPost(ctx context.Context, tx *sql.Tx) citeFinder {
+	return func(board, match string) (Post, error) {
+		board = safeBoardId(board)
+
+		// Cites can point to other boards, which may not exist.
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT count() FROM boards WHERE id = ?`, board).Scan(&n); err != nil {
+			return Post{}, err
+		} else if n == 0 {
+			return Post{}, sql.ErrNoRows
+		} else if match == "" {
+			return Post{}, nil
+		}
+
+		var post Post
+		var err error
+
+		if match[0] == 'h' { // AP
+			post, err = db.findAPIDTx(ctx, tx, board, match)
+		} else {
+			id, _ := strconv.Atoi(match) // Won't fail
+			post, err = db.postTx(ctx, tx, board, PostID(id))
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			// Check if it used to exist.
+			if _, terr := db.tombstoneTx(ctx, tx, board, match); terr == nil {
+				err = ErrPostDeleted
+			}
+		}
+
+		return post, err
+	}
+}
+
+// filter checks if the contents of a post are acceptable.
+func (db *SqliteDatabase) filter(raw string) error {
+	// Forbid empty posting
+	if strings.TrimSpace(raw) == "" {
+		return ErrPostContents
+	}
+
+	// Check to see if this post is hit by the filter
+	for _, regexp := range db.regexps {
+		if regexp.MatchString(raw) {
+			return ErrPostRejected
+		}
+	}
+
+	return nil
+}
+
+// SavePostTx saves a post to the database, in a transaction.
+// If Post.ID is 0, one will be generated. If not, it will update an existing post.
+// If Post.Thread is 0, it is considered a thread.
+func (db *SqliteDatabase) SavePostTx(ctx context.Context, tx *sql.Tx, board string, post *Post) error {
+	board = safeBoardId(board)
+
+	if post.Date.IsZero() {
+		post.Date = time.Now().UTC()
+	}
+
+	if err := db.filter(post.Raw); err != nil {
+		return err
+	}
+
+	// Don't bring back what we've deleted.
+	if post.ID == 0 && post.APID != "" {
+		if _, err := db.tombstoneTx(ctx, tx, board, post.APID); err == nil {
+			return ErrPostDeleted
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	// Generate APID
+	// Random hex number for now
 	if post.APID == "" {
 		// TODO: This really sucks. Really. However, it does work well enough. 16^8 possible different IDs.
 		// This sucks even more to avoid a bug.
@@ -821,8 +1447,7 @@ func (db *SqliteDatabase) SavePostTx(ctx context.Context, tx *sql.Tx, board stri
 	var err error
 	var reps []PostID
 	if post.Content == "" {
-		repmap := findReplies(post)
-		reps, err = formatPost(board, post, repmap, db.findPost(ctx, tx, board))
+		reps, err = formatPost(board, post, db.findPost(ctx, tx))
 		if err != nil {
 			return err
 		}
@@ -845,14 +1470,15 @@ func (db *SqliteDatabase) SavePostTx(ctx context.Context, tx *sql.Tx, board stri
 		sql.Named("tripcode", post.Tripcode),
 		sql.Named("bumpdate", post.Date.Unix()),
 		sql.Named("flags", post.flags()),
+		sql.Named("rendered", renderVersion),
 	}
 
 	if post.ID == 0 {
 		// We are creating a new post.
 
 		r, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO
-			posts_%s(thread, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags) VALUES (
-				:thread, :name, :tripcode, :subject, :date, :raw, :content, :source, :bumpdate, :apid, :flags)`,
+			posts_%s(thread, name, tripcode, subject, date, raw, content, source, bumpdate, apid, flags, rendered) VALUES (
+				:thread, :name, :tripcode, :subject, :date, :raw, :content, :source, :bumpdate, :apid, :flags, :rendered)`,
 			board), args...)
 		if err != nil {
 			return err
@@ -888,7 +1514,7 @@ func (db *SqliteDatabase) SavePostTx(ctx context.Context, tx *sql.Tx, board stri
 	// the user controls.
 	args = append(args, sql.Named("id", post.ID))
 	_, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE posts_%s SET name =
-		:name, tripcode = :tripcode, subject = :subject, raw = :raw, content = :content WHERE id = :id`,
+		:name, tripcode = :tripcode, subject = :subject, raw = :raw, content = :content, rendered = :rendered WHERE id = :id`,
 		board), args...)
 	return err
 }
@@ -912,6 +1538,397 @@ func (db *SqliteDatabase) SavePost(ctx context.Context, board string, post *Post
 	return tx.Commit()
 }
 
+// EditPost replaces the subject and contents of an existing post with those of
+// post, keeping the old version as a revision, and records a moderation action.
+// The post is formatted again and its replies are updated.
+func (db *SqliteDatabase) EditPost(ctx context.Context, board string, post *Post, editor string) error {
+	board = safeBoardId(board)
+
+	if err := db.filter(post.Raw); err != nil {
+		return err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := db.postTx(ctx, tx, board, post.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO revisions_%s(post, date, editor, subject, raw, content) VALUES (?, ?, ?, ?, ?, ?)`, board),
+		old.ID, time.Now().UTC().Unix(), editor, old.Subject, old.Raw, old.Content); err != nil {
+		return err
+	}
+
+	// Everything else stays as it was.
+	subject, raw := post.Subject, post.Raw
+	*post = old
+	post.Subject = subject
+	post.Raw = raw
+	post.SJIS = util.IsJapanese(raw)
+	post.Edited = true
+
+	reps, err := formatPost(board, post, db.findPost(ctx, tx))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE posts_%s SET subject = ?, raw = ?, content = ?, flags = ?, rendered = ? WHERE id = ?`, board),
+		post.Subject, post.Raw, post.Content, post.flags(), renderVersion, post.ID); err != nil {
+		return err
+	}
+
+	// The post may cite different posts now.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM replies_%s WHERE source = ?`, board), post.ID); err != nil {
+		return err
+	}
+
+	// See SavePostTx.
+	if post.Thread != 0 {
+		for _, v := range reps {
+			if err := db.addReplyTx(ctx, tx, board, post.ID, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return db.audit(ctx, ModerationAction{
+		Author: editor,
+		Type:   ModActionEdit,
+		Board:  board,
+		Post:   post.ID,
+		Reason: "Edited.",
+	})
+}
+
+// renderTx formats post again from its raw text and saves it, replacing its
+// replies.
+func (db *SqliteDatabase) renderTx(ctx context.Context, tx *sql.Tx, board string, post *Post) error {
+	p := *post
+	if p.Thread == p.ID {
+		// Threads and Thread fill this in for threads too
+		p.Thread = 0
+	}
+
+	reps, err := formatPost(board, &p, db.findPost(ctx, tx))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE posts_%s SET raw = ?, content = ?, rendered = ? WHERE id = ?`, board),
+		p.Raw, p.Content, renderVersion, p.ID); err != nil {
+		return err
+	}
+
+	// See EditPost.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM replies_%s WHERE source = ?`, board), p.ID); err != nil {
+		return err
+	}
+
+	if p.Thread != 0 {
+		for _, v := range reps {
+			if err := db.addReplyTx(ctx, tx, board, p.ID, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	post.Raw, post.Content = p.Raw, p.Content
+	return nil
+}
+
+// queueStale queues the posts at the indexes in stale to be formatted again,
+// since they were formatted by an older version of formatPost.
+// They are shown as they are until then, so reads never have to write.
+func (db *SqliteDatabase) queueStale(board string, posts []Post, stale []int) {
+	db.staleLock.Lock()
+	defer db.staleLock.Unlock()
+
+	for _, i := range stale {
+		key := stalePost{board, posts[i].ID}
+		if db.staleQueued[key] {
+			continue
+		}
+
+		select {
+		case db.stale <- key:
+			db.staleQueued[key] = true
+		default:
+			// Full; they'll be queued when they're read again.
+			return
+		}
+	}
+}
+
+// freshen formats posts sent to db.stale again, one at a time, until the
+// database is closed.
+// Failing isn't fatal; the post keeps what it had.
+func (db *SqliteDatabase) freshen() {
+	for {
+		var key stalePost
+		select {
+		case <-db.done:
+			return
+		case key = <-db.stale:
+		}
+
+		if err := db.freshenPost(context.Background(), key.board, key.id); err != nil {
+			log.Printf("unable to format post %d on %s again: %s", key.id, key.board, err)
+		}
+
+		db.staleLock.Lock()
+		delete(db.staleQueued, key)
+		db.staleLock.Unlock()
+	}
+}
+
+// freshenPost formats a post again, unless that was done in the meantime.
+func (db *SqliteDatabase) freshenPost(ctx context.Context, board string, id PostID) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	post := Post{ID: id}
+	rendered := 0
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT thread, raw, source, rendered FROM posts_%s WHERE id = ?`, board), id).Scan(&post.Thread, &post.Raw, &post.Source, &rendered); errors.Is(err, sql.ErrNoRows) {
+		// Deleted since
+		return nil
+	} else if err != nil {
+		return err
+	} else if rendered >= renderVersion {
+		return nil
+	}
+
+	if err := db.renderTx(ctx, tx, board, &post); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RenderPosts formats every post on board again from its raw text, and
+// updates their replies.
+// Posts are done a few at a time so the board can still be used in the
+// meantime.
+// It returns how many posts were formatted.
+func (db *SqliteDatabase) RenderPosts(ctx context.Context, board string) (int, error) {
+	board = safeBoardId(board)
+
+	const batch = 100
+	n := 0
+	last := PostID(0)
+
+	for {
+		tx, err := db.conn.BeginTx(ctx, nil)
+		if err != nil {
+			return n, err
+		}
+
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, thread, raw, source FROM posts_%s WHERE id > ? ORDER BY id LIMIT ?`, board), last, batch)
+		if err != nil {
+			tx.Rollback()
+			return n, err
+		}
+
+		posts := []Post{}
+		for rows.Next() {
+			post := Post{}
+			if err := rows.Scan(&post.ID, &post.Thread, &post.Raw, &post.Source); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return n, err
+			}
+			posts = append(posts, post)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			tx.Rollback()
+			return n, err
+		}
+
+		for i := range posts {
+			if err := db.renderTx(ctx, tx, board, &posts[i]); err != nil {
+				tx.Rollback()
+				return n, err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+
+		n += len(posts)
+		if len(posts) < batch {
+			return n, nil
+		}
+
+		last = posts[len(posts)-1].ID
+	}
+}
+
+// SaveSync records the result of an outbox sync.
+func (db *SqliteDatabase) SaveSync(ctx context.Context, sync Sync) error {
+	board := safeBoardId(sync.Board)
+	if sync.Date.IsZero() {
+		sync.Date = time.Now().UTC()
+	}
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO syncs(board, target, date, duration, posts, error) VALUES(?, ?, ?, ?, ?, ?)`,
+		board, sync.Target, sync.Date.Unix(), sync.Duration.Milliseconds(), sync.Posts, sync.Error)
+	return err
+}
+
+// SaveRelay subscribes to a relay, or updates the state of a subscription.
+func (db *SqliteDatabase) SaveRelay(ctx context.Context, relay Relay) error {
+	board := safeBoardId(relay.Board)
+	if relay.Date.IsZero() {
+		relay.Date = time.Now().UTC()
+	}
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO relays(board, target, state, date) VALUES(?, ?, ?, ?)
+		ON CONFLICT(board, target) DO UPDATE SET state = excluded.state`,
+		board, relay.Target, relay.State, relay.Date.Unix())
+	return err
+}
+
+// SavePeers saves what we know about other instances, replacing what was
+// saved for them before.
+func (db *SqliteDatabase) SavePeers(ctx context.Context, peers []Peer) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range peers {
+		failures := make([]string, 0, len(p.Failures))
+		for status, n := range p.Failures {
+			failures = append(failures, fmt.Sprintf("%d:%d", status, n))
+		}
+
+		var lastdelivery, lastinbound int64
+		if !p.LastDelivery.IsZero() {
+			lastdelivery = p.LastDelivery.Unix()
+		}
+		if !p.LastInbound.IsZero() {
+			lastinbound = p.LastInbound.Unix()
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO peers(host, requests, failures, latency, lastdelivery, inbound, lastinbound) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			p.Host, p.Requests, strings.Join(failures, ","), p.Latency.Milliseconds(), lastdelivery, p.Inbound, lastinbound); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveActivity records an activity that was received, and sets its ID.
+func (db *SqliteDatabase) SaveActivity(ctx context.Context, act *Activity) error {
+	act.Board = safeBoardId(act.Board)
+	if act.Date.IsZero() {
+		act.Date = time.Now().UTC()
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO activities(board, apid, actor, type, body, state, error, attempts, date) VALUES(?, ?, ?, ?, ?, ?, ?, 0, ?)`,
+		act.Board, act.APID, act.Actor, act.Type, act.Body, act.State, act.Error, act.Date.Unix())
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 1 {
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		act.ID = int(id)
+		return tx.Commit()
+	}
+
+	// It was sent again; take it again if we failed to process it before.
+	err = tx.QueryRowContext(ctx, `SELECT id, attempts FROM activities WHERE board = ? AND apid = ? AND state = ?`, act.Board, act.APID, ActivityFailed).Scan(&act.ID, &act.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrActivityExists
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE activities SET body = ?, state = ?, error = ?, date = ? WHERE id = ?`, act.Body, act.State, act.Error, act.Date.Unix(), act.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetActivityState records how processing an activity went.
+// Setting it to anything but pending counts as an attempt.
+func (db *SqliteDatabase) SetActivityState(ctx context.Context, id int, state ActivityState, reason string) error {
+	attempt := 0
+	if state != ActivityPending {
+		attempt = 1
+	}
+
+	_, err := db.conn.ExecContext(ctx, `UPDATE activities SET state = ?, error = ?, attempts = attempts + ? WHERE id = ?`, state, reason, attempt, id)
+	return err
+}
+
+// SaveToken makes a new API token, and returns the token itself.
+// Token.ID is filled in.
+func (db *SqliteDatabase) SaveToken(ctx context.Context, token *Token) (string, error) {
+	if token.Date.IsZero() {
+		token.Date = time.Now().UTC()
+	}
+
+	boards := make([]string, len(token.Boards))
+	for i, b := range token.Boards {
+		boards[i] = safeBoardId(b)
+	}
+
+	secret, h := newToken()
+
+	res, err := db.conn.ExecContext(ctx, `INSERT INTO tokens(name, hash, boards, scopes, rate, date, lastused) VALUES(?, ?, ?, ?, ?, ?, 0)`,
+		token.Name, h, strings.Join(boards, ","), token.Scopes, token.Rate, token.Date.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	id, err := res.LastInsertId()
+	token.ID = int(id)
+	return secret, err
+}
+
+// SaveKey saves a signing key, replacing any other with the same name.
+func (db *SqliteDatabase) SaveKey(ctx context.Context, key Key) error {
+	if key.Date.IsZero() {
+		key.Date = time.Now().UTC()
+	}
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO keys(name, private, public, sealed, date) VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET private = excluded.private, public = excluded.public, sealed = excluded.sealed, date = excluded.date`,
+		key.Name, key.Private, key.Public, key.Sealed, key.Date.Unix())
+	return err
+}
+
 // SaveModerator updates data about a moderator, or creates a new one.
 func (db *SqliteDatabase) SaveModerator(ctx context.Context, username, email, password string, priv ModType) error {
 	ns := sql.NullString{
@@ -1038,39 +2055,83 @@ func (db *SqliteDatabase) addReplyTx(ctx context.Context, tx *sql.Tx, board stri
 }
 
 // DeleteThread deletes a thread from the database and records a moderation action.
-// It will also delete all posts and reports.
+// It will also delete all posts and reports, and leave tombstones behind.
 func (db *SqliteDatabase) DeleteThread(ctx context.Context, board string, thread PostID, modAction ModerationAction) error {
 	board = safeBoardId(board)
 
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Delete all associated reports.
-	_, err := db.conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM reports WHERE board = ? AND post IN (SELECT id FROM posts_%s WHERE id = ? OR thread = ?)", board), board, thread, thread)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM reports WHERE board = ? AND post IN (SELECT id FROM posts_%s WHERE id = ? OR thread = ?)", board), board, thread, thread)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO tombstones(board, post, thread, apid, date, reason) SELECT ?, id, ?, apid, ?, ? FROM posts_%s WHERE id = ? OR thread = ?", board),
+		board, thread, time.Now().UTC().Unix(), modAction.Reason, thread, thread)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM revisions_%s WHERE post IN (SELECT id FROM posts_%s WHERE id = ? OR thread = ?)", board, board), thread, thread)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM posts_%s WHERE id = ? OR thread = ?", board), thread, thread)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM posts_%s WHERE id = ? OR thread = ?", board), thread, thread)
 	if err != nil {
 		return err
 	}
 
-	return db.audit(ctx, modAction)
+	if err := db.auditTx(ctx, tx, modAction); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // DeletePost deletes a post from the database and records a moderation action.
+// A tombstone is left behind.
 func (db *SqliteDatabase) DeletePost(ctx context.Context, board string, post PostID, modAction ModerationAction) error {
 	board = safeBoardId(board)
 
-	_, err := db.conn.ExecContext(ctx, `DELETE FROM reports WHERE board = ? AND post = ?`, board, post)
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM reports WHERE board = ? AND post = ?`, board, post)
+	if err != nil {
+		return err
+	}
+
+	// Threads are the thread of their own tombstone
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO tombstones(board, post, thread, apid, date, reason) SELECT ?, id, CASE thread WHEN 0 THEN id ELSE thread END, apid, ?, ? FROM posts_%s WHERE id = ?", board),
+		board, time.Now().UTC().Unix(), modAction.Reason, post)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM posts_%s WHERE id = ?", board), post)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM revisions_%s WHERE post = ?", board), post)
 	if err != nil {
 		return err
 	}
 
-	return db.audit(ctx, modAction)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM posts_%s WHERE id = ?", board), post)
+	if err != nil {
+		return err
+	}
+
+	if err := db.auditTx(ctx, tx, modAction); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // DeleteNews deletes news.
@@ -1110,6 +2171,38 @@ func (db *SqliteDatabase) DeleteRegexp(ctx context.Context, id int) error {
 	return err
 }
 
+// DeleteBlock unblocks an instance.
+func (db *SqliteDatabase) DeleteBlock(ctx context.Context, host string) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM blocks WHERE host = ?", strings.ToLower(host))
+	return err
+}
+
+// DeleteRelay removes a subscription to a relay.
+func (db *SqliteDatabase) DeleteRelay(ctx context.Context, board string, target string) error {
+	board = safeBoardId(board)
+
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM relays WHERE board = ? AND target = ?", board, target)
+	return err
+}
+
+// DeleteToken revokes an API token.
+func (db *SqliteDatabase) DeleteToken(ctx context.Context, id int) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM tokens WHERE id = ?", id)
+	return err
+}
+
+// DeletePeer forgets what we know about an instance.
+func (db *SqliteDatabase) DeletePeer(ctx context.Context, host string) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM peers WHERE host = ?", host)
+	return err
+}
+
+// PruneActivities deletes processed activities received before t.
+func (db *SqliteDatabase) PruneActivities(ctx context.Context, t time.Time) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM activities WHERE state != ? AND date < ?", ActivityPending, t.Unix())
+	return err
+}
+
 func (db *SqliteDatabase) password(ctx context.Context, username string) ([]byte, []byte, error) {
 	row := db.conn.QueryRowContext(ctx, `SELECT hash, salt FROM moderators WHERE username = ?`, username)
 
@@ -1170,5 +2263,6 @@ func (db *SqliteDatabase) RecentPosts(ctx context.Context, board string, limit i
 
 // Close closes the database. This should only be called upon exit.
 func (db *SqliteDatabase) Close() error {
+	close(db.done)
 	return db.conn.Close()
 }
@@ -8,11 +8,12 @@ package database
 
 import (
 	"context"
+	"errors"
 	"testing"
 )
 
 func initTest() Database {
-	db, err := Engines["sqlite3"]("file::memory:?cache=shared")
+	db, err := Engines["sqlite3"]("file::memory:")
 	if err != nil {
 		panic(err)
 	}
@@ -31,7 +32,7 @@ func makeGarbage(db Database) []PostID {
 		t := Post{
 			Name:     "test",
 			Tripcode: "abc",
-			Content:  "def",
+			Raw:      "def",
 			Source:   "ghi",
 		}
 
@@ -46,7 +47,7 @@ func makeGarbage(db Database) []PostID {
 				Thread:   t.ID,
 				Name:     "test",
 				Tripcode: "abc",
-				Content:  "hello world",
+				Raw:      "hello world",
 				Source:   "ghi",
 			}
 
@@ -74,7 +75,7 @@ func TestSqliteDatabase_Thread(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run("", func(t *testing.T) {
-			got, err := db.Thread(context.Background(), "b", tt.thread)
+			got, err := db.Thread(context.Background(), "b", tt.thread, 0, false)
 			if err != nil {
 				t.Errorf("SqliteDatabase.Thread() error = %v", err)
 				return
@@ -225,3 +226,94 @@ func TestSqliteDatabase_DeletePost(t *testing.T) {
 		})
 	}
 }
+
+func TestSqliteDatabase_Tombstone(t *testing.T) {
+	db := initTest()
+	defer db.Close()
+
+	ctx := context.Background()
+
+	op := Post{Name: "test", Raw: "op", Source: "https://example.com/b", APID: "https://example.com/b/OP"}
+	if err := db.SavePost(ctx, "b", &op); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := Post{Thread: op.ID, Name: "test", Raw: "spam", Source: "https://example.com/b", APID: "https://example.com/b/SPAM"}
+	if err := db.SavePost(ctx, "b", &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		del  func() error
+		post Post
+	}{
+		{"post", func() error {
+			return db.DeletePost(ctx, "b", reply.ID, ModerationAction{})
+		}, Post{Thread: op.ID, Name: "test", Raw: "spam", Source: "https://example.com/b", APID: reply.APID}},
+		{"thread", func() error {
+			return db.DeleteThread(ctx, "b", op.ID, ModerationAction{})
+		}, Post{Name: "test", Raw: "op", Source: "https://example.com/b", APID: op.APID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.del(); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+
+			if _, err := db.FindAPID(ctx, "b", tt.post.APID); err == nil {
+				t.Errorf("post still exists after being deleted")
+			}
+
+			if err := db.SavePost(ctx, "b", &tt.post); !errors.Is(err, ErrPostDeleted) {
+				t.Errorf("SqliteDatabase.SavePost() of a deleted post error = %v, want %v", err, ErrPostDeleted)
+			}
+		})
+	}
+}
+
+func TestSqliteDatabase_ThreadActivity(t *testing.T) {
+	db := initTest()
+	defer db.Close()
+
+	ctx := context.Background()
+	ts := makeGarbage(db)
+
+	// Tombstones count too
+	replies, err := db.Thread(ctx, "b", ts[3], 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeletePost(ctx, "b", replies[1].ID, ModerationAction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	threads, err := db.Threads(ctx, "b", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.ThreadActivity(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(threads) {
+		t.Fatalf("SqliteDatabase.ThreadActivity() returned %d threads, want %d", len(got), len(threads))
+	}
+
+	for i, th := range threads {
+		posts, _, err := db.ThreadStat(ctx, "b", th.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modified, err := db.LastModified(ctx, "b", th.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := ThreadActivity{ID: th.ID, Replies: posts - 1, LastModified: modified}
+		if got[i] != want {
+			t.Errorf("SqliteDatabase.ThreadActivity()[%d] = %+v, want %+v", i, got[i], want)
+		}
+	}
+}
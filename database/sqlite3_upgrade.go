@@ -18,6 +18,7 @@ CREATE TABLE boards(
 	id TEXT,
 	title TEXT,
 	description TEXT,
+	push INTEGER NOT NULL DEFAULT 0,
 
 	UNIQUE(id)
 );
@@ -103,6 +104,7 @@ CREATE TABLE followers(
 CREATE TABLE following(
 	board TEXT,
 	target TEXT,
+	state INTEGER NOT NULL DEFAULT 1,
 
 	UNIQUE(board, target),
 	FOREIGN KEY(board) REFERENCES boards(id)
@@ -114,10 +116,106 @@ CREATE TABLE regexps(
 
 	UNIQUE(pattern)
 );
+
+CREATE TABLE blocks(
+	host TEXT,
+	reason TEXT,
+	date INTEGER,
+
+	UNIQUE(host)
+);
+
+CREATE TABLE tombstones(
+	board TEXT,
+	post INTEGER,
+	thread INTEGER,
+	apid TEXT,
+
+	date INTEGER,
+	reason TEXT,
+
+	UNIQUE(board, apid),
+	FOREIGN KEY(board) REFERENCES boards(id)
+);
+
+CREATE TABLE syncs(
+	id INTEGER PRIMARY KEY ASC,
+
+	board TEXT,
+	target TEXT,
+
+	date INTEGER,
+	duration INTEGER,
+	posts INTEGER,
+	error TEXT,
+
+	FOREIGN KEY(board) REFERENCES boards(id)
+);
+
+CREATE TABLE keys(
+	name TEXT PRIMARY KEY,
+
+	private BLOB,
+	public TEXT,
+	sealed INTEGER,
+
+	date INTEGER
+);
+
+CREATE TABLE relays(
+	board TEXT,
+	target TEXT,
+	state INTEGER,
+	date INTEGER,
+
+	PRIMARY KEY(board, target)
+);
+
+CREATE TABLE activities(
+	id INTEGER PRIMARY KEY ASC,
+
+	board TEXT,
+	apid TEXT,
+	actor TEXT,
+	type TEXT,
+	body TEXT,
+
+	state INTEGER,
+	error TEXT,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	date INTEGER,
+
+	UNIQUE(board, apid)
+);
+
+CREATE TABLE tokens(
+	id INTEGER PRIMARY KEY ASC,
+
+	name TEXT,
+	hash TEXT UNIQUE,
+	boards TEXT,
+	scopes INTEGER,
+	rate INTEGER,
+
+	date INTEGER,
+	lastused INTEGER
+);
+
+CREATE TABLE peers(
+	host TEXT PRIMARY KEY,
+
+	requests INTEGER,
+	failures TEXT,
+	latency INTEGER,
+	lastdelivery INTEGER,
+
+	inbound INTEGER,
+	lastinbound INTEGER
+);
 `
 
 const sqliteNewBoard = `
-CREATE TABLE posts_{board}(
+CREATE TABLE IF NOT EXISTS posts_{board}(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	thread INTEGER,
 
@@ -135,11 +233,12 @@ CREATE TABLE posts_{board}(
 	apid TEXT,
 
 	flags INTEGER NOT NULL DEFAULT 0,
+	rendered INTEGER NOT NULL DEFAULT 0,
 
 	UNIQUE(apid)
 );
 
-CREATE TABLE replies_{board}(
+CREATE TABLE IF NOT EXISTS replies_{board}(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 
 	source INTEGER,
@@ -149,10 +248,48 @@ CREATE TABLE replies_{board}(
 	FOREIGN KEY(target) REFERENCES posts_{board}(id),
 	UNIQUE(source,target)
 );
+
+CREATE TABLE IF NOT EXISTS revisions_{board}(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post INTEGER,
+
+	date INTEGER,
+	editor TEXT,
+
+	subject TEXT,
+	raw TEXT,
+	content TEXT,
+
+	FOREIGN KEY(post) REFERENCES posts_{board}(id)
+);
 `
 
 var errUpgradeContinue = fmt.Errorf("continue upgrade")
 
+// findReplies finds the cites in a post for the Replies upgrade, keyed by how
+// they were written.
+// It only understands the cites of the time, and must not change with the ones
+// posts are formatted with now.
+func findReplies(p *Post) map[string]string {
+	s := p.Raw
+
+	repmap := map[string]string{}
+
+	// Database functionality in here isn't implemented greatly but it'll work more or less
+	// Don't bother with local cites from external sources
+	if p.IsLocal() {
+		for _, v := range citeRegex.FindAllString(s, -1) {
+			repmap[v] = v[len(">>"):]
+		}
+	}
+
+	for _, v := range apCiteRegex.FindAllString(s, -1) {
+		repmap[v] = v[len(">>"):]
+	}
+
+	return repmap
+}
+
 // sqliteUpgrades is a list of functions that upgrade the database's schema
 // enough up to the next version after it.
 // This is called by quering `PRAGMA user_version` and then selecting all
@@ -354,6 +491,202 @@ var sqliteUpgrades = []func(*sql.Tx) error{
 		_, err := tx.Exec(`ALTER TABLE moderators ADD COLUMN email TEXT`)
 		return err
 	},
+	func(tx *sql.Tx) error { // Instance blocklist
+		_, err := tx.Exec(`CREATE TABLE blocks(
+	host TEXT,
+	reason TEXT,
+	date INTEGER,
+
+	UNIQUE(host)
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Follow state
+		// Everything we're following now was assumed to be accepted.
+		_, err := tx.Exec(`ALTER TABLE following ADD COLUMN state INTEGER NOT NULL DEFAULT 1`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Post revisions
+		// Be *extremely* careful here, you cannot simply defer rows.Close() here.
+
+		rows, err := tx.Query(`select id from boards`)
+		if err != nil {
+			return err
+		}
+
+		// Collect a list of boards.
+		boards := []string{}
+		for rows.Next() {
+			board := ""
+			if err := rows.Scan(&board); err != nil {
+				rows.Close()
+				return err
+			}
+			boards = append(boards, board)
+		}
+		rows.Close()
+
+		for _, board := range boards {
+			if _, err := tx.Exec(fmt.Sprintf(`CREATE TABLE revisions_%s(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post INTEGER,
+
+	date INTEGER,
+	editor TEXT,
+
+	subject TEXT,
+	raw TEXT,
+	content TEXT,
+
+	FOREIGN KEY(post) REFERENCES posts_%s(id)
+)`, board, board)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+	func(tx *sql.Tx) error { // Tombstones
+		_, err := tx.Exec(`CREATE TABLE tombstones(
+	board TEXT,
+	post INTEGER,
+	apid TEXT,
+
+	date INTEGER,
+	reason TEXT,
+
+	UNIQUE(board, apid),
+	FOREIGN KEY(board) REFERENCES boards(id)
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Outbox syncs
+		_, err := tx.Exec(`CREATE TABLE syncs(
+	id INTEGER PRIMARY KEY ASC,
+
+	board TEXT,
+	target TEXT,
+
+	date INTEGER,
+	duration INTEGER,
+	posts INTEGER,
+	error TEXT,
+
+	FOREIGN KEY(board) REFERENCES boards(id)
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Signing keys
+		_, err := tx.Exec(`CREATE TABLE keys(
+	name TEXT PRIMARY KEY,
+
+	private BLOB,
+	public TEXT,
+	sealed INTEGER,
+
+	date INTEGER
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Relays
+		_, err := tx.Exec(`CREATE TABLE relays(
+	board TEXT,
+	target TEXT,
+	state INTEGER,
+	date INTEGER,
+
+	PRIMARY KEY(board, target)
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Received activities
+		_, err := tx.Exec(`CREATE TABLE activities(
+	id INTEGER PRIMARY KEY ASC,
+
+	board TEXT,
+	apid TEXT,
+	actor TEXT,
+	type TEXT,
+	body TEXT,
+
+	state INTEGER,
+	error TEXT,
+	date INTEGER,
+
+	UNIQUE(board, apid)
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Pushing threads to new followers
+		_, err := tx.Exec(`ALTER TABLE boards ADD COLUMN push INTEGER NOT NULL DEFAULT 0`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Versioned post content
+		// Be *extremely* careful here, you cannot simply defer rows.Close() here.
+
+		rows, err := tx.Query(`select id from boards`)
+		if err != nil {
+			return err
+		}
+
+		// Collect a list of boards.
+		boards := []string{}
+		for rows.Next() {
+			board := ""
+			if err := rows.Scan(&board); err != nil {
+				rows.Close()
+				return err
+			}
+			boards = append(boards, board)
+		}
+		rows.Close()
+
+		// Every post is out of date, and gets rendered again when it's read.
+		for _, board := range boards {
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE posts_%s ADD COLUMN rendered INTEGER NOT NULL DEFAULT 0", board)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+	func(tx *sql.Tx) error { // API tokens
+		_, err := tx.Exec(`CREATE TABLE tokens(
+	id INTEGER PRIMARY KEY ASC,
+
+	name TEXT,
+	hash TEXT UNIQUE,
+	boards TEXT,
+	scopes INTEGER,
+	rate INTEGER,
+
+	date INTEGER,
+	lastused INTEGER
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Retrying activities
+		_, err := tx.Exec(`ALTER TABLE activities ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Peer stats
+		_, err := tx.Exec(`CREATE TABLE peers(
+	host TEXT PRIMARY KEY,
+
+	requests INTEGER,
+	failures TEXT,
+	latency INTEGER,
+	lastdelivery INTEGER,
+
+	inbound INTEGER,
+	lastinbound INTEGER
+)`)
+		return err
+	},
+	func(tx *sql.Tx) error { // Threads of tombstones
+		_, err := tx.Exec(`ALTER TABLE tombstones ADD COLUMN thread INTEGER`)
+		return err
+	},
 }
 
 // sqliteUpgrade upgrades the SQLite3 database to the latest schema version.
@@ -0,0 +1,170 @@
+package fedi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/util"
+)
+
+// backfillLimit keeps count of how many posts we have fetched from each host
+// to backfill threads.
+// This stops anyone from having us fetch as much as they like by sending
+// replies to threads that don't exist.
+var backfillLimit = struct {
+	sync.Mutex
+	hosts map[string]*backfillCount
+}{hosts: map[string]*backfillCount{}}
+
+type backfillCount struct {
+	n     int
+	reset time.Time
+}
+
+// allowBackfill checks if we're allowed to fetch another post from host, and
+// counts it if we are.
+func allowBackfill(host string) bool {
+	backfillLimit.Lock()
+	defer backfillLimit.Unlock()
+
+	now := time.Now()
+	c, ok := backfillLimit.hosts[host]
+	if !ok || now.After(c.reset) {
+		c = &backfillCount{reset: now.Add(config.BackfillWindow)}
+		backfillLimit.hosts[host] = c
+	}
+
+	if c.n >= config.BackfillRate {
+		return false
+	}
+
+	c.n++
+	return true
+}
+
+// fetchNote dereferences a Note.
+// FChannel, and us, wrap Notes in an OrderedCollection, so that is unwrapped
+// here.
+func fetchNote(ctx context.Context, board, id string) (Object, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return Object{}, err
+	} else if !util.ValidHost(u.Hostname()) {
+		return Object{}, fmt.Errorf("refusing to fetch %s", id)
+	}
+
+	if blocked, err := Blocked(ctx, id); err != nil {
+		return Object{}, err
+	} else if blocked {
+		return Object{}, fmt.Errorf("%s is blocked", u.Hostname())
+	}
+
+	if !allowBackfill(u.Hostname()) {
+		return Object{}, fmt.Errorf("fetched too many posts from %s", u.Hostname())
+	}
+
+	res, err := fetch(ctx, board, id)
+	if err != nil {
+		return Object{}, err
+	}
+	defer res.Body.Close()
+
+	col := OrderedCollection{}
+	if err := json.NewDecoder(res.Body).Decode(&col); err != nil {
+		return Object{}, err
+	}
+
+	note := Object{}
+	if col.Object != nil && col.Type == "Note" {
+		note = *col.Object
+	} else if len(col.OrderedItems) > 0 {
+		note = Object(col.OrderedItems[0])
+	}
+
+	if note.Type != "Note" {
+		return Object{}, fmt.Errorf("%s is not a Note", id)
+	} else if !util.EqualDomains(note.ID, id) {
+		// Don't let anyone hand us posts from elsewhere.
+		return Object{}, fmt.Errorf("fetched %s but got %s", id, note.ID)
+	}
+
+	return note, nil
+}
+
+// Backfill fetches the thread that note is a reply to and imports it into a
+// board, for when a reply comes in for a thread we don't have.
+// The thread is looked for up to config.BackfillDepth posts up the reply chain,
+// and every post on the way there is imported too, oldest first, so that note
+// has something to reply to even if the thread didn't come with its replies.
+func Backfill(ctx context.Context, board string, note Object) error {
+	return backfill(ctx, board, note, 0)
+}
+
+func backfill(ctx context.Context, board string, note Object, depth int) error {
+	if depth >= config.BackfillDepth {
+		return fmt.Errorf("thread for %s is too far up the reply chain", note.ID)
+	}
+
+	var err error
+	for _, irt := range note.InReplyTo {
+		if irt.ID == "" {
+			continue
+		}
+
+		var parent Object
+		parent, err = fetchNote(ctx, board, irt.ID)
+		if err != nil {
+			continue
+		}
+
+		// Threads don't reply to anything, although FChannel gives them an
+		// empty inReplyTo.
+		isThread := true
+		for _, v := range parent.InReplyTo {
+			if v.ID != "" {
+				isThread = false
+				break
+			}
+		}
+
+		if isThread {
+			_, err = mergeThread(ctx, board, parent)
+		} else if err = backfill(ctx, board, parent, depth+1); err == nil {
+			err = saveParent(ctx, board, parent)
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("nothing to backfill")
+	}
+
+	return err
+}
+
+// saveParent imports a post found on the way up a reply chain, once
+// everything above it is in the database, unless it came with the thread.
+func saveParent(ctx context.Context, board string, parent Object) error {
+	if _, err := DB.FindAPID(ctx, board, parent.ID); err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	post, err := parent.AsPost(ctx, board)
+	if err != nil {
+		return err
+	}
+
+	return DB.SavePost(ctx, board, &post)
+}
@@ -0,0 +1,72 @@
+package fedi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestBackfillChain backfills a reply two posts below its thread, from an
+// instance that doesn't send replies along with threads, like Mastodon.
+func TestBackfillChain(t *testing.T) {
+	db, _ := setupRelay(t)
+	ctx := context.Background()
+
+	// Status n replies to n-1, and 1 is the thread.
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/users/bob", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%[1]s/users/bob","type":"Person","name":"Bob","preferredUsername":"bob","inbox":"%[1]s/users/bob/inbox"}`, srv.URL)
+	})
+	mux.HandleFunc("/users/bob/statuses/", func(w http.ResponseWriter, r *http.Request) {
+		n := strings.TrimPrefix(r.URL.Path, "/users/bob/statuses/")
+		irt := "null"
+		if n != "1" {
+			irt = fmt.Sprintf(`"%s/users/bob/statuses/%c"`, srv.URL, n[0]-1)
+		}
+
+		fmt.Fprintf(w, `{"id":"%[1]s%[2]s","type":"Note","inReplyTo":%[3]s,"attributedTo":"%[1]s/users/bob","content":"<p>post %[4]s</p>"}`, srv.URL, r.URL.Path, irt, n)
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	status := func(n int) string {
+		return fmt.Sprintf("%s/users/bob/statuses/%d", srv.URL, n)
+	}
+
+	note := Object{
+		Type:         "Note",
+		ID:           status(3),
+		AttributedTo: &LinkObject{Type: "Link", ID: srv.URL + "/users/bob"},
+		InReplyTo:    []LinkObject{{Type: "Link", ID: status(2)}},
+		Content:      "<p>post 3</p>",
+	}
+
+	if _, err := note.AsPost(ctx, "prog"); !errors.Is(err, ErrNoThread) {
+		t.Fatalf("AsPost before backfilling: got %v, want ErrNoThread", err)
+	}
+
+	if err := Backfill(ctx, "prog", note); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.posts) != 2 || db.posts[0].APID != status(1) || db.posts[1].APID != status(2) {
+		t.Fatalf("saved %v; want the thread, then the post in between", db.posts)
+	}
+
+	thread := db.posts[0].ID
+	if db.posts[1].Thread != thread {
+		t.Errorf("post in between is in thread %d, want %d", db.posts[1].Thread, thread)
+	}
+
+	post, err := note.AsPost(ctx, "prog")
+	if err != nil {
+		t.Fatalf("AsPost after backfilling: %v", err)
+	} else if post.Thread != thread {
+		t.Errorf("reply is in thread %d, want %d", post.Thread, thread)
+	}
+}
@@ -0,0 +1,319 @@
+package fedi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/crypto"
+	"github.com/KushBlazingJudah/feditext/database"
+)
+
+const keySize = 2048
+
+// pemDir is where keys used to be kept before they were moved into the
+// database.
+const pemDir = "./pem"
+
+// instanceKey is the name of the instance actor's key.
+// Board names can't have underscores in them, so it can't clash with one.
+const instanceKey = "_instance"
+
+// ownKeyTime is how long our keys are cached for.
+// They can be changed from the command line while we're running.
+const ownKeyTime = 5 * time.Minute
+
+// Our own keys, read from the database.
+var (
+	ownKeys    = map[string]ownKey{}
+	ownKeyLock sync.RWMutex
+)
+
+type ownKey struct {
+	private *rsa.PrivateKey
+	public  string
+	date    time.Time
+
+	fetched time.Time
+}
+
+// loadKey fetches one of our keys by name.
+func loadKey(ctx context.Context, name string) (ownKey, error) {
+	ownKeyLock.RLock()
+	k, ok := ownKeys[name]
+	ownKeyLock.RUnlock()
+	if ok && time.Since(k.fetched) < ownKeyTime {
+		return k, nil
+	}
+
+	dk, err := DB.Key(ctx, name)
+	if err != nil {
+		return ownKey{}, err
+	}
+
+	k, err = openKey(dk)
+	if err != nil {
+		return k, err
+	}
+
+	ownKeyLock.Lock()
+	ownKeys[name] = k
+	ownKeyLock.Unlock()
+
+	return k, nil
+}
+
+// openKey decrypts and parses a key from the database.
+func openKey(dk database.Key) (ownKey, error) {
+	priv := dk.Private
+	if dk.Sealed {
+		var err error
+		priv, err = crypto.Open(priv, []byte(dk.Name))
+		if err != nil {
+			return ownKey{}, fmt.Errorf("unable to decrypt key %s: %w", dk.Name, err)
+		}
+	}
+
+	block, _ := pem.Decode(priv)
+	if block == nil {
+		return ownKey{}, fmt.Errorf("invalid private key %s", dk.Name)
+	}
+
+	// Older versions wrote PKCS #1 keys as "PRIVATE KEY", so the type can't
+	// be trusted.
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		k, perr := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if perr != nil {
+			return ownKey{}, err
+		}
+
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return ownKey{}, fmt.Errorf("private key %s is not an RSA key", dk.Name)
+		}
+	}
+
+	return ownKey{
+		private: key,
+		public:  dk.Public,
+		date:    dk.Date,
+		fetched: time.Now(),
+	}, nil
+}
+
+// saveKey saves one of our keys to the database, encrypting it if we can.
+func saveKey(ctx context.Context, name string, key *rsa.PrivateKey, public string, date time.Time) error {
+	priv := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	dk := database.Key{
+		Name:    name,
+		Private: priv,
+		Public:  public,
+		Date:    date,
+	}
+
+	if config.KeySecret != "" {
+		var err error
+		dk.Private, err = crypto.Seal(priv, []byte(name))
+		if err != nil {
+			return err
+		}
+		dk.Sealed = true
+	}
+
+	if err := DB.SaveKey(ctx, dk); err != nil {
+		return err
+	}
+
+	ownKeyLock.Lock()
+	ownKeys[name] = ownKey{private: key, public: public, date: date, fetched: time.Now()}
+	ownKeyLock.Unlock()
+
+	return nil
+}
+
+func getPrivateKey(ctx context.Context, id string) (*rsa.PrivateKey, error) {
+	k, err := loadKey(ctx, id)
+	return k.private, err
+}
+
+// getRetiredKey returns the key that id used before it was last rotated, as
+// long as it was rotated less than config.KeyGracePeriod ago.
+func getRetiredKey(ctx context.Context, id string) (*rsa.PrivateKey, error) {
+	k, err := loadKey(ctx, id+".retired")
+	if err != nil {
+		return nil, err
+	} else if time.Since(k.date) > config.KeyGracePeriod {
+		return nil, fmt.Errorf("retired key for %s has expired", id)
+	}
+
+	return k.private, nil
+}
+
+// signingKey returns the key used to sign for id, or the key it used before
+// being rotated if retired is set.
+func signingKey(ctx context.Context, id string, retired bool) (*rsa.PrivateKey, error) {
+	if retired {
+		return getRetiredKey(ctx, id)
+	}
+
+	return getPrivateKey(ctx, id)
+}
+
+// PublicKey returns the PEM encoded public key of id.
+func PublicKey(id string) (string, error) {
+	k, err := loadKey(context.Background(), id)
+	return k.public, err
+}
+
+// CreateKey creates a new key for id, replacing the one it has.
+func CreateKey(ctx context.Context, id string) error {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return err
+	}
+
+	pubkey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	public := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubkey,
+	})
+
+	return saveKey(ctx, id, key, string(public), time.Now().UTC())
+}
+
+// RotateKey replaces the key of id with a new one.
+// The old key is kept around for config.KeyGracePeriod so requests can be
+// signed with it for servers that haven't noticed the new one yet.
+func RotateKey(ctx context.Context, id string) error {
+	old, err := loadKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// The date marks when it was retired.
+	if err := saveKey(ctx, id+".retired", old.private, old.public, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return CreateKey(ctx, id)
+}
+
+// CreateInstanceKey creates the instance actor's key if it doesn't exist yet.
+func CreateInstanceKey(ctx context.Context) error {
+	if _, err := loadKey(ctx, instanceKey); err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return CreateKey(ctx, instanceKey)
+}
+
+// ImportKeys moves keys left in ./pem by older versions into the database,
+// and encrypts any keys that were saved before KeySecret was set, or that
+// were encrypted the way older versions did.
+func ImportKeys(ctx context.Context) error {
+	files, err := filepath.Glob(filepath.Join(pemDir, "*.private.pem"))
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.Base(path), ".private.pem")
+
+		if _, err := DB.Key(ctx, name); err == nil {
+			// Already imported
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		priv, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		public, err := os.ReadFile(filepath.Join(pemDir, name+".pem"))
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		k, err := openKey(database.Key{Name: name, Private: priv})
+		if err != nil {
+			return err
+		}
+
+		if err := saveKey(ctx, name, k.private, string(public), fi.ModTime().UTC()); err != nil {
+			return err
+		}
+
+		log.Printf("Imported key %s from %s", name, path)
+		imported++
+	}
+
+	if imported > 0 {
+		log.Printf("Keys are now kept in the database; %s can be deleted once you have a backup of it.", pemDir)
+	}
+
+	keys, err := DB.Keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, dk := range keys {
+		if dk.Sealed && !crypto.Outdated(dk.Private) {
+			continue
+		}
+
+		if config.KeySecret == "" {
+			if dk.Sealed {
+				// Can't be opened anyway
+				continue
+			}
+
+			log.Printf("Warning: private keys are stored unencrypted in the database; anyone with a copy of it can sign as your boards. Set keysecret in the config to encrypt them.")
+			break
+		}
+
+		k, err := openKey(dk)
+		if err != nil {
+			return err
+		}
+
+		if err := saveKey(ctx, dk.Name, k.private, k.public, k.date); err != nil {
+			return err
+		}
+
+		log.Printf("Encrypted key %s", dk.Name)
+	}
+
+	return nil
+}
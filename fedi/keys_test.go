@@ -0,0 +1,100 @@
+package fedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/crypto"
+)
+
+// TestImportKeys moves a key from ./pem into the database, the way older
+// versions left it.
+func TestImportKeys(t *testing.T) {
+	db, _ := setupRelay(t)
+	ctx := context.Background()
+
+	oldSecret := config.KeySecret
+	config.KeySecret = "hunter2"
+	t.Cleanup(func() { config.KeySecret = oldSecret })
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	if err := os.Mkdir(pemDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Older versions called PKCS #1 keys "PRIVATE KEY".
+	priv := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(pemDir, "tech.private.pem"), priv, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pemDir, "tech.pem"), public, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dk, err := db.Key(ctx, "tech")
+	if err != nil {
+		t.Fatalf("key wasn't imported: %v", err)
+	} else if !dk.Sealed || crypto.Outdated(dk.Private) {
+		t.Fatalf("imported key isn't sealed")
+	} else if bytes.Contains(dk.Private, priv[40:80]) {
+		t.Fatalf("imported key is stored in plain text")
+	}
+
+	if dk.Public != string(public) {
+		t.Errorf("public key = %q, want %q", dk.Public, public)
+	}
+
+	k, err := openKey(dk)
+	if err != nil {
+		t.Fatal(err)
+	} else if !k.private.Equal(key) {
+		t.Errorf("imported key differs from the one in %s", pemDir)
+	}
+
+	// setupRelay made this one before there was a secret.
+	if dk, err := db.Key(ctx, "prog"); err != nil {
+		t.Fatal(err)
+	} else if !dk.Sealed {
+		t.Errorf("key saved without a secret wasn't sealed")
+	} else if _, err := openKey(dk); err != nil {
+		t.Errorf("opening key sealed by ImportKeys: %v", err)
+	}
+
+	// Keys in the database win over ./pem.
+	if err := os.WriteFile(filepath.Join(pemDir, "tech.private.pem"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportKeys(ctx); err != nil {
+		t.Fatalf("importing again: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,12 +17,22 @@ import (
 
 	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/KushBlazingJudah/feditext/util"
 )
 
 const streams = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
 
+const webfingerPath = "/.well-known/webfinger"
+
 var wfRegex = regexp.MustCompile(`(https?):\/\/([0-9a-z\-\.]*\.[0-9a-z]+(?::\d+)?)\/([0-9a-z]+)`)
-var webfingerCache = map[string]Actor{}
+
+// Actors fetched through Finger, and keys fetched through fetchKey.
+// Both are accessed from several goroutines, so hold cacheLock.
+var (
+	webfingerCache = map[string]Actor{}
+	keyCache       = map[string]Actor{}
+	cacheLock      sync.RWMutex
+)
 
 type finger struct {
 	Links []struct {
@@ -31,26 +42,134 @@ type finger struct {
 	}
 }
 
-func Finger(ctx context.Context, actor string) (Actor, error) {
+// Blocked checks if the instance that id belongs to has been blocked.
+func Blocked(ctx context.Context, id string) (bool, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return false, err
+	} else if u.Hostname() == "" {
+		return false, fmt.Errorf("%s has no host", id)
+	}
+
+	return DB.Blocked(ctx, u.Hostname())
+}
+
+// Forget drops an actor, and any keys it owns, from the cache so they are
+// fetched again the next time they're needed.
+func Forget(id string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	delete(webfingerCache, id)
+	for k, v := range keyCache {
+		if v.Object != nil && v.ID == id {
+			delete(keyCache, k)
+		}
+	}
+}
+
+// forgetKey drops a key from the cache.
+func forgetKey(id string) {
+	cacheLock.Lock()
+	delete(keyCache, id)
+	cacheLock.Unlock()
+}
+
+// fetch performs a signed GET request for an ActivityPub object.
+// signer is the ID of the board whose key signs the request; if it is empty,
+// the instance's key is used.
+func fetch(ctx context.Context, signer, uri string) (*http.Response, error) {
+	name := signer
+	if name == "" {
+		name = instanceKey
+	}
+
+	res, err := fetchWith(ctx, name, keyID(signer), uri, false)
+	if err == nil && (res.StatusCode == 401 || res.StatusCode == 403) && config.RetiredKeyRetry {
+		// They may not know about our new key yet.
+		if _, kerr := getRetiredKey(ctx, name); kerr == nil {
+			res.Body.Close()
+			res, err = fetchWith(ctx, name, keyID(signer), uri, true)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("non-200 status code %d from %s", res.StatusCode, uri)
+	}
+
+	return res, nil
+}
+
+func fetchWith(ctx context.Context, name, kid, uri string, retired bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", streams)
+
+	key, err := signingKey(ctx, name, retired)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := signRequest(req, key, kid, nil); err != nil {
+		return nil, err
+	}
+
+	return do(req)
+}
+
+// Finger looks up an actor through Webfinger.
+// signer is the ID of the board the actor is fetched on behalf of; see fetch.
+// Actors that Webfinger can't find, such as the ones on Mastodon where the
+// URL of the actor doesn't resemble its name, are fetched directly.
+func Finger(ctx context.Context, signer, actor string) (Actor, error) {
 	// Get from cache if at all possible
-	if a, ok := webfingerCache[actor]; ok {
+	cacheLock.RLock()
+	a, ok := webfingerCache[actor]
+	cacheLock.RUnlock()
+	if ok {
 		return a, nil
 	}
 
+	act, err := webfinger(ctx, signer, actor)
+	if err != nil {
+		act, err = fetchActor(ctx, signer, actor)
+		if err != nil {
+			return act, err
+		}
+	}
+
+	// Throw it into the cache now that we have it
+	// This saves two queries to a site
+	cacheLock.Lock()
+	webfingerCache[actor] = act
+	cacheLock.Unlock()
+
+	return act, nil
+}
+
+func webfinger(ctx context.Context, signer, actor string) (Actor, error) {
 	// Assumes that the actor is in form of https?://instance/actor.
 	match := wfRegex.FindStringSubmatch(actor)
-	if match == nil || len(match) != 4 {
+	if match == nil || len(match) != 4 || match[0] != actor {
 		return Actor{}, fmt.Errorf("Finger: invalid format; %s", actor)
 	}
 	tp, host, id := match[1], match[2], match[3]
 
 	uri := fmt.Sprintf("%s://%s", tp, host)
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/.well-known/webfinger?resource=acct:%s@%s", uri, id, host), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s?resource=acct:%s@%s", uri, webfingerPath, id, host), nil)
 	if err != nil {
 		return Actor{}, err
 	}
 
-	res, err := Proxy.Do(req)
+	res, err := do(req)
 	if err != nil {
 		return Actor{}, err
 	}
@@ -81,61 +200,124 @@ func Finger(ctx context.Context, actor string) (Actor, error) {
 	}
 
 	// Finally, do one more request to the server.
-	req, err = http.NewRequestWithContext(ctx, "GET", target, nil)
+	res, err = fetch(ctx, signer, target)
 	if err != nil {
 		return Actor{}, err
 	}
+	defer res.Body.Close()
 
-	req.Header.Set("Accept", streams)
+	act := Actor{}
+	decoder = json.NewDecoder(res.Body)
+	if err := decoder.Decode(&act); err != nil {
+		return act, err
+	}
+
+	return act, nil
+}
 
-	res, err = Proxy.Do(req)
+// fetchActor fetches an actor from its ID.
+func fetchActor(ctx context.Context, signer, actor string) (Actor, error) {
+	res, err := fetch(ctx, signer, actor)
 	if err != nil {
 		return Actor{}, err
 	}
 	defer res.Body.Close()
 
 	act := Actor{}
-	decoder = json.NewDecoder(res.Body)
-	if err := decoder.Decode(&act); err != nil {
+	if err := json.NewDecoder(res.Body).Decode(&act); err != nil {
 		return act, err
 	}
 
-	// Throw it into the cache now that we have it
-	// This saves two queries to a site
-	webfingerCache[actor] = act
+	if act.Object == nil || act.ID != actor {
+		return act, fmt.Errorf("fetched actor from %s has a different id", actor)
+	}
 
 	return act, nil
 }
 
-func makeActivityRequest(ctx context.Context, act Activity, data []byte, to string) (*http.Request, error) {
-	actor, err := Finger(ctx, to)
+// fetchKey fetches the actor that owns a key given the key's ID.
+// The key is expected to be found on the actor, which is where everyone puts
+// it.
+func fetchKey(ctx context.Context, signer, id string) (Actor, error) {
+	cacheLock.RLock()
+	a, ok := keyCache[id]
+	cacheLock.RUnlock()
+	if ok {
+		return a, nil
+	}
+
+	u, err := url.Parse(id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to finger: %w", err)
+		return Actor{}, err
 	}
+	u.Fragment = ""
 
-	if actor.Inbox != "" {
-		req, err := http.NewRequestWithContext(ctx, "POST", actor.Inbox, bytes.NewBuffer(data))
+	res, err := fetch(ctx, signer, u.String())
+	if err != nil {
+		return Actor{}, err
+	}
+	defer res.Body.Close()
+
+	act := Actor{}
+	if err := json.NewDecoder(res.Body).Decode(&act); err != nil {
+		return act, err
+	}
+
+	if act.Object == nil || act.PublicKey == nil || act.PublicKey.ID != id || act.PublicKey.Pem == "" {
+		return act, fmt.Errorf("actor at %s does not have key %s", u.String(), id)
+	} else if !util.EqualDomains(act.ID, id) {
+		return act, fmt.Errorf("key %s is owned by an actor on another domain", id)
+	}
+
+	cacheLock.Lock()
+	keyCache[id] = act
+	cacheLock.Unlock()
+
+	return act, nil
+}
+
+// makeActivityRequest creates a signed request delivering an activity to to,
+// which is an actor, or an inbox if isInbox is set.
+// If retired is set, it is signed with the key the actor used before it was
+// rotated.
+func makeActivityRequest(ctx context.Context, act Activity, data []byte, to string, isInbox, retired bool) (*http.Request, error) {
+	if blocked, err := Blocked(ctx, to); err != nil {
+		return nil, err
+	} else if blocked {
+		return nil, fmt.Errorf("%s is blocked", to)
+	}
+
+	inbox := to
+	if !isInbox {
+		actor, err := Finger(ctx, "", to)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate request: %w", err)
+			return nil, fmt.Errorf("failed to finger: %w", err)
 		}
 
-		u, err := url.Parse(actor.Inbox)
+		inbox = actor.Inbox
+	}
+
+	if inbox != "" {
+		req, err := http.NewRequestWithContext(ctx, "POST", inbox, bytes.NewBuffer(data))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse actor's inbox URL: %w", err)
+			return nil, fmt.Errorf("failed to generate request: %w", err)
 		}
 
-		date := time.Now().UTC().Format(time.RFC1123)
-		data := fmt.Sprintf("(request-target): post %s\nhost: %s\ndate: %s", u.Path, u.Host, date)
+		name, err := keyName(act.Actor.ID)
+		if err != nil {
+			return nil, err
+		}
 
-		sig, err := Sign(act.Actor.Name, data) // TODO: Bad.
+		key, err := signingKey(ctx, name, retired)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := signRequest(req, key, act.Actor.PublicKey.ID, data); err != nil {
+			return nil, err
+		}
+
 		req.Header.Set("Content-Type", streams)
-		req.Header.Set("Date", date)
-		req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",headers="(request-target) host date",signature="%s"`, act.Actor.PublicKey.ID, sig))
-		req.Host = u.Host
 
 		return req, nil
 	}
@@ -144,7 +326,31 @@ func makeActivityRequest(ctx context.Context, act Activity, data []byte, to stri
 }
 
 func SendActivity(ctx context.Context, act Activity) error {
-	if len(act.To) == 0 {
+	data, err := json.Marshal(act)
+	if err != nil {
+		return err
+	}
+
+	return deliver(ctx, act, data)
+}
+
+// deliver sends data, the encoded form of act, to everyone act is addressed
+// to.
+func deliver(ctx context.Context, act Activity, data []byte) error {
+	targets := []string{}
+	for _, to := range act.To {
+		if to.Type == "Link" && to.ID != Public {
+			targets = append(targets, to.ID)
+		}
+	}
+
+	return deliverTo(ctx, act, data, targets, false)
+}
+
+// deliverTo sends data, the encoded form of act, to each of targets, which
+// are actors, or inboxes if inboxes is set.
+func deliverTo(ctx context.Context, act Activity, data []byte, targets []string, inboxes bool) error {
+	if len(targets) == 0 {
 		// There's nothing to do
 		return nil
 	}
@@ -153,49 +359,41 @@ func SendActivity(ctx context.Context, act Activity) error {
 		return fmt.Errorf("invalid activity; missing actor or public key")
 	}
 
-	data, err := json.Marshal(act)
-	if err != nil {
-		return err
-	}
-
 	if config.Debug {
-		log.Printf("sending an activity of type %s to %d different actors", act.Type, len(act.To))
+		log.Printf("sending an activity of type %s to %d different actors", act.Type, len(targets))
 		log.Printf("marshalled json for activity: %s", string(data))
 	}
 
 	wg := sync.WaitGroup{}
 
-	for _, to := range act.To {
-		if to.Type != "Link" {
-			continue
-		}
-
+	for _, to := range targets {
 		wg.Add(1)
-		go func(to LinkObject) {
+		go func(to string) {
 			defer wg.Done()
 			d := config.RetryDelay
+			retired := false
 
 			for i := 0; i < config.MaxRetries; i++ {
 				if i != 0 {
-					log.Printf("Retrying activity send to %s in %s", to.ID, d.String())
+					log.Printf("Retrying activity send to %s in %s", to, d.String())
 
 					time.Sleep(d)
 					d *= config.RetryMultiplyer
 				}
 
 				// Reasonable amount of time for everything here to complete.
-				ctx, cancel := context.WithTimeout(ctx, config.MaxReqTime)
+				ctx, cancel := context.WithTimeout(ctx, Proxy.MaxTime(to))
 				defer cancel()
 
-				req, err := makeActivityRequest(ctx, act, data, to.ID)
+				req, err := makeActivityRequest(ctx, act, data, to, inboxes, retired)
 				if err != nil {
-					log.Printf("failed to make activity request for %s: %v", to.ID, err)
+					log.Printf("failed to make activity request for %s: %v", to, err)
 					return // permanent failure
 				}
 
-				res, err := Proxy.Do(req)
+				res, err := do(req)
 				if err != nil {
-					log.Printf("failed sending activity to %s: %v", to.ID, err)
+					log.Printf("failed sending activity to %s: %v", to, err)
 					continue
 				}
 
@@ -204,12 +402,22 @@ func SendActivity(ctx context.Context, act Activity) error {
 					defer res.Body.Close()
 				}
 
-				if res.StatusCode != 200 {
-					log.Printf("failed sending activity to %s: non-200 status code %d", to.ID, res.StatusCode)
+				if res.StatusCode < 200 || res.StatusCode > 299 {
+					// Mastodon answers with 202 Accepted, so allow any 2xx
+					log.Printf("failed sending activity to %s: status code %d", to, res.StatusCode)
+
+					if (res.StatusCode == 401 || res.StatusCode == 403) && !retired && config.RetiredKeyRetry {
+						// They may not know about our new key yet.
+						if name, err := keyName(act.Actor.ID); err == nil {
+							if _, err := getRetiredKey(ctx, name); err == nil {
+								retired = true
+							}
+						}
+					}
 
 					if config.Debug && res.Body != nil {
 						// Write to stderr
-						fmt.Fprintf(os.Stderr, "Response body (at most 4096 bytes) for failure on %s for %s follows", act.Object.ID, to.ID)
+						fmt.Fprintf(os.Stderr, "Response body (at most 4096 bytes) for failure on %s for %s follows", act.Object.ID, to)
 						io.Copy(os.Stderr, io.LimitReader(res.Body, 4096))
 						fmt.Fprint(os.Stderr, "\n")
 					}
@@ -220,7 +428,7 @@ func SendActivity(ctx context.Context, act Activity) error {
 				return
 			}
 
-			log.Printf("Failed sending activity to %s after %d retries", to.ID, config.MaxRetries)
+			log.Printf("Failed sending activity to %s after %d retries", to, config.MaxRetries)
 		}(to)
 	}
 
@@ -229,8 +437,9 @@ func SendActivity(ctx context.Context, act Activity) error {
 	return nil
 }
 
-func FetchOutbox(ctx context.Context, actorUrl string) (Outbox, error) {
-	actor, err := Finger(ctx, actorUrl)
+// FetchOutbox fetches the outbox of an actor, on behalf of the board signer.
+func FetchOutbox(ctx context.Context, signer, actorUrl string) (Outbox, error) {
+	actor, err := Finger(ctx, signer, actorUrl)
 	if err != nil {
 		return Outbox{}, err
 	}
@@ -239,12 +448,7 @@ func FetchOutbox(ctx context.Context, actorUrl string) (Outbox, error) {
 		return Outbox{}, fmt.Errorf("actor returned no outbox")
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", actor.Outbox, nil)
-	if err != nil {
-		return Outbox{}, err
-	}
-
-	res, err := Proxy.Do(req)
+	res, err := fetch(ctx, signer, actor.Outbox)
 	if err != nil {
 		return Outbox{}, err
 	}
@@ -256,57 +460,116 @@ func FetchOutbox(ctx context.Context, actorUrl string) (Outbox, error) {
 	return outbox, err
 }
 
-func MergeOutbox(ctx context.Context, board string, ob Outbox) error {
+// MergeOutbox imports the threads in an outbox into a board, and returns how
+// many new posts were saved.
+// Threads that haven't been posted in or bumped since the time given are
+// skipped, unless it is zero.
+// If any thread couldn't be imported, an error saying so is returned along
+// with the count, so that the sync isn't counted as a success and the same
+// threads are tried again next time.
+func MergeOutbox(ctx context.Context, board string, ob Outbox, since time.Time) (int, error) {
+	n := 0
+	failed := 0
+	var first error
+
 	for _, thread := range ob.OrderedItems {
 		if thread.Type != "Note" {
 			log.Printf("encountered unknown type %s in outbox", thread.Type)
 			continue
 		}
 
-		t, err := Object(thread).AsThread(ctx, board)
-		if err != nil {
-			log.Printf("error converting object %s to thread: %s", thread.ID, err)
-			continue
+		if !since.IsZero() {
+			// Updated is the bump date, at least for FChannel and us.
+			last := time.Time{}
+			if thread.Published != nil {
+				last = *thread.Published
+			}
+			if thread.Updated != nil && thread.Updated.After(last) {
+				last = *thread.Updated
+			}
+
+			if !last.IsZero() && last.Before(since) {
+				continue
+			}
 		}
 
-		// Import it into the database
-		op := t[0]
+		i, err := mergeThread(ctx, board, Object(thread))
+		n += i
+		if err != nil && !errors.Is(err, database.ErrPostDeleted) {
+			log.Printf("error importing thread %s: %s", thread.ID, err)
 
-		// Check if we have the OP already in the database
-		if post, err := DB.FindAPID(ctx, board, op.APID); err != nil {
-			// We (probably) don't.
-			if err := DB.SavePost(ctx, board, &op); err != nil {
-				// Log it to the console.
-				log.Printf("unable to import %s: %s", op.APID, err)
-				continue
+			failed++
+			if first == nil {
+				first = fmt.Errorf("importing thread %s: %w", thread.ID, err)
 			}
-		} else {
-			// We do have it in the database so we can ignore the first one.
-			op = post
 		}
+	}
 
-		for _, post := range t[1:] {
-			post.Thread = op.ID
+	if failed > 0 {
+		return n, fmt.Errorf("%d threads failed to import; first: %w", failed, first)
+	}
 
-			// First, check if it's in the database.
-			// We'll save it if it isn't.
-			if _, err := DB.FindAPID(ctx, board, post.APID); err != nil {
-				// We're probably safe to save it into the database.
-				// Most likely fatal if it isn't.
-				if err := DB.SavePost(ctx, board, &post); err != nil {
-					log.Printf("unable to save %s: %s", post.APID, err)
-					continue
-				}
+	return n, nil
+}
 
-				if config.Debug {
-					log.Printf("added %s to %s", post.APID, board)
-				}
+// mergeThread imports a thread and all of its replies into a board, and
+// returns how many new posts were saved.
+// Posts we already have are skipped.
+// Replies that couldn't be saved don't stop the rest from being imported, but
+// an error is returned for them at the end.
+func mergeThread(ctx context.Context, board string, thread Object) (int, error) {
+	t, err := thread.AsThread(ctx, board)
+	if err != nil {
+		return 0, fmt.Errorf("converting object to thread: %w", err)
+	}
+
+	n := 0
+	failed := 0
+
+	// Import it into the database
+	op := t[0]
+
+	// Check if we have the OP already in the database
+	if post, err := DB.FindAPID(ctx, board, op.APID); err != nil {
+		// We (probably) don't.
+		// If we deleted it, we don't want its replies either.
+		if err := DB.SavePost(ctx, board, &op); err != nil {
+			return 0, err
+		}
+		n++
+	} else {
+		// We do have it in the database so we can ignore the first one.
+		op = post
+	}
+
+	for _, post := range t[1:] {
+		post.Thread = op.ID
+
+		// First, check if it's in the database.
+		// We'll save it if it isn't.
+		if _, err := DB.FindAPID(ctx, board, post.APID); err != nil {
+			// We're probably safe to save it into the database.
+			// Most likely fatal if it isn't.
+			if err := DB.SavePost(ctx, board, &post); errors.Is(err, database.ErrPostDeleted) {
+				continue
+			} else if err != nil {
+				log.Printf("unable to save %s: %s", post.APID, err)
+				failed++
+				continue
 			}
 
+			n++
+			if config.Debug {
+				log.Printf("added %s to %s", post.APID, board)
+			}
 		}
 	}
 
-	return nil
+	if failed > 0 {
+		return n, fmt.Errorf("unable to save %d replies", failed)
+	}
+
+	return n, nil
 }
 
 func activityBase(ctx context.Context, board database.Board) (Activity, error) {
@@ -333,24 +596,53 @@ func activityBase(ctx context.Context, board database.Board) (Activity, error) {
 	}, nil
 }
 
+// ActorUpdate sends a board's actor to its followers, so that they notice
+// changes to it, such as a new key.
+func ActorUpdate(ctx context.Context, board database.Board) error {
+	act, err := activityBase(ctx, board)
+	if err != nil {
+		return err
+	}
+
+	act.Object.Type = "Update"
+
+	// ObjectProp can't hold an Actor.
+	actor := TransformBoard(board)
+	data, err := json.Marshal(struct {
+		*Object
+		ObjectProp *Actor `json:"object"`
+	}{act.Object, &actor})
+	if err != nil {
+		return err
+	}
+
+	return deliver(ctx, act, data)
+}
+
 // PostOut sends a post out to federated servers.
 func PostOut(ctx context.Context, board database.Board, post database.Post) error {
-	actor := TransformBoard(board)
+	return sendPost(ctx, board, post, "Create")
+}
+
+// PostUpdate sends an edited post out to federated servers.
+func PostUpdate(ctx context.Context, board database.Board, post database.Post) error {
+	return sendPost(ctx, board, post, "Update")
+}
+
+// sendPost wraps a post in an activity of type typ and sends it to our
+// followers, and the owner of the thread it was posted in.
+func sendPost(ctx context.Context, board database.Board, post database.Post, typ string) error {
 	act, err := activityBase(ctx, board)
 	if err != nil {
 		return err
 	}
 
-	irt := Object{}
 	if post.Thread != 0 {
 		thread, err := DB.Post(ctx, board.ID, post.Thread)
 		if err != nil {
 			return err
 		}
 
-		irt.Type = "Note"
-		irt.ID = thread.APID
-
 		// Add the actor of the thread into To, if it's not already there
 		// thread.Source is the Actor for posts that aren't local to us.
 		if !thread.IsLocal() {
@@ -367,17 +659,55 @@ func PostOut(ctx context.Context, board database.Board, post database.Post) erro
 		}
 	}
 
-	note, err := TransformPost(ctx, &actor, post, irt, false, true) // Won't ever have replies
+	if typ == "Create" {
+		// New posts go out to relays too
+		relays, err := relayTargets(ctx, board.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range relays {
+			act.To = append(act.To, LinkObject{Type: "Link", ID: r})
+		}
+	}
+
+	note, err := postNote(ctx, board, post)
 	if err != nil {
 		return err
 	}
 
-	act.Object.Type = "Create"
+	act.Object.Type = typ
+	act.Object.Cc = note.Cc
 	act.ObjectProp = &note
 
 	return SendActivity(ctx, act)
 }
 
+// postNote turns a post into the Note that is sent to other instances.
+func postNote(ctx context.Context, board database.Board, post database.Post) (Object, error) {
+	actor := TransformBoard(board)
+
+	irt := Object{}
+	if post.Thread != 0 {
+		thread, err := DB.Post(ctx, board.ID, post.Thread)
+		if err != nil {
+			return Object{}, err
+		}
+
+		irt.Type = "Note"
+		irt.ID = thread.APID
+	}
+
+	note, err := TransformPost(ctx, &actor, post, irt, false, true) // Won't ever have replies
+	if err != nil {
+		return Object{}, err
+	}
+
+	// Posts are public, which other software needs to be told.
+	note.Cc = LinkList{{Type: "Link", ID: Public}}
+	return note, nil
+}
+
 func PostDel(ctx context.Context, board database.Board, post database.Post) error {
 	actor := TransformBoard(board)
 	lactor := LinkActor(actor)
@@ -397,3 +727,56 @@ func PostDel(ctx context.Context, board database.Board, post database.Post) erro
 
 	return SendActivity(ctx, act)
 }
+
+// ReportOut sends a report about a federated post to where it came from, as a
+// Flag.
+// Posts from boards are reported to the board; posts from people are reported
+// to the shared inbox of their instance, so that the author never sees it.
+// Nothing about who made the report is sent.
+func ReportOut(ctx context.Context, board database.Board, post database.Post, reason string) error {
+	if post.IsLocal() {
+		return fmt.Errorf("post %d is not federated", post.ID)
+	}
+
+	author, err := Finger(ctx, "", post.Source)
+	if err != nil {
+		return err
+	}
+
+	actor := TransformBoard(board)
+	actor.NoCollapse = true
+	lactor := LinkActor(actor)
+
+	act := Activity{
+		Object: &Object{
+			Context: Context,
+			Type:    "Flag",
+			Actor:   &lactor,
+			Content: reason,
+		},
+	}
+
+	// ObjectProp can only hold one object.
+	objects := []string{post.APID}
+	target, inbox := post.Source, false
+
+	if author.Type == "Group" {
+		act.To = LinkList{{Type: "Link", ID: post.Source}}
+	} else if author.Endpoints != nil && author.Endpoints.SharedInbox != "" {
+		// Their instance needs to know who is being reported.
+		objects = []string{post.Source, post.APID}
+		target, inbox = author.Endpoints.SharedInbox, true
+	} else {
+		return fmt.Errorf("%s has no shared inbox to report to", post.Source)
+	}
+
+	data, err := json.Marshal(struct {
+		*Object
+		Objects []string `json:"object"`
+	}{act.Object, objects})
+	if err != nil {
+		return err
+	}
+
+	return deliverTo(ctx, act, data, []string{target}, inbox)
+}
@@ -1,6 +1,8 @@
 package fedi
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,183 +10,398 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/util"
 	"github.com/gofiber/fiber/v2"
 )
 
-const keySize = 2048
-const pemDir = "./pem"
-
 const signWindow = 30
 
-func writePem(name string, block *pem.Block) error {
-	path := filepath.Join(pemDir, name+".pem")
+// requiredHeaders is the list of headers that signatures on incoming
+// activities must cover.
+var requiredHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// fetchHeaders is requiredHeaders for requests without a body.
+var fetchHeaders = []string{"(request-target)", "host", "date"}
 
-	fp, err := os.Create(path)
+func Sign(id string, data string) (string, error) {
+	key, err := getPrivateKey(context.Background(), id)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer fp.Close()
 
-	return pem.Encode(fp, block)
+	return sign(key, data)
 }
 
-func getPrivateKey(id string) (*rsa.PrivateKey, error) {
-	// TODO: Should this just be cached in memory?
+func sign(key *rsa.PrivateKey, data string) (string, error) {
+	hash := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
 
-	path := filepath.Join(pemDir, id+".private.pem")
+	return base64.StdEncoding.EncodeToString(sig), err
+}
 
-	pkey, err := os.ReadFile(path)
+func Verify(keyPem string, sign string, data string) error {
+	sig, err := base64.StdEncoding.DecodeString(sign)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(keyPem))
+	if block == nil {
+		return fmt.Errorf("invalid public key")
 	}
 
-	block, _ := pem.Decode(pkey)
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	return key, err
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	rkey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	hash := sha256.Sum256([]byte(data))
+	return rsa.VerifyPKCS1v15(rkey, crypto.SHA256, hash[:], sig)
+}
+
+// Digest returns the value of the Digest header for body.
+func Digest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(hash[:])
 }
 
-func PublicKey(id string) (string, error) {
-	// TODO: Should this just be cached in memory?
+// checkDigest checks the value of a Digest header against body.
+// Only SHA-256 is understood; anything else is rejected.
+func checkDigest(hdr string, body []byte) error {
+	if hdr == "" {
+		return fmt.Errorf("missing digest")
+	}
 
-	path := filepath.Join(pemDir, id+".pem")
+	hash := sha256.Sum256(body)
 
-	pkey, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
+	// There may be several digests in one header
+	for _, v := range strings.Split(hdr, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok || !strings.EqualFold(alg, "SHA-256") {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("malformed digest: %w", err)
+		}
+
+		if !bytes.Equal(sum, hash[:]) {
+			return fmt.Errorf("digest does not match body")
+		}
+
+		return nil
 	}
 
-	return string(pkey), err
+	return fmt.Errorf("no supported digest algorithm in %q", hdr)
+}
+
+// signature is a parsed Signature header.
+type signature struct {
+	keyID     string
+	algorithm string
+	headers   []string
+	signature string
 }
 
-func CreatePem(id string) ([]byte, error) {
-	// Create pem directory
-	if _, err := os.Stat(pemDir); err != nil {
-		if err := os.Mkdir(pemDir, 0700); err != nil {
-			return nil, err
+// parseSignature parses the value of a Signature header.
+func parseSignature(hdr string) (signature, error) {
+	sig := signature{}
+
+	for hdr != "" {
+		k, rest, ok := strings.Cut(hdr, "=")
+		if !ok {
+			return sig, fmt.Errorf("incorrectly formatted signature header")
+		}
+		k = strings.TrimSpace(k)
+
+		// Values are usually quoted, but don't have to be
+		v := ""
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return sig, fmt.Errorf("unterminated value in signature header")
+			}
+			v, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			v, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
 		}
+
+		switch strings.ToLower(k) {
+		case "keyid":
+			sig.keyID = v
+		case "algorithm":
+			sig.algorithm = strings.ToLower(v)
+		case "headers":
+			sig.headers = strings.Fields(strings.ToLower(v))
+		case "signature":
+			sig.signature = v
+		}
+
+		hdr = strings.TrimLeft(rest, ", ")
 	}
 
-	key, err := rsa.GenerateKey(rand.Reader, keySize)
-	if err != nil {
-		return nil, err
+	if sig.keyID == "" || sig.signature == "" {
+		return sig, fmt.Errorf("signature header is missing keyId or signature")
 	}
 
-	pkey := x509.MarshalPKCS1PrivateKey(key)
-	if err := writePem(id+".private", &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: pkey,
-	}); err != nil {
-		return nil, err
+	if len(sig.headers) == 0 {
+		// The spec says to assume just the date if nothing was given
+		sig.headers = []string{"date"}
 	}
 
-	pubkey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return sig, nil
+}
+
+// signingString builds the string that is signed from a list of headers.
+// target is the path and query of the request.
+func signingString(headers []string, method, target string, get func(string) string) (string, error) {
+	out := make([]string, 0, len(headers))
+
+	for _, h := range headers {
+		h = strings.ToLower(h)
+
+		switch h {
+		case "(request-target)": // Ensure it's to _this_ path, not some other one.
+			out = append(out, fmt.Sprintf("(request-target): %s %s", strings.ToLower(method), target))
+		default:
+			v := get(h)
+			if v == "" {
+				return "", fmt.Errorf("signed header %s is missing", h)
+			}
+
+			out = append(out, fmt.Sprintf("%s: %s", h, v))
+		}
+	}
+
+	return strings.Join(out, "\n"), nil
+}
+
+// parseDate parses the Date header.
+// Older versions of Feditext send UTC instead of GMT, so both are accepted.
+func parseDate(s string) (time.Time, error) {
+	if t, err := http.ParseTime(s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC1123, s)
+}
+
+// errBadSignature is returned when a signature doesn't check out against the
+// key we have for it.
+// Only then is it worth fetching the key again, in case it was rotated.
+var errBadSignature = errors.New("bad signature")
+
+var (
+	refetches   = map[string]time.Time{}
+	refetchLock sync.Mutex
+)
+
+// mayRefetch checks if the key of id may be fetched again because a signature
+// didn't match it, and if so, notes that it is.
+// Without this, anyone could make us fetch an actor over and over by sending
+// requests with bad signatures.
+func mayRefetch(id string) bool {
+	refetchLock.Lock()
+	defer refetchLock.Unlock()
+
+	now := time.Now()
+	if t, ok := refetches[id]; ok && now.Sub(t) < config.KeyRefetchInterval {
+		return false
+	}
+
+	// Anything older than that is no longer needed.
+	for k, t := range refetches {
+		if now.Sub(t) >= config.KeyRefetchInterval {
+			delete(refetches, k)
+		}
+	}
+
+	refetches[id] = now
+	return true
+}
+
+// verifyRequest verifies a parsed signature against a request.
+// required is the list of headers that the signature must cover.
+func verifyRequest(sig signature, keyPem, method, target string, get func(string) string, body []byte, required []string) error {
+	data, err := checkRequest(sig, method, target, get, body, required)
 	if err != nil {
-		return pubkey, err
+		return err
 	}
 
-	return pubkey, writePem(id, &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pubkey,
-	})
+	return verifySigned(sig, keyPem, data)
 }
 
-func Sign(id string, data string) (string, error) {
-	key, err := getPrivateKey(id)
+// checkRequest checks everything about a signed request but the signature
+// itself, and returns the string that was signed.
+func checkRequest(sig signature, method, target string, get func(string) string, body []byte, required []string) (string, error) {
+	switch sig.algorithm {
+	case "", "rsa-sha256", "hs2019":
+		// hs2019 leaves the algorithm up to the key, which is always RSA for us
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %s", sig.algorithm)
+	}
+
+	for _, h := range required {
+		if !util.Has(h, sig.headers) {
+			return "", fmt.Errorf("signature does not cover %s", h)
+		}
+	}
+
+	// Check date for replay attacks
+	t, err := parseDate(get("date"))
 	if err != nil {
 		return "", err
 	}
 
-	hash := sha256.Sum256([]byte(data))
-	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	// Prevent reuse attacks
+	if d := time.Since(t); d > signWindow*time.Second || d < -signWindow*time.Second {
+		return "", fmt.Errorf("missed sign window")
+	}
 
-	return base64.StdEncoding.EncodeToString(sig), err
+	// The signature only covers the digest, so make sure it covers the body
+	if util.Has("digest", sig.headers) {
+		if err := checkDigest(get("digest"), body); err != nil {
+			return "", err
+		}
+	}
+
+	return signingString(sig.headers, method, target, get)
 }
 
-func Verify(keyPem string, sign string, data string) error {
-	sig, err := base64.StdEncoding.DecodeString(sign)
+// verifySigned checks a signature against what was signed.
+func verifySigned(sig signature, keyPem, data string) error {
+	if err := Verify(keyPem, sig.signature, data); err != nil {
+		return fmt.Errorf("%w: %s", errBadSignature, err)
+	}
+
+	return nil
+}
+
+// signRequest signs an outgoing request.
+// If body is not nil, a Digest header is added and signed along with it.
+func signRequest(req *http.Request, key *rsa.PrivateKey, keyID string, body []byte) error {
+	headers := []string{"(request-target)", "host", "date"}
+
+	req.Host = req.URL.Host
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	if body != nil {
+		req.Header.Set("Digest", Digest(body))
+		headers = append(headers, "digest")
+	}
+
+	get := func(h string) string {
+		if h == "host" {
+			return req.Host
+		}
+		return req.Header.Get(h)
+	}
+
+	data, err := signingString(headers, req.Method, req.URL.RequestURI(), get)
 	if err != nil {
 		return err
 	}
 
-	block, _ := pem.Decode([]byte(keyPem))
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	sig, err := sign(key, data)
 	if err != nil {
 		return err
 	}
 
-	hash := sha256.Sum256([]byte(data))
-	return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], sig)
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`, keyID, strings.Join(headers, " "), sig))
+	return nil
 }
 
+// CheckHeaders verifies the signature on an incoming activity sent by the
+// actor id.
+// Keys are fetched on behalf of the instance.
 func CheckHeaders(c *fiber.Ctx, id string) error {
 	// See https://blog.joinmastodon.org/2018/07/how-to-make-friends-and-verify-requests/
 
-	// Check date for replay attacks
-	t, err := time.Parse(time.RFC1123, c.GetReqHeaders()["Date"])
+	sig, err := parseSignature(c.Get("Signature"))
 	if err != nil {
 		return err
 	}
 
-	// Prevent reuse attacks
-	if time.Now().UTC().Sub(t).Seconds() > signWindow {
-		return fmt.Errorf("missed sign window")
+	// Check everything we can before fetching anything
+	get := func(h string) string { return c.Get(h) }
+	data, err := checkRequest(sig, c.Method(), c.OriginalURL(), get, c.Body(), requiredHeaders)
+	if err != nil {
+		return err
 	}
 
-	out := []string{}
-	sig := ""
-	kid := ""
-
-	// Split up headers
-	headers := ""
-	for _, v := range strings.Split(c.GetReqHeaders()["Signature"], ",") {
-		toks := strings.SplitN(v, "=", 2)
-		if len(toks) != 2 {
-			return fmt.Errorf("incorrectly formatted signature header")
+	// Fetch key id, the one we may receive in the request that triggered this
+	// function could be uncool
+	verify := func() error {
+		actor, err := Finger(c.Context(), "", id)
+		if err != nil {
+			return err
 		}
 
-		k := toks[0]
-		v = strings.TrimPrefix(strings.TrimSuffix(toks[1], "\""), "\"")
-		switch strings.ToLower(k) {
-		case "keyid":
-			kid = v
-		case "headers":
-			headers = v
-		case "signature":
-			sig = v
+		if actor.PublicKey == nil || actor.PublicKey.Pem == "" {
+			return fmt.Errorf("fingered actor does not have public key")
+		} else if actor.PublicKey.ID != sig.keyID {
+			return fmt.Errorf("%w: fetched key id (%s) does not match expected (%s)", errBadSignature, actor.PublicKey.ID, sig.keyID)
 		}
+
+		return verifySigned(sig, actor.PublicKey.Pem, data)
 	}
 
-	// Fetch key id, the one we may receive in the request that triggered this
-	// function could be uncool
-	actor, err := Finger(c.Context(), id)
-	if err != nil {
+	err = verify()
+	if err == nil || !errors.Is(err, errBadSignature) || !mayRefetch(id) {
 		return err
 	}
 
-	if actor.PublicKey == nil || actor.PublicKey.Pem == "" {
-		return fmt.Errorf("fingered actor does not have public key")
-	} else if actor.PublicKey.ID != kid {
-		return fmt.Errorf(fmt.Sprintf("fetched key id (%s) does not match expected (%s)", actor.PublicKey.ID, kid))
+	// The key we have may be out of date if it was rotated, so try again
+	// with a fresh one.
+	Forget(id)
+	return verify()
+}
+
+// CheckSignature verifies the signature on a request that has no body, such
+// as a GET request, and returns the ID of the actor that signed it.
+// Keys are fetched on behalf of the instance.
+func CheckSignature(c *fiber.Ctx) (string, error) {
+	sig, err := parseSignature(c.Get("Signature"))
+	if err != nil {
+		return "", err
 	}
 
-	keyPem := actor.PublicKey.Pem
+	get := func(h string) string { return c.Get(h) }
+	data, err := checkRequest(sig, c.Method(), c.OriginalURL(), get, nil, fetchHeaders)
+	if err != nil {
+		return "", err
+	}
 
-	// Parse header
-	for _, v := range strings.Split(headers, " ") {
-		switch strings.ToLower(v) {
-		case "(request-target)": // Ensure it's to _this_ path, not some other one.
-			out = append(out, fmt.Sprintf("(request-target): %s %s", strings.ToLower(c.Method()), c.Path()))
-		default:
-			out = append(out, fmt.Sprintf("%s: %s", v, c.GetReqHeaders()[strings.Title(v)]))
+	verify := func() (string, error) {
+		actor, err := fetchKey(c.Context(), "", sig.keyID)
+		if err != nil {
+			return "", err
 		}
+
+		return actor.ID, verifySigned(sig, actor.PublicKey.Pem, data)
+	}
+
+	id, err := verify()
+	if err == nil || !errors.Is(err, errBadSignature) || !mayRefetch(sig.keyID) {
+		return id, err
 	}
 
-	// TODO: Assumes digest is SHA256.
-	return Verify(keyPem, sig, strings.Join(out, "\n"))
+	// See CheckHeaders.
+	forgetKey(sig.keyID)
+	return verify()
 }
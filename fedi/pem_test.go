@@ -0,0 +1,234 @@
+package fedi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+}
+
+// testRequest creates a signed request, lets mod tamper with it, and returns
+// what verifyRequest needs.
+func testRequest(t *testing.T, key *rsa.PrivateKey, body []byte, mod func(req *http.Request)) (signature, func(string) string, *http.Request) {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", "https://example.com/prog/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signRequest(req, key, "https://example.com/prog#key", body); err != nil {
+		t.Fatal(err)
+	}
+
+	if mod != nil {
+		mod(req)
+	}
+
+	sig, err := parseSignature(req.Header.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h string) string {
+		if h == "host" {
+			return req.Host
+		}
+		return req.Header.Get(h)
+	}
+
+	return sig, get, req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key, pub := testKey(t)
+	_, otherPub := testKey(t)
+
+	body := []byte(`{"type":"Create"}`)
+
+	tests := []struct {
+		name    string
+		body    []byte // body seen by the verifier; nil means the signed body
+		keyPem  string
+		mod     func(req *http.Request)
+		wantErr bool
+		badSig  bool // the error should make us fetch the key again
+	}{
+		{name: "valid"},
+		{
+			name: "hs2019",
+			mod: func(req *http.Request) {
+				req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), "rsa-sha256", "hs2019", 1))
+			},
+		},
+		{
+			name: "unknown algorithm",
+			mod: func(req *http.Request) {
+				req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), "rsa-sha256", "ed25519", 1))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "replayed with different body",
+			body:    []byte(`{"type":"Delete"}`),
+			wantErr: true,
+		},
+		{
+			name: "digest not covered",
+			mod: func(req *http.Request) {
+				req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), " digest", "", 1))
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported digest",
+			mod: func(req *http.Request) {
+				req.Header.Set("Digest", "MD5=AAAA")
+			},
+			wantErr: true,
+		},
+		{
+			name: "stale date",
+			mod: func(req *http.Request) {
+				req.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			},
+			wantErr: true,
+		},
+		{
+			name: "different path",
+			mod: func(req *http.Request) {
+				req.URL.Path = "/b/inbox"
+			},
+			wantErr: true,
+			badSig:  true,
+		},
+		{
+			name: "different host",
+			mod: func(req *http.Request) {
+				req.Host = "evil.example.com"
+			},
+			wantErr: true,
+			badSig:  true,
+		},
+		{
+			name:    "wrong key",
+			keyPem:  otherPub,
+			wantErr: true,
+			badSig:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, get, req := testRequest(t, key, body, tt.mod)
+
+			b := body
+			if tt.body != nil {
+				b = tt.body
+			}
+
+			k := pub
+			if tt.keyPem != "" {
+				k = tt.keyPem
+			}
+
+			err := verifyRequest(sig, k, req.Method, req.URL.RequestURI(), get, b, requiredHeaders)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyRequest() error = %v, wantErr %v", err, tt.wantErr)
+			} else if errors.Is(err, errBadSignature) != tt.badSig {
+				t.Errorf("verifyRequest() error = %v, badSig %v", err, tt.badSig)
+			}
+		})
+	}
+}
+
+func TestMayRefetch(t *testing.T) {
+	if !mayRefetch("https://example.com/a") {
+		t.Errorf("first refetch of a was refused")
+	}
+
+	if mayRefetch("https://example.com/a") {
+		t.Errorf("second refetch of a was allowed")
+	}
+
+	if !mayRefetch("https://example.com/b") {
+		t.Errorf("first refetch of b was refused")
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		hdr     string
+		want    signature
+		wantErr bool
+	}{
+		{
+			name: "mastodon",
+			hdr:  `keyId="https://example.com/users/a#main-key",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="Y2FiYmFnZQ=="`,
+			want: signature{
+				keyID:     "https://example.com/users/a#main-key",
+				algorithm: "rsa-sha256",
+				headers:   []string{"(request-target)", "host", "date", "digest"},
+				signature: "Y2FiYmFnZQ==",
+			},
+		},
+		{
+			name: "no headers",
+			hdr:  `keyId="https://example.com/prog#key",signature="Y2FiYmFnZQ=="`,
+			want: signature{
+				keyID:     "https://example.com/prog#key",
+				headers:   []string{"date"},
+				signature: "Y2FiYmFnZQ==",
+			},
+		},
+		{
+			name:    "no signature",
+			hdr:     `keyId="https://example.com/prog#key",headers="date"`,
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			hdr:     `what`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSignature(tt.hdr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSignature() error = %v, wantErr %v", err, tt.wantErr)
+			} else if tt.wantErr {
+				return
+			}
+
+			if got.keyID != tt.want.keyID || got.algorithm != tt.want.algorithm || got.signature != tt.want.signature ||
+				strings.Join(got.headers, " ") != strings.Join(tt.want.headers, " ") {
+				t.Errorf("parseSignature() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package fedi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/database"
+)
+
+// pollTick is how often Poll checks if anything needs to be polled.
+const pollTick = time.Minute
+
+type pollState struct {
+	next     time.Time
+	failures int
+}
+
+// pollInterval returns how often target should be polled.
+func pollInterval(target string) time.Duration {
+	if d, ok := config.PollIntervals[target]; ok {
+		return d
+	}
+
+	return config.PollInterval
+}
+
+// jitter adds up to a tenth of d to d, so that polls don't all happen at once.
+func jitter(d time.Duration) time.Duration {
+	if d < 10 {
+		return d
+	}
+
+	return d + time.Duration(rand.Int63n(int64(d/10)))
+}
+
+// Poll periodically fetches the outboxes of everything our boards follow and
+// imports any posts we're missing.
+// It runs until ctx is cancelled.
+func Poll(ctx context.Context) {
+	state := map[[2]string]*pollState{}
+
+	t := time.NewTicker(pollTick)
+	defer t.Stop()
+
+	for {
+		pollOnce(ctx, state)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func pollOnce(ctx context.Context, state map[[2]string]*pollState) {
+	boards, err := DB.Boards(ctx)
+	if err != nil {
+		log.Printf("poll: unable to list boards: %s", err)
+		return
+	}
+
+	now := time.Now()
+
+	for _, board := range boards {
+		following, err := DB.Following(ctx, board.ID)
+		if err != nil {
+			log.Printf("poll: unable to list following for %s: %s", board.ID, err)
+			continue
+		}
+
+		for _, target := range following {
+			interval := pollInterval(target)
+			if interval <= 0 {
+				continue
+			}
+
+			key := [2]string{board.ID, target}
+			st, ok := state[key]
+			if !ok {
+				// Pick up where we left off, if we can.
+				st = &pollState{next: now.Add(jitter(pollTick) - pollTick)}
+				if last, err := DB.LastSync(ctx, board.ID, target); err == nil {
+					st.next = last.Date.Add(jitter(interval))
+				}
+				state[key] = st
+			}
+
+			if now.Before(st.next) {
+				continue
+			}
+
+			if err := Sync(ctx, board.ID, target); err != nil {
+				st.failures++
+
+				// Back off exponentially.
+				backoff := interval
+				for i := 0; i < st.failures && backoff < config.MaxPollBackoff; i++ {
+					backoff *= 2
+				}
+				if backoff > config.MaxPollBackoff {
+					backoff = config.MaxPollBackoff
+				}
+
+				st.next = time.Now().Add(jitter(backoff))
+				log.Printf("poll: syncing %s for %s failed %d times, next try in %s: %s", target, board.ID, st.failures, st.next.Sub(time.Now()).Round(time.Second), err)
+			} else {
+				st.failures = 0
+				st.next = time.Now().Add(jitter(interval))
+			}
+		}
+	}
+
+	// Forget about anything we've stopped following.
+	for key := range state {
+		found := false
+		if following, err := DB.Following(ctx, key[0]); err == nil {
+			for _, target := range following {
+				if target == key[1] {
+					found = true
+					break
+				}
+			}
+		}
+
+		if !found {
+			delete(state, key)
+		}
+	}
+}
+
+// Sync fetches the outbox of target and imports any posts made since the last
+// successful sync into board.
+// The result is recorded in the database.
+func Sync(ctx context.Context, board, target string) error {
+	since := time.Time{}
+	if last, err := DB.LastSync(ctx, board, target); err == nil {
+		since = last.Date
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	start := time.Now()
+	n, err := syncOutbox(ctx, board, target, since)
+
+	sync := database.Sync{
+		Board:    board,
+		Target:   target,
+		Date:     start.UTC(),
+		Duration: time.Since(start),
+		Posts:    n,
+	}
+	if err != nil {
+		sync.Error = err.Error()
+	}
+
+	if serr := DB.SaveSync(ctx, sync); serr != nil {
+		log.Printf("poll: unable to record sync of %s for %s: %s", target, board, serr)
+	}
+
+	return err
+}
+
+func syncOutbox(ctx context.Context, board, target string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, Proxy.MaxTime(target))
+	defer cancel()
+
+	ob, err := FetchOutbox(ctx, board, target)
+	if err != nil {
+		return 0, err
+	}
+
+	return MergeOutbox(ctx, board, ob, since)
+}
@@ -6,12 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/KushBlazingJudah/feditext/database"
 	"github.com/KushBlazingJudah/feditext/util"
 )
 
+// ErrNoThread is returned by AsPost when a Note replies to a thread that we
+// don't have.
+var ErrNoThread = errors.New("no suitable thread in the database to reply to")
+
 func (n Object) AsPost(ctx context.Context, board string) (database.Post, error) {
 	if n.Type != "Note" {
 		// We need an actor to save.
@@ -37,19 +43,23 @@ func (n Object) AsPost(ctx context.Context, board string) (database.Post, error)
 		updated = time.Now().UTC()
 	}
 
+	actor := n.author()
+	if actor == "" {
+		// We need an actor to save.
+		return database.Post{}, fmt.Errorf("Object.AsPost: no actor")
+	}
+
 	name := ""
 	if n.AttributedTo == nil || n.AttributedTo.ID == "" {
 		name = "Anonymous"
+	} else if n.AttributedTo.ID == actor {
+		// This is a person and not a name, like FChannel puts here.
+		name = displayName(ctx, actor)
 	} else {
 		name = n.AttributedTo.ID
 	}
 
-	actor := ""
-	if n.Actor == nil || n.Actor.ID == "" {
-		// We need an actor to save.
-		return database.Post{}, fmt.Errorf("Object.AsPost: no actor")
-	}
-	actor = n.Actor.ID
+	raw := n.Text()
 
 	// The post coming in may have a thread attached to it.
 	// Look for it.
@@ -69,9 +79,12 @@ func (n Object) AsPost(ctx context.Context, board string) (database.Post, error)
 
 				if th.Thread == 0 {
 					thread = th.ID
-					ok = true
-					break
+				} else {
+					// Replies to a reply go into the same thread.
+					thread = th.Thread
 				}
+				ok = true
+				break
 			} else {
 				// FChannel implementation bug
 				thread = 0
@@ -87,7 +100,7 @@ func (n Object) AsPost(ctx context.Context, board string) (database.Post, error)
 
 	if !ok {
 		// No post in the database, ignore!
-		return database.Post{}, fmt.Errorf("no suitable thread in the database to reply to, ignoring")
+		return database.Post{}, ErrNoThread
 	}
 
 	return database.Post{
@@ -103,14 +116,79 @@ func (n Object) AsPost(ctx context.Context, board string) (database.Post, error)
 		Subject:  n.Name,
 		Date:     published,
 		Bumpdate: updated,
-		Raw:      n.Content,
+		Raw:      raw,
 		Source:   actor,
 		APID:     n.ID,
 		Sage:     saged,
-		SJIS:     util.IsJapanese(n.Content),
+		SJIS:     util.IsJapanese(raw),
 	}, nil
 }
 
+// author returns the ID of the actor that sent n, or an empty string if it
+// doesn't say.
+func (n Object) author() string {
+	if n.Actor != nil && n.Actor.Object != nil && n.Actor.ID != "" {
+		return n.Actor.ID
+	} else if n.AttributedTo != nil && isURL(n.AttributedTo.ID) {
+		// Most software says who wrote a Note with attributedTo.
+		return n.AttributedTo.ID
+	}
+
+	return ""
+}
+
+// fromBoard checks if n was sent by a board on FChannel or Feditext, rather
+// than by a person.
+// Boards are Groups, and put the name of the poster in attributedTo, if
+// anything.
+func (n Object) fromBoard() bool {
+	if n.Actor != nil && n.Actor.Object != nil && n.Actor.Type == "Group" {
+		return true
+	}
+
+	return n.AttributedTo == nil || n.AttributedTo.ID != n.author()
+}
+
+// Text returns the content of a Note as plain text.
+// Notes that say they are HTML are converted.
+// So are Notes from people that don't say what they are, since Mastodon and
+// friends send HTML without saying so; boards send plain text, where
+// something that looks like a tag is just text.
+func (n Object) Text() string {
+	if n.MediaType == "text/html" || (n.MediaType == "" && !n.fromBoard() && util.LooksLikeHTML(n.Content)) {
+		return util.HTMLToText(n.Content)
+	}
+
+	return n.Content
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// displayName finds the name of a person who sent us a post.
+func displayName(ctx context.Context, id string) string {
+	actor, err := Finger(ctx, "", id)
+	if err != nil {
+		log.Printf("failed to fetch actor %s: %v", id, err)
+		return "Anonymous"
+	}
+
+	name := actor.PreferredUsername
+	if actor.Object != nil && actor.Name != "" {
+		name = actor.Name
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Anonymous"
+	} else if len(name) > config.NameCutoff {
+		name = strings.ToValidUTF8(name[:config.NameCutoff], "")
+	}
+
+	return name
+}
+
 func (n Object) AsThread(ctx context.Context, board string) ([]database.Post, error) {
 	var posts []database.Post
 
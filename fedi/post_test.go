@@ -0,0 +1,67 @@
+package fedi
+
+import "testing"
+
+func TestText(t *testing.T) {
+	person := "https://mastodon.example/users/alice"
+	group := "https://feditext.example/prog"
+
+	tests := []struct {
+		name string
+		note Object
+		want string
+	}{
+		{
+			name: "html from a person",
+			note: Object{
+				AttributedTo: &LinkObject{Type: "Link", ID: person},
+				Actor:        &LinkActor{Object: &Object{Type: "Link", ID: person}},
+				Content:      "<p>hello<br>there</p>",
+			},
+			want: "hello\nthere",
+		},
+		{
+			name: "plain text from FChannel",
+			note: Object{
+				Actor:   &LinkActor{Object: &Object{Type: "Group", ID: group}},
+				Content: "use <b> for bold",
+			},
+			want: "use <b> for bold",
+		},
+		{
+			name: "plain text from a board by link",
+			note: Object{
+				AttributedTo: &LinkObject{Type: "Link", ID: "anon"},
+				Actor:        &LinkActor{Object: &Object{Type: "Link", ID: group}},
+				Content:      "<p> is a paragraph",
+			},
+			want: "<p> is a paragraph",
+		},
+		{
+			name: "board that says it is html",
+			note: Object{
+				Actor:     &LinkActor{Object: &Object{Type: "Group", ID: group}},
+				MediaType: "text/html",
+				Content:   "<p>a &amp; b</p>",
+			},
+			want: "a & b",
+		},
+		{
+			name: "person that says it is plain",
+			note: Object{
+				AttributedTo: &LinkObject{Type: "Link", ID: person},
+				MediaType:    "text/plain",
+				Content:      "<p>not a paragraph</p>",
+			},
+			want: "<p>not a paragraph</p>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.note.Text(); got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,40 +2,212 @@ package fedi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/util"
 )
 
-var Proxy proxy
+// ErrForbiddenHost is returned when a request would be made to a host that we
+// aren't allowed to talk to, such as one on the local network.
+var ErrForbiddenHost = errors.New("requests to this host are not allowed")
+
+// ErrResponseTooLarge is returned when reading a response body larger than
+// config.MaxResponseSize.
+var ErrResponseTooLarge = errors.New("response body is too large")
+
+var Proxy proxy = mustProxy(NewProxy("", nil))
 var ua = fmt.Sprintf("feditext/%s", config.Version)
 
+// proxy is what every request going out to other servers goes through.
+// It refuses to talk to hosts forbidden by util.ValidHost, whether they are
+// reached directly, through DNS, or through a redirect.
+//
+// Requests are routed by the host they are going to; see config.Routes.
 type proxy struct {
-	client http.Client
+	client *http.Client
+	routes []route
 }
 
-func NewProxy(proxyUrl string) (proxy, error) {
-	if proxyUrl == "" {
-		// Zero value is fine
-		return proxy{}, nil
+type route struct {
+	suffix string
+	client *http.Client
+}
+
+func mustProxy(p proxy, err error) proxy {
+	if err != nil {
+		panic(err)
 	}
+	return p
+}
 
-	u, err := url.Parse(proxyUrl)
+// dialControl checks the address we're about to connect to, after any DNS
+// lookups have been done.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !util.ValidIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+	}
+
+	return nil
+}
+
+// checkURL checks if we're allowed to make a request to u.
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" || !util.ValidHost(u.Hostname()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, u.Hostname())
+	}
+
+	return nil
+}
+
+// matchSuffix checks if host is suffix, or a subdomain of it.
+// A leading dot on suffix is ignored, so ".onion" matches every hidden
+// service.
+func matchSuffix(host, suffix string) bool {
+	suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+	host = strings.ToLower(host)
+
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// newClient creates an HTTP client that goes through proxyUrl, or connects
+// directly if it is empty.
+func newClient(proxyUrl string, timeout time.Duration) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tr := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if proxyUrl != "" {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		// The only thing we connect to is the proxy, which very likely lives
+		// on this machine, and the proxy does DNS lookups for us.
+		// All that can be checked is the URL itself.
+		tr.Proxy = http.ProxyURL(u)
+	} else {
+		dialer.Control = dialControl
+	}
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+	}, nil
+}
+
+// NewProxy creates a proxy that sends requests through proxyUrl, or directly
+// if it is empty, unless one of routes says otherwise.
+func NewProxy(proxyUrl string, routes []config.Route) (proxy, error) {
+	p := proxy{}
+
+	var err error
+	p.client, err = newClient(proxyUrl, config.RequestTimeout)
 	if err != nil {
 		return proxy{}, err
 	}
 
-	hc := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(u),
-		},
-		Timeout: config.RequestTimeout,
+	for _, r := range routes {
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = config.RequestTimeout
+		}
+
+		c, err := newClient(r.Proxy, timeout)
+		if err != nil {
+			return proxy{}, fmt.Errorf("route for %s: %w", r.Suffix, err)
+		}
+
+		p.routes = append(p.routes, route{suffix: r.Suffix, client: c})
 	}
 
-	return proxy{client: hc}, nil
+	// Every client needs to know about every route to check redirects.
+	for _, c := range p.clients() {
+		c := c
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			// Don't let a redirect send a request out the wrong way, like a
+			// hidden service sending us to the clearnet without Tor.
+			if p.route(req.URL.Hostname()) != c {
+				return fmt.Errorf("refusing redirect from %s to %s", via[0].URL.Hostname(), req.URL.Hostname())
+			}
+
+			return checkURL(req.URL)
+		}
+	}
+
+	return p, nil
+}
+
+func (p proxy) clients() []*http.Client {
+	c := []*http.Client{p.client}
+	for _, r := range p.routes {
+		c = append(c, r.client)
+	}
+	return c
+}
+
+// route picks the client requests to host go through.
+// The route with the longest matching suffix wins.
+func (p proxy) route(host string) *http.Client {
+	c := p.client
+	best := -1
+
+	for _, r := range p.routes {
+		if matchSuffix(host, r.suffix) && len(r.suffix) > best {
+			c = r.client
+			best = len(r.suffix)
+		}
+	}
+
+	return c
+}
+
+// MaxTime returns how long something that makes requests to uri may take in
+// total: config.MaxReqTime, or longer if the route to it allows requests to
+// take longer.
+func (p proxy) MaxTime(uri string) time.Duration {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return config.MaxReqTime
+	}
+
+	if t := p.route(u.Hostname()).Timeout; t > config.MaxReqTime {
+		return t
+	}
+
+	return config.MaxReqTime
 }
 
 func (p proxy) Request(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
@@ -44,12 +216,53 @@ func (p proxy) Request(ctx context.Context, method, url string, body io.Reader)
 		return nil, err
 	}
 
-	req.Header.Set("User-Agent", ua)
-
-	return p.client.Do(req)
+	return p.Do(req)
 }
 
 func (p proxy) Do(req *http.Request) (*http.Response, error) {
+	if err := checkURL(req.URL); err != nil {
+		return nil, err
+	}
+
 	req.Header.Set("User-Agent", ua)
-	return p.client.Do(req)
+
+	res, err := p.route(req.URL.Hostname()).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body = &limitedBody{rc: res.Body, n: config.MaxResponseSize}
+	return res, nil
+}
+
+// limitedBody errors out if more than n bytes are read from it.
+// Unlike io.LimitReader, the response being cut short is not mistaken for a
+// complete one.
+type limitedBody struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// See if there is anything left
+		var b [1]byte
+		n, err := l.rc.Read(b[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.rc.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
 }
@@ -0,0 +1,198 @@
+package fedi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+)
+
+// allowLocal sets config.AllowLocal for the rest of a test.
+func allowLocal(t *testing.T, allow bool) {
+	t.Helper()
+
+	old := config.AllowLocal
+	config.AllowLocal = allow
+	t.Cleanup(func() { config.AllowLocal = old })
+}
+
+func TestDialControl(t *testing.T) {
+	allowLocal(t, false)
+
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:80", false},
+		{"127.1.2.3:443", false},
+		{"[::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:443", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fc00::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+		{"localhost:80", false}, // Not an IP; names should be resolved by now
+		{"93.184.216.34:443", true},
+		{"[2606:4700::1111]:443", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := dialControl("tcp", tt.address, nil)
+			if tt.ok && err != nil {
+				t.Errorf("dialControl(%s) = %v, want nil", tt.address, err)
+			} else if !tt.ok && !errors.Is(err, ErrForbiddenHost) {
+				t.Errorf("dialControl(%s) = %v, want ErrForbiddenHost", tt.address, err)
+			}
+		})
+	}
+}
+
+func TestProxyForbidden(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request to %s went through", r.URL)
+	}))
+	defer srv.Close()
+
+	allowLocal(t, false)
+
+	p, err := NewProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(srv.URL)
+	port := u.Port()
+
+	for _, uri := range []string{
+		srv.URL,                             // By IP
+		"http://localhost:" + port,          // By a name that resolves to a local IP
+		"http://[::ffff:127.0.0.1]:" + port, // IPv4 in IPv6
+	} {
+		if _, err := p.Request(context.Background(), "GET", uri, nil); !errors.Is(err, ErrForbiddenHost) {
+			t.Errorf("request to %s: got %v, want ErrForbiddenHost", uri, err)
+		}
+	}
+
+	if _, err := p.Request(context.Background(), "GET", "ftp://example.com/x", nil); err == nil {
+		t.Errorf("FTP request was allowed")
+	}
+}
+
+func TestProxyRedirect(t *testing.T) {
+	allowLocal(t, true)
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(srv.URL)
+
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, srv.URL+"/ok", http.StatusFound)
+		case "/other":
+			// localhost goes through another route
+			http.Redirect(w, r, "http://localhost:"+u.Port()+"/ok", http.StatusFound)
+		case "/ok":
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewProxy("", []config.Route{{Suffix: "localhost", Timeout: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := p.Request(context.Background(), "GET", srv.URL+"/same", nil)
+	if err != nil {
+		t.Fatalf("redirect on the same route: %v", err)
+	}
+	res.Body.Close()
+
+	if _, err := p.Request(context.Background(), "GET", srv.URL+"/other", nil); err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+		t.Errorf("redirect to another route: got %v, want it refused", err)
+	}
+}
+
+func TestProxyResponseSize(t *testing.T) {
+	allowLocal(t, true)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := config.MaxResponseSize
+		if r.URL.Path == "/big" {
+			n++
+		}
+
+		w.Write(bytes.Repeat([]byte("a"), n))
+	}))
+	defer srv.Close()
+
+	p, err := NewProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		err  error
+	}{
+		{"/fits", nil},
+		{"/big", ErrResponseTooLarge},
+	} {
+		res, err := p.Request(context.Background(), "GET", srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("reading %s: got %v, want %v", tt.path, err, tt.err)
+		} else if tt.err == nil && len(body) != config.MaxResponseSize {
+			t.Errorf("reading %s: got %d bytes, want %d", tt.path, len(body), config.MaxResponseSize)
+		}
+	}
+}
+
+func TestProxyRoute(t *testing.T) {
+	p, err := NewProxy("", []config.Route{
+		{Suffix: ".onion", Timeout: 1 * time.Minute},
+		{Suffix: "foo.onion", Timeout: 2 * time.Minute},
+		{Suffix: "example.com", Timeout: 3 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		timeout time.Duration
+	}{
+		{"bar.onion", 1 * time.Minute},
+		{"foo.onion", 2 * time.Minute},
+		{"a.foo.onion", 2 * time.Minute},
+		{"xfoo.onion", 1 * time.Minute},
+		{"EXAMPLE.com", 3 * time.Minute},
+		{"www.example.com", 3 * time.Minute},
+		{"notexample.com", config.RequestTimeout},
+		{"example.com.evil", config.RequestTimeout},
+	}
+
+	for _, tt := range tests {
+		if got := p.route(tt.host).Timeout; got != tt.timeout {
+			t.Errorf("route(%s) has timeout %s, want %s", tt.host, got, tt.timeout)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package fedi
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/database"
+)
+
+// pushInterval is how long to wait between posts sent by PushThreads to the
+// same host, so that it isn't flooded.
+const pushInterval = 2 * time.Second
+
+var (
+	// pushNext is when the next post may be pushed to each host.
+	// Every push to a host shares it, whatever board or follower it's for.
+	pushNext = map[string]time.Time{}
+
+	// pushing holds the board and follower of every push going on.
+	pushing = map[[2]string]bool{}
+
+	pushLock sync.Mutex
+)
+
+// pushWait waits until a post may be pushed to host.
+func pushWait(ctx context.Context, host string) error {
+	pushLock.Lock()
+	now := time.Now()
+	for h, t := range pushNext {
+		if t.Before(now) {
+			delete(pushNext, h)
+		}
+	}
+
+	at, ok := pushNext[host]
+	if !ok {
+		at = now
+	}
+	pushNext[host] = at.Add(pushInterval)
+	pushLock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(at)):
+		return nil
+	}
+}
+
+// PushThreads sends the most recently bumped threads made on board, and the
+// replies made to them here, to a board that just started following it, so
+// that it has something to show.
+// How many threads are sent is set by the board; see database.Board.Push.
+// The posts are only sent to follower, and only one push to a follower of a
+// board happens at a time.
+func PushThreads(ctx context.Context, board database.Board, follower string) error {
+	if board.Push <= 0 {
+		return nil
+	}
+
+	u, err := url.Parse(follower)
+	if err != nil {
+		return err
+	}
+
+	key := [2]string{board.ID, follower}
+	pushLock.Lock()
+	if pushing[key] {
+		pushLock.Unlock()
+		log.Printf("Already pushing threads of %s to %s", board.ID, follower)
+		return nil
+	}
+	pushing[key] = true
+	pushLock.Unlock()
+
+	defer func() {
+		pushLock.Lock()
+		delete(pushing, key)
+		pushLock.Unlock()
+	}()
+
+	threads, err := DB.Threads(ctx, board.ID, 0)
+	if err != nil {
+		return err
+	}
+
+	push := []database.Post{}
+	for _, t := range threads {
+		if len(push) == board.Push {
+			break
+		} else if t.IsLocal() {
+			push = append(push, t)
+		}
+	}
+
+	actor := TransformBoard(board)
+	actor.NoCollapse = true
+	lactor := LinkActor(actor)
+
+	// Oldest first, so that they are bumped in the same order over there.
+	for i := len(push) - 1; i >= 0; i-- {
+		posts, err := DB.Thread(ctx, board.ID, push[i].ID, 0, false)
+		if err != nil {
+			return err
+		}
+
+		for _, post := range posts {
+			if !post.IsLocal() {
+				// Not ours to send
+				continue
+			}
+
+			if err := pushWait(ctx, u.Hostname()); err != nil {
+				return err
+			}
+
+			note, err := postNote(ctx, board, post)
+			if err != nil {
+				return err
+			}
+
+			act := Activity{
+				Object: &Object{
+					Context: Context,
+					Type:    "Create",
+					Actor:   &lactor,
+					To:      LinkList{{Type: "Link", ID: follower}},
+					Cc:      note.Cc,
+				},
+				ObjectProp: &note,
+			}
+
+			if err := SendActivity(ctx, act); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package fedi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/KushBlazingJudah/feditext/util"
+)
+
+// ErrDuplicate is returned by ImportAnnounce when we already have the post.
+var ErrDuplicate = errors.New("post already exists")
+
+// relayActor returns the actor that subscribes to relays for board.
+// An empty board is the instance.
+func relayActor(ctx context.Context, board string) (LinkActor, error) {
+	if board == "" {
+		return LinkActor(InstanceActor()), nil
+	}
+
+	b, err := DB.Board(ctx, board)
+	if err != nil {
+		return LinkActor{}, err
+	}
+
+	return LinkActor(TransformBoard(b)), nil
+}
+
+// sendRelay sends a Follow, or an Undo of one, for a relay.
+// Relays only understand Follows of the Public collection.
+func sendRelay(ctx context.Context, board, relay string, undo bool) error {
+	actor, err := relayActor(ctx, board)
+	if err != nil {
+		return err
+	}
+
+	act := Activity{
+		Object: &Object{
+			Context: Context,
+			Type:    "Follow",
+			Actor:   &actor,
+			To:      LinkList{{Type: "Link", ID: relay}},
+		},
+	}
+
+	type follow struct {
+		*Object
+		Actor      string `json:"actor"`
+		ObjectProp any    `json:"object"`
+	}
+
+	var v any = follow{act.Object, actor.ID, Public}
+	if undo {
+		act.Object.Type = "Undo"
+		v = follow{act.Object, actor.ID, follow{&Object{Type: "Follow"}, actor.ID, Public}}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return deliver(ctx, act, data)
+}
+
+// RelayFollow subscribes board to a relay.
+// An empty board subscribes the whole instance.
+// relay is looked up first, and what is saved is the ID of its actor, since
+// that is what it sends activities as.
+// The subscription is pending until the relay sends an Accept.
+func RelayFollow(ctx context.Context, board, relay string) error {
+	actor, err := Finger(ctx, "", relay)
+	if err != nil {
+		return fmt.Errorf("%s is not an actor: %w", relay, err)
+	} else if actor.Inbox == "" {
+		return fmt.Errorf("%s has no inbox", relay)
+	}
+
+	if err := sendRelay(ctx, board, actor.ID, false); err != nil {
+		return err
+	}
+
+	return DB.SaveRelay(ctx, database.Relay{
+		Board:  board,
+		Target: actor.ID,
+		State:  database.FollowPending,
+	})
+}
+
+// RelayUnfollow unsubscribes board from a relay.
+func RelayUnfollow(ctx context.Context, board, relay string) error {
+	if err := DB.DeleteRelay(ctx, board, relay); err != nil {
+		return err
+	}
+
+	return sendRelay(ctx, board, relay, true)
+}
+
+// relayTargets returns the relays that posts made on board are sent to.
+func relayTargets(ctx context.Context, board string) ([]string, error) {
+	relays, err := DB.Relays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []string{}
+	for _, r := range relays {
+		if r.State == database.FollowAccepted && (r.Board == "" || r.Board == board) {
+			targets = append(targets, r.Target)
+		}
+	}
+
+	return targets, nil
+}
+
+// fetchAnnounced fetches the Note at id, which a relay announced.
+// Relays announce either the Note or the Create that made it, so both are
+// understood, as is what fetchNote understands.
+// Unlike fetchNote, this isn't rate limited as every announced post has to be
+// fetched.
+func fetchAnnounced(ctx context.Context, signer, id string) (Object, error) {
+	for i := 0; i < 2; i++ {
+		if blocked, err := Blocked(ctx, id); err != nil {
+			return Object{}, err
+		} else if blocked {
+			return Object{}, fmt.Errorf("%s is blocked", id)
+		}
+
+		res, err := fetch(ctx, signer, id)
+		if err != nil {
+			return Object{}, err
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return Object{}, err
+		}
+
+		act := Activity{}
+		if err := json.Unmarshal(body, &act); err != nil {
+			return Object{}, err
+		}
+
+		if act.Type == "OrderedCollection" {
+			col := OrderedCollection{}
+			if err := json.Unmarshal(body, &col); err != nil {
+				return Object{}, err
+			} else if len(col.OrderedItems) == 0 {
+				return Object{}, fmt.Errorf("%s is empty", id)
+			}
+
+			act = Activity{Object: (*Object)(&col.OrderedItems[0])}
+		}
+
+		if !util.EqualDomains(act.ID, id) {
+			return Object{}, fmt.Errorf("fetched %s but got %s", id, act.ID)
+		}
+
+		switch {
+		case act.Type == "Note":
+			return *act.Object, nil
+		case act.Type == "Create" && act.ObjectProp != nil && act.ObjectProp.Type == "Note":
+			if !util.EqualDomains(act.ObjectProp.ID, id) {
+				return Object{}, fmt.Errorf("%s created %s", id, act.ObjectProp.ID)
+			}
+			return *act.ObjectProp, nil
+		case act.Type == "Create" && act.ObjectProp != nil && act.ObjectProp.ID != "":
+			// Only a link to the Note
+			id = act.ObjectProp.ID
+		default:
+			return Object{}, fmt.Errorf("%s is a %s, not a Note", id, act.Type)
+		}
+	}
+
+	return Object{}, fmt.Errorf("could not find a Note at %s", id)
+}
+
+// relayBoard picks the board a Note announced to the instance goes on.
+// Only posts from boards elsewhere are taken, and they go on the board with
+// the same name as the one they came from, if it follows that board or is
+// subscribed to a relay itself.
+// Anything else, like posts from people, has nowhere to go.
+func relayBoard(ctx context.Context, note Object) (string, error) {
+	id := note.author()
+	author, err := Finger(ctx, "", id)
+	if err != nil {
+		return "", err
+	} else if author.Type != "Group" {
+		return "", fmt.Errorf("%s is not a board", id)
+	}
+
+	u, err := url.Parse(author.ID)
+	if err != nil {
+		return "", err
+	}
+
+	board, err := DB.Board(ctx, path.Base(u.Path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no board for %s", id)
+	} else if err != nil {
+		return "", err
+	}
+
+	following, err := DB.Following(ctx, board.ID)
+	if err != nil {
+		return "", err
+	} else if util.Has(author.ID, following) {
+		return board.ID, nil
+	}
+
+	relays, err := DB.Relays(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range relays {
+		if r.Board == board.ID && r.State == database.FollowAccepted {
+			return board.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s neither follows %s nor is subscribed to a relay", board.ID, id)
+}
+
+// ImportAnnounce imports a post that a relay announced to board.
+// An empty board means it was announced to the instance.
+// Whatever the relay sent along with the Announce is thrown away and the post
+// is fetched from where it came from, so that it can't be forged.
+func ImportAnnounce(ctx context.Context, board, id string) (database.Post, error) {
+	note, err := fetchAnnounced(ctx, board, id)
+	if err != nil {
+		return database.Post{}, err
+	}
+
+	// The host of the Note was checked against the blocklist already.
+	if actor := note.author(); !util.EqualDomains(actor, note.ID) {
+		return database.Post{}, fmt.Errorf("%s was not made by %s", note.ID, actor)
+	}
+
+	if board == "" {
+		if board, err = relayBoard(ctx, note); err != nil {
+			return database.Post{}, err
+		}
+	}
+
+	if _, err := DB.FindAPID(ctx, board, note.ID); err == nil {
+		return database.Post{}, ErrDuplicate
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return database.Post{}, err
+	}
+
+	post, err := note.AsPost(ctx, board)
+	if errors.Is(err, ErrNoThread) {
+		// See processBoardActivity.
+		if err := Backfill(ctx, board, note); err != nil {
+			return database.Post{}, err
+		}
+
+		if _, err := DB.FindAPID(ctx, board, note.ID); err == nil {
+			return database.Post{}, ErrDuplicate
+		}
+
+		post, err = note.AsPost(ctx, board)
+	}
+	if err != nil {
+		return database.Post{}, err
+	}
+
+	if err := DB.SavePost(ctx, board, &post); err != nil {
+		return post, err
+	}
+
+	go post.Notify(DB, board)
+	return post, nil
+}
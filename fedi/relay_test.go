@@ -0,0 +1,416 @@
+package fedi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/database"
+)
+
+// relayDB is just enough of a database for relays to work.
+type relayDB struct {
+	database.Database
+
+	mu        sync.Mutex
+	keys      map[string]database.Key
+	relays    map[[2]string]database.Relay
+	posts     []database.Post
+	blocked   map[string]bool
+	following []string
+}
+
+func newRelayDB() *relayDB {
+	return &relayDB{
+		keys:    map[string]database.Key{},
+		relays:  map[[2]string]database.Relay{},
+		blocked: map[string]bool{},
+	}
+}
+
+func (db *relayDB) Key(ctx context.Context, name string) (database.Key, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k, ok := db.keys[name]
+	if !ok {
+		return k, sql.ErrNoRows
+	}
+	return k, nil
+}
+
+func (db *relayDB) SaveKey(ctx context.Context, key database.Key) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.keys[key.Name] = key
+	return nil
+}
+
+func (db *relayDB) Keys(ctx context.Context) ([]database.Key, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keys := []database.Key{}
+	for _, k := range db.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (db *relayDB) Board(ctx context.Context, board string) (database.Board, error) {
+	if board != "prog" {
+		return database.Board{}, sql.ErrNoRows
+	}
+	return database.Board{ID: "prog", Title: "Programming"}, nil
+}
+
+func (db *relayDB) Blocked(ctx context.Context, host string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.blocked[host], nil
+}
+
+func (db *relayDB) Relays(ctx context.Context) ([]database.Relay, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	relays := []database.Relay{}
+	for _, r := range db.relays {
+		relays = append(relays, r)
+	}
+	return relays, nil
+}
+
+func (db *relayDB) Relay(ctx context.Context, board, target string) (database.Relay, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, ok := db.relays[[2]string{board, target}]
+	if !ok {
+		return r, sql.ErrNoRows
+	}
+	return r, nil
+}
+
+func (db *relayDB) SaveRelay(ctx context.Context, relay database.Relay) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.relays[[2]string{relay.Board, relay.Target}] = relay
+	return nil
+}
+
+func (db *relayDB) DeleteRelay(ctx context.Context, board, target string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.relays, [2]string{board, target})
+	return nil
+}
+
+func (db *relayDB) FindAPID(ctx context.Context, board, apid string) (database.Post, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, p := range db.posts {
+		if p.APID == apid {
+			return p, nil
+		}
+	}
+	return database.Post{}, sql.ErrNoRows
+}
+
+func (db *relayDB) SavePost(ctx context.Context, board string, post *database.Post) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	post.ID = database.PostID(len(db.posts) + 1)
+	db.posts = append(db.posts, *post)
+	return nil
+}
+
+func (db *relayDB) Followers(ctx context.Context, board string) ([]string, error) {
+	return nil, nil
+}
+
+func (db *relayDB) Following(ctx context.Context, board string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.following, nil
+}
+
+func (db *relayDB) Replies(ctx context.Context, board string, id database.PostID, reverse bool) ([]database.Post, error) {
+	return nil, nil
+}
+
+// standIn is a stand-in for a relay, which also serves a Mastodon user, a
+// board named prog, and their posts.
+type standIn struct {
+	*httptest.Server
+
+	// Activities delivered to the relay's inbox, after their signatures
+	// were checked.
+	received chan map[string]any
+}
+
+func newStandIn(t *testing.T) *standIn {
+	t.Helper()
+
+	s := &standIn{received: make(chan map[string]any, 8)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%[1]s/actor","type":"Application","inbox":"%[1]s/inbox"}`, s.URL)
+	})
+
+	mux.HandleFunc("/users/alice", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%[1]s/users/alice","type":"Person","name":"Alice","preferredUsername":"alice","inbox":"%[1]s/users/alice/inbox"}`, s.URL)
+	})
+
+	mux.HandleFunc("/users/alice/statuses/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"@context":["https://www.w3.org/ns/activitystreams",{"sensitive":"as:sensitive"}],"id":"%[1]s%[2]s","type":"Note","inReplyTo":null,"attributedTo":"%[1]s/users/alice","to":"%[3]s","content":"<p>hello from <a href=\"https://example.com/x\">elsewhere</a></p>"}`, s.URL, r.URL.Path, Public)
+	})
+
+	mux.HandleFunc("/prog", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%[1]s/prog","type":"Group","name":"prog","inbox":"%[1]s/prog/inbox"}`, s.URL)
+	})
+
+	mux.HandleFunc("/prog/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%[1]s%[2]s","type":"Note","actor":"%[1]s/prog","content":"hello from a board"}`, s.URL, r.URL.Path)
+	})
+
+	mux.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := checkStandInSignature(r, body); err != nil {
+			t.Errorf("bad signature on delivery to relay: %v", err)
+			w.WriteHeader(401)
+			return
+		}
+
+		act := map[string]any{}
+		if err := json.Unmarshal(body, &act); err != nil {
+			t.Error(err)
+		}
+
+		s.received <- act
+		w.WriteHeader(202)
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// checkStandInSignature checks a request signed by one of our actors.
+func checkStandInSignature(r *http.Request, body []byte) error {
+	sig, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+
+	name, err := keyName(strings.TrimSuffix(sig.keyID, "#key"))
+	if err != nil {
+		return err
+	}
+
+	pub, err := PublicKey(name)
+	if err != nil {
+		return err
+	}
+
+	get := func(h string) string {
+		if h == "host" {
+			return r.Host
+		}
+		return r.Header.Get(h)
+	}
+
+	return verifyRequest(sig, pub, r.Method, r.URL.RequestURI(), get, body, requiredHeaders)
+}
+
+func (s *standIn) next(t *testing.T) map[string]any {
+	t.Helper()
+
+	select {
+	case act := <-s.received:
+		return act
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay received nothing")
+		return nil
+	}
+}
+
+func setupRelay(t *testing.T) (*relayDB, *standIn) {
+	t.Helper()
+
+	oldDB, oldLocal := DB, config.AllowLocal
+	t.Cleanup(func() {
+		DB, config.AllowLocal = oldDB, oldLocal
+	})
+
+	db := newRelayDB()
+	DB = db
+	config.AllowLocal = true
+
+	ctx := context.Background()
+	if err := CreateKey(ctx, "prog"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateInstanceKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, newStandIn(t)
+}
+
+func TestRelayFollow(t *testing.T) {
+	db, relay := setupRelay(t)
+	ctx := context.Background()
+	target := relay.URL + "/actor"
+
+	for _, board := range []string{"prog", ""} {
+		if err := RelayFollow(ctx, board, target); err != nil {
+			t.Fatal(err)
+		}
+
+		act := relay.next(t)
+		want := instanceURL()
+		if board != "" {
+			want = boardURL(board)
+		}
+
+		if act["type"] != "Follow" || act["object"] != Public || act["actor"] != want {
+			t.Errorf("relay got %v; want a Follow of Public from %s", act, want)
+		}
+
+		r, err := db.Relay(ctx, board, target)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.State != database.FollowPending {
+			t.Errorf("subscription is %s, want pending", r.State)
+		}
+	}
+
+	if err := RelayUnfollow(ctx, "prog", target); err != nil {
+		t.Fatal(err)
+	}
+
+	act := relay.next(t)
+	if obj, ok := act["object"].(map[string]any); act["type"] != "Undo" || !ok || obj["type"] != "Follow" || obj["object"] != Public {
+		t.Errorf("relay got %v; want an Undo of a Follow", act)
+	}
+
+	if _, err := db.Relay(ctx, "prog", target); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("subscription still exists after unsubscribing")
+	}
+
+	// An inbox isn't an actor, so nothing is sent or saved.
+	if err := RelayFollow(ctx, "prog", relay.URL+"/inbox"); err == nil {
+		t.Errorf("subscribed to an inbox")
+	}
+
+	if _, err := db.Relay(ctx, "prog", relay.URL+"/inbox"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("subscription to an inbox was saved")
+	}
+}
+
+func TestRelayAnnounce(t *testing.T) {
+	db, relay := setupRelay(t)
+	ctx := context.Background()
+	note := relay.URL + "/users/alice/statuses/1"
+
+	post, err := ImportAnnounce(ctx, "prog", note)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if post.APID != note || post.Source != relay.URL+"/users/alice" {
+		t.Errorf("imported post has id %s and source %s", post.APID, post.Source)
+	}
+	if post.Name != "Alice" || post.Raw != "hello from https://example.com/x" {
+		t.Errorf("imported post by %q says %q", post.Name, post.Raw)
+	}
+
+	if _, err := ImportAnnounce(ctx, "prog", note); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("importing twice: got %v, want ErrDuplicate", err)
+	}
+
+	// Announced to the instance, but it's from a person
+	if _, err := ImportAnnounce(ctx, "", relay.URL+"/users/alice/statuses/2"); err == nil {
+		t.Errorf("post with nowhere to go was imported")
+	}
+
+	// From a board named prog, which our prog doesn't follow
+	if _, err := ImportAnnounce(ctx, "", relay.URL+"/prog/A"); err == nil {
+		t.Errorf("post from a board that isn't followed was imported")
+	}
+
+	db.following = []string{relay.URL + "/prog"}
+	if post, err := ImportAnnounce(ctx, "", relay.URL+"/prog/B"); err != nil {
+		t.Errorf("post from a followed board: %v", err)
+	} else if post.Raw != "hello from a board" {
+		t.Errorf("post from a followed board says %q", post.Raw)
+	}
+
+	db.blocked["127.0.0.1"] = true
+	if _, err := ImportAnnounce(ctx, "prog", relay.URL+"/users/alice/statuses/3"); err == nil {
+		t.Errorf("post from a blocked instance was imported")
+	}
+
+	if len(db.posts) != 2 {
+		t.Errorf("%d posts were saved, want 2", len(db.posts))
+	}
+}
+
+func TestRelayPublish(t *testing.T) {
+	db, relay := setupRelay(t)
+	ctx := context.Background()
+	target := relay.URL + "/actor"
+
+	db.SaveRelay(ctx, database.Relay{Board: "prog", Target: target, State: database.FollowAccepted})
+
+	board := database.Board{ID: "prog", Title: "Programming"}
+	post := database.Post{
+		ID:      1,
+		Name:    "Anonymous",
+		Date:    time.Now().UTC(),
+		Raw:     "hello relay",
+		Content: "hello relay",
+		Source:  "127.0.0.1",
+		APID:    boardURL("prog") + "/A0000001",
+	}
+
+	if err := PostOut(ctx, board, post); err != nil {
+		t.Fatal(err)
+	}
+
+	act := relay.next(t)
+	obj, _ := act["object"].(map[string]any)
+	if act["type"] != "Create" || obj == nil || obj["id"] != post.APID {
+		t.Errorf("relay got %v; want a Create of %s", act, post.APID)
+	}
+}
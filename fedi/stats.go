@@ -0,0 +1,294 @@
+package fedi
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/database"
+)
+
+// peerSaveTick is how often stats are saved to the database.
+const peerSaveTick = 5 * time.Minute
+
+// PeerStats is how talking to another instance has been going.
+type PeerStats struct {
+	Host string
+
+	// Requests is how many requests we made to the host, and Failures is how
+	// many of those failed, by status code; see failed.
+	// Requests that never got an answer are counted under 0.
+	Requests int
+	Failures map[int]int
+
+	// LastDelivery is when an activity was last delivered successfully.
+	LastDelivery time.Time
+
+	// Inbound is how many activities the host sent us, and LastInbound is
+	// when the last one arrived.
+	Inbound     int
+	LastInbound time.Time
+
+	latency time.Duration // Total of every request
+}
+
+var (
+	peerStats = map[string]*PeerStats{}
+	statsLock sync.Mutex
+)
+
+// Latency returns how long requests to the host took on average.
+func (p PeerStats) Latency() time.Duration {
+	if p.Requests == 0 {
+		return 0
+	}
+
+	return (p.latency / time.Duration(p.Requests)).Round(time.Millisecond)
+}
+
+// FailureCount returns how many requests to the host failed.
+func (p PeerStats) FailureCount() int {
+	n := 0
+	for _, v := range p.Failures {
+		n += v
+	}
+	return n
+}
+
+// peer returns the stats of host, creating them if needed.
+// statsLock must be held.
+func peer(host string) *PeerStats {
+	p, ok := peerStats[host]
+	if !ok {
+		p = &PeerStats{Host: host, Failures: map[int]int{}}
+		peerStats[host] = p
+	}
+
+	return p
+}
+
+// PeerHost returns the host that stats for id are kept under.
+func PeerHost(id string) string {
+	u, err := url.Parse(id)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// failed reports whether a request that was answered with status failed.
+// Redirects and 304s are normal answers, and so is a 404 from Webfinger, which
+// only means that Finger has to fetch the actor directly.
+func failed(req *http.Request, status int) bool {
+	switch {
+	case status == 0, status >= 500:
+		return true
+	case status >= 400:
+		return status != http.StatusNotFound || req.URL.Path != webfingerPath
+	}
+
+	return false
+}
+
+// do sends a request to another instance and keeps track of how it went.
+func do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := Proxy.Do(req)
+	took := time.Since(start)
+
+	status := 0
+	if err == nil {
+		status = res.StatusCode
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	p := peer(req.URL.Host)
+	p.Requests++
+	p.latency += took
+
+	if failed(req, status) {
+		p.Failures[status]++
+	} else if req.Method == "POST" && status >= 200 && status <= 299 {
+		p.LastDelivery = time.Now()
+	}
+
+	return res, err
+}
+
+// RecordInbound notes that actor sent us an activity.
+func RecordInbound(actor string) {
+	host := PeerHost(actor)
+	if host == "" {
+		return
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	p := peer(host)
+	p.Inbound++
+	p.LastInbound = time.Now()
+}
+
+// Peers returns the stats of every instance we have talked to, sorted by
+// host.
+func Peers() []PeerStats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	peers := make([]PeerStats, 0, len(peerStats))
+	for _, p := range peerStats {
+		c := *p
+		c.Failures = make(map[int]int, len(p.Failures))
+		for k, v := range p.Failures {
+			c.Failures[k] = v
+		}
+
+		peers = append(peers, c)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Host < peers[j].Host
+	})
+
+	return peers
+}
+
+// LoadPeers loads the stats saved by SavePeers.
+// Stats gathered before it is called are replaced.
+func LoadPeers(ctx context.Context) error {
+	peers, err := DB.Peers(ctx)
+	if err != nil {
+		return err
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	for _, p := range peers {
+		peerStats[p.Host] = &PeerStats{
+			Host:         p.Host,
+			Requests:     p.Requests,
+			Failures:     p.Failures,
+			LastDelivery: p.LastDelivery,
+			Inbound:      p.Inbound,
+			LastInbound:  p.LastInbound,
+			latency:      p.Latency,
+		}
+	}
+
+	return nil
+}
+
+// federating returns the hosts of everyone our boards follow or have asked
+// to follow, everyone that follows them, and every relay.
+func federating(ctx context.Context) (map[string]bool, error) {
+	hosts := map[string]bool{}
+
+	boards, err := DB.Boards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, board := range boards {
+		follows, err := DB.FollowRequests(ctx, board.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range follows {
+			hosts[PeerHost(f.Target)] = true
+		}
+
+		followers, err := DB.Followers(ctx, board.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range followers {
+			hosts[PeerHost(f)] = true
+		}
+	}
+
+	relays, err := DB.Relays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range relays {
+		hosts[PeerHost(r.Target)] = true
+	}
+
+	return hosts, nil
+}
+
+// SavePeers saves the stats of every instance we federate with, and forgets
+// the rest, so that instances that only ever talked to us once aren't kept
+// around forever.
+func SavePeers(ctx context.Context) error {
+	keep, err := federating(ctx)
+	if err != nil {
+		return err
+	}
+
+	statsLock.Lock()
+	peers := []database.Peer{}
+	forget := []string{}
+
+	for host, p := range peerStats {
+		if !keep[host] {
+			delete(peerStats, host)
+			forget = append(forget, host)
+			continue
+		}
+
+		failures := make(map[int]int, len(p.Failures))
+		for k, v := range p.Failures {
+			failures[k] = v
+		}
+
+		peers = append(peers, database.Peer{
+			Host:         p.Host,
+			Requests:     p.Requests,
+			Failures:     failures,
+			Latency:      p.latency,
+			LastDelivery: p.LastDelivery,
+			Inbound:      p.Inbound,
+			LastInbound:  p.LastInbound,
+		})
+	}
+	statsLock.Unlock()
+
+	for _, host := range forget {
+		if err := DB.DeletePeer(ctx, host); err != nil {
+			return err
+		}
+	}
+
+	return DB.SavePeers(ctx, peers)
+}
+
+// KeepPeers saves stats every so often, until ctx is done.
+func KeepPeers(ctx context.Context) {
+	t := time.NewTicker(peerSaveTick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := SavePeers(ctx); err != nil {
+			log.Printf("unable to save peer stats: %s", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package fedi
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestFailed(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		failed bool
+	}{
+		{"/users/bob", 0, true},
+		{"/users/bob", 200, false},
+		{"/users/bob/inbox", 202, false},
+		{"/users/bob", 301, false},
+		{"/users/bob", 304, false},
+		{"/users/bob", 401, true},
+		{"/users/bob", 404, true},
+		{"/users/bob", 410, true},
+		{"/users/bob", 500, true},
+		{"/users/bob", 503, true},
+		{webfingerPath, 404, false},
+		{webfingerPath, 403, true},
+		{webfingerPath, 500, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+" "+strconv.Itoa(tt.status), func(t *testing.T) {
+			req, err := http.NewRequest("GET", "https://example.com"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := failed(req, tt.status); got != tt.failed {
+				t.Errorf("failed = %v, want %v", got, tt.failed)
+			}
+		})
+	}
+}
@@ -15,6 +15,7 @@ package fedi
 */
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -23,6 +24,10 @@ import (
 )
 
 var Context = StringList{"https://www.w3.org/ns/activitystreams"}
+
+// Public is the special collection that addresses everyone.
+const Public = "https://www.w3.org/ns/activitystreams#Public"
+
 var DB database.Database
 
 // StringList is a type that takes either a string, or a []string.
@@ -49,8 +54,15 @@ func (s *StringList) UnmarshalJSON(data []byte) error {
 	}
 
 	switch v := value.(type) {
-	case []string:
-		*s = v
+	case []interface{}:
+		// Mastodon puts objects in its @context alongside the strings; those
+		// are skipped.
+		*s = make([]string, 0, len(v))
+		for _, vv := range v {
+			if str, ok := vv.(string); ok {
+				*s = append(*s, str)
+			}
+		}
 	case string:
 		*s = []string{v}
 	default:
@@ -173,6 +185,30 @@ func (l *LinkObject) UnmarshalJSON(data []byte) error {
 	return err
 }
 
+// LinkList is a list of Links or Objects.
+// Most software sends a single item on its own instead of a list with one
+// thing in it, so both are accepted.
+type LinkList []LinkObject
+
+func (l *LinkList) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if len(data) == 0 || string(data) == "null" {
+		*l = nil
+		return nil
+	} else if data[0] == '[' {
+		return json.Unmarshal(data, (*[]LinkObject)(l))
+	}
+
+	var lo LinkObject
+	if err := json.Unmarshal(data, &lo); err != nil {
+		return err
+	}
+
+	*l = LinkList{lo}
+	return nil
+}
+
 // LinkActor is for cases where there may either be a Link or an Actor.
 // Links can be a full Link object, or just a string.
 // Actors must be a full Object.
@@ -226,14 +262,20 @@ type Object struct {
 
 	AttributedTo *LinkObject        `json:"attributedTo,omitempty"`
 	Content      string             `json:"content,omitempty"`
-	InReplyTo    []LinkObject       `json:"inReplyTo,omitempty"`
+	InReplyTo    LinkList           `json:"inReplyTo,omitempty"`
+	MediaType    string             `json:"mediaType,omitempty"`
 	Name         string             `json:"name,omitempty"`
 	Published    *time.Time         `json:"published,omitempty"`
 	Replies      *OrderedCollection `json:"replies,omitempty"`
 	Summary      string             `json:"summary,omitempty"`
-	To           []LinkObject       `json:"to,omitempty"`
+	To           LinkList           `json:"to,omitempty"`
+	Cc           LinkList           `json:"cc,omitempty"`
 	Updated      *time.Time         `json:"updated,omitempty"`
 
+	// Tombstone
+	FormerType string     `json:"formerType,omitempty"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+
 	// Extended attributes for other types
 	Tripcode string     `json:"tripcode,omitempty"`
 	Subject  string     `json:"subject,omitempty"`
@@ -244,10 +286,89 @@ type Object struct {
 	NoCollapse bool `json:"-"`
 }
 
+// Note is a Note as the spec describes it, which is what's given to
+// everything that isn't FChannel.
+// The Notes in Object follow what FChannel expects instead.
+type Note struct {
+	Context StringList `json:"@context,omitempty"`
+
+	ID   string `json:"id"`
+	Type string `json:"type"`
+
+	AttributedTo string      `json:"attributedTo"`
+	Name         string      `json:"name,omitempty"`
+	Content      string      `json:"content"`
+	MediaType    string      `json:"mediaType"`
+	Source       *NoteSource `json:"source,omitempty"`
+	InReplyTo    string      `json:"inReplyTo,omitempty"`
+	Replies      string      `json:"replies"`
+	URL          string      `json:"url,omitempty"`
+	Published    *time.Time  `json:"published,omitempty"`
+	To           []string    `json:"to"`
+	Cc           []string    `json:"cc,omitempty"`
+
+	Tripcode string `json:"tripcode,omitempty"`
+}
+
+// NoteSource is what the content of a Note was made from.
+type NoteSource struct {
+	Content   string `json:"content"`
+	MediaType string `json:"mediaType"`
+}
+
 type Activity struct {
 	*Object
 
 	ObjectProp *Object `json:"object,omitempty"`
+
+	// Objects holds every object of an activity that has several of them,
+	// such as Flag.
+	// ObjectProp is the first of them.
+	Objects []Object `json:"-"`
+}
+
+func (a *Activity) UnmarshalJSON(data []byte) error {
+	// The object of an activity may just be a link to it, which is common for
+	// Accept and Undo.
+	// In that case, ObjectProp only has its ID set.
+	var raw struct {
+		ObjectProp json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	obj := Object{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+
+	a.Object = &obj
+	a.ObjectProp = nil
+	a.Objects = nil
+
+	if len(raw.ObjectProp) == 0 || string(raw.ObjectProp) == "null" {
+		return nil
+	}
+
+	props := LinkList{}
+	if err := json.Unmarshal(raw.ObjectProp, &props); err != nil {
+		return err
+	}
+
+	for _, prop := range props {
+		if prop.Type == "Link" {
+			a.Objects = append(a.Objects, Object{ID: prop.ID})
+		} else {
+			a.Objects = append(a.Objects, Object(prop))
+		}
+	}
+
+	if len(a.Objects) > 0 {
+		a.ObjectProp = &a.Objects[0]
+	}
+
+	return nil
 }
 
 // Collection is a collection of links or objects.
@@ -303,6 +424,15 @@ type Actor struct {
 
 	PreferredUsername string `json:"preferredUsername,omitempty"`
 	Restricted        bool   `json:"restricted"`
+
+	// Endpoints is only read from other actors.
+	Endpoints *endpoints `json:"endpoints,omitempty"`
+}
+
+// endpoints are the extra endpoints of an actor.
+type endpoints struct {
+	// SharedInbox is an inbox for the whole instance an actor is on.
+	SharedInbox string `json:"sharedInbox,omitempty"`
 }
 
 type Outbox struct {
@@ -3,20 +3,90 @@ package fedi
 import (
 	"context"
 	"fmt"
+	"html"
+	"strings"
 
 	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/KushBlazingJudah/feditext/database"
 )
 
+// boardURL returns the ID of a board's actor.
+func boardURL(id string) string {
+	return fmt.Sprintf("%s://%s/%s", config.TransportProtocol, config.FQDN, id)
+}
+
+// keyID returns the ID of a board's public key.
+// The instance's key is used for an empty ID.
+func keyID(id string) string {
+	if id == "" {
+		return instanceURL() + "#key"
+	}
+
+	return boardURL(id) + "#key"
+}
+
+// instanceURL returns the ID of the instance's actor.
+func instanceURL() string {
+	return fmt.Sprintf("%s://%s", config.TransportProtocol, config.FQDN)
+}
+
+// keyName returns the name of the key used to sign for the local actor id.
+func keyName(id string) (string, error) {
+	if id == instanceURL() || id == instanceURL()+"/" {
+		return instanceKey, nil
+	}
+
+	name := strings.TrimPrefix(id, instanceURL()+"/")
+	if name == id || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("%s is not a local actor", id)
+	}
+
+	return name, nil
+}
+
+// InstanceActor returns the Application actor that represents this instance.
+// It signs requests that aren't made on behalf of any one board.
+func InstanceActor() Actor {
+	u := instanceURL()
+
+	var pkey *publicKey
+
+	pubKey, err := PublicKey(instanceKey)
+	if err == nil {
+		pkey = &publicKey{
+			ID:    keyID(""),
+			Owner: u,
+			Pem:   pubKey,
+		}
+	}
+
+	return Actor{
+		Object: &Object{
+			Context: Context,
+			ID:      u,
+			Type:    "Application",
+			Name:    config.FQDN,
+
+			Summary: config.Title,
+		},
+
+		Inbox:             u + "/inbox",
+		Outbox:            u + "/outbox",
+		PreferredUsername: config.FQDN,
+
+		PublicKey: pkey,
+	}
+}
+
 func TransformBoard(board database.Board) Actor {
-	u := fmt.Sprintf("%s://%s/%s", config.TransportProtocol, config.FQDN, board.ID)
+	u := boardURL(board.ID)
 
 	var pkey *publicKey
 
 	pubKey, err := PublicKey(board.ID)
 	if err == nil {
 		pkey = &publicKey{
-			ID:    u + "#key",
+			ID:    keyID(board.ID),
 			Owner: u,
 			Pem:   pubKey,
 		}
@@ -29,6 +99,9 @@ func TransformBoard(board database.Board) Actor {
 			Name: board.ID,
 
 			Summary: board.Description,
+
+			// Point to the instance actor.
+			AttributedTo: &LinkObject{Type: "Link", ID: instanceURL()},
 		},
 
 		Inbox:             u + "/inbox",
@@ -178,3 +251,68 @@ func TransformPost(ctx context.Context, actor *Actor, p database.Post, irt Objec
 
 	return n, nil
 }
+
+// RepliesURL returns the ID of the collection of replies to a post.
+func RepliesURL(board string, p database.Post) string {
+	if p.IsLocal() && p.APID != "" {
+		return p.APID + "/replies"
+	}
+
+	return fmt.Sprintf("%s/%d/replies", boardURL(board), p.ID)
+}
+
+// TransformNote converts a post into a Note that follows the spec.
+// thread is the thread the post is in, if it is a reply.
+func TransformNote(actor *Actor, p database.Post, thread *database.Post) Note {
+	attTo := actor.ID
+	if !p.IsLocal() {
+		attTo = p.Source
+	}
+
+	// Links in the formatted post are relative, so build it again.
+	content := "<p>" + strings.ReplaceAll(html.EscapeString(p.Raw), "\n", "<br>") + "</p>"
+
+	n := Note{
+		Context: Context,
+
+		ID:   p.APID,
+		Type: "Note",
+
+		AttributedTo: attTo,
+		Name:         p.Subject,
+		Content:      content,
+		MediaType:    "text/html",
+		Source:       &NoteSource{Content: p.Raw, MediaType: "text/plain"},
+		Replies:      RepliesURL(actor.Name, p),
+		Published:    &p.Date,
+		To:           []string{Public},
+		Cc:           []string{actor.Followers},
+
+		Tripcode: p.Tripcode,
+	}
+
+	if p.IsLocal() {
+		if thread != nil {
+			n.URL = fmt.Sprintf("%s/%d#p%d", actor.ID, thread.ID, p.ID)
+		} else {
+			n.URL = fmt.Sprintf("%s/%d", actor.ID, p.ID)
+		}
+	}
+
+	if thread != nil {
+		n.InReplyTo = thread.APID
+	}
+
+	return n
+}
+
+// TransformTombstone converts what remains of a deleted post into a Tombstone.
+func TransformTombstone(t database.Tombstone) Object {
+	return Object{
+		Context:    Context,
+		ID:         t.APID,
+		Type:       "Tombstone",
+		FormerType: "Note",
+		Deleted:    &t.Date,
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/valyala/fasthttp v1.44.0
+	golang.org/x/crypto v0.5.0
 	golang.org/x/image v0.5.0
 )
 
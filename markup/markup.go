@@ -0,0 +1,321 @@
+// Package markup turns the raw text of posts into HTML.
+//
+// The following is understood:
+//
+//	>greentext                  the rest of the line is quoted
+//	>>123                       cites, which are left to the caller to find
+//	[code]...[/code]            a block of code, kept exactly as written
+//	`code`                      code inside of a line
+//	[spoiler]...[/spoiler]      hidden until hovered over
+//	[b]...[/b], **...**         bold
+//	[i]...[/i], *...*           italic
+//	https://example.com         links
+//
+// Everything else is escaped, and markup that is never closed is left as it
+// was written.
+package markup
+
+import (
+	"html"
+	"strings"
+)
+
+// CiteFunc finds a cite at the start of s, which always starts with ">>".
+// It returns the HTML to put in its place and how many bytes of s it spans,
+// or 0 if s doesn't start with a cite.
+type CiteFunc func(s string) (string, int)
+
+// tag is markup that wraps other markup.
+type tag struct {
+	name       string
+	open, shut string // Written form
+	html       string // Opening HTML tag; the closing one is derived from it
+}
+
+var tags = []tag{
+	{"spoiler", "[spoiler]", "[/spoiler]", `<span class="spoiler">`},
+	{"b", "[b]", "[/b]", `<b>`},
+	{"i", "[i]", "[/i]", `<i>`},
+}
+
+// element is a tag that was opened and not closed yet.
+type element struct {
+	name  string
+	html  string
+	piece int // Index of the opening tag in renderer.out
+}
+
+type renderer struct {
+	src  string
+	cite CiteFunc
+
+	// out is the HTML so far, in pieces, so that the opening of an element
+	// can be turned into HTML once it is known that it was closed.
+	// Until then, it is the escaped text it was written as.
+	out   []string
+	stack []element
+}
+
+// Render turns src into HTML.
+// cite is called to find cites, and may be nil.
+func Render(src string, cite CiteFunc) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	r := &renderer{src: src, cite: cite}
+	r.render()
+	return strings.Join(r.out, "")
+}
+
+func (r *renderer) text(s string) {
+	r.out = append(r.out, html.EscapeString(s))
+}
+
+func (r *renderer) raw(s string) {
+	r.out = append(r.out, s)
+}
+
+// open starts an element, which stays as text until it is closed.
+func (r *renderer) open(name, written, tag string) {
+	r.stack = append(r.stack, element{name: name, html: tag, piece: len(r.out)})
+	r.text(written)
+}
+
+// find returns where the innermost open element with name is in the stack,
+// or -1 if there isn't one.
+// Quotes end with their line, so nothing opened before one can be closed
+// inside of it.
+func (r *renderer) find(name string) int {
+	for i := len(r.stack) - 1; i >= 0; i-- {
+		if r.stack[i].name == name {
+			return i
+		} else if r.stack[i].name == "quote" {
+			break
+		}
+	}
+
+	return -1
+}
+
+// close closes the innermost element with name, if there is one.
+// Elements opened inside of it that weren't closed stay as text.
+func (r *renderer) close(name string) bool {
+	i := r.find(name)
+	if i == -1 {
+		return false
+	}
+
+	e := r.stack[i]
+	r.out[e.piece] = e.html
+	r.raw(closing(e.html))
+	r.stack = r.stack[:i]
+	return true
+}
+
+// closing returns the closing tag for an opening one.
+func closing(tag string) string {
+	name := strings.TrimPrefix(tag, "<")
+	if i := strings.IndexAny(name, " >"); i != -1 {
+		name = name[:i]
+	}
+	return "</" + name + ">"
+}
+
+func (r *renderer) render() {
+	s := r.src
+	start := 0 // Start of text that hasn't been written yet
+	lineStart := true
+
+	flush := func(i int) {
+		if i > start {
+			r.text(s[start:i])
+		}
+	}
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		if lineStart {
+			lineStart = false
+
+			// Greentext, unless it's a cite
+			if n := r.tryCite(i, flush); n > 0 {
+				i += n
+				start = i
+				continue
+			} else if rest[0] == '>' && len(rest) > 1 && rest[1] != '\n' {
+				flush(i)
+				r.stack = append(r.stack, element{name: "quote", html: `<span class="quote">`, piece: len(r.out)})
+				r.raw(`<span class="quote">`)
+				start = i
+			}
+		}
+
+		switch {
+		case rest[0] == '\n':
+			flush(i)
+			r.close("quote")
+			r.raw("<br/>")
+			i++
+			start = i
+			lineStart = true
+			continue
+		case strings.HasPrefix(rest, ">>"):
+			if n := r.tryCite(i, flush); n > 0 {
+				i += n
+				start = i
+				continue
+			}
+		case strings.HasPrefix(rest, "[code]"):
+			if end := strings.Index(rest, "[/code]"); end != -1 {
+				flush(i)
+				code := rest[len("[code]"):end]
+				code = strings.TrimPrefix(code, "\n")
+				code = strings.TrimSuffix(code, "\n")
+				r.raw(`<pre class="code"><code>` + html.EscapeString(code) + `</code></pre>`)
+
+				i += end + len("[/code]")
+				if strings.HasPrefix(s[i:], "\n") {
+					// The block already ends the line
+					i++
+					r.close("quote")
+					lineStart = true
+				}
+				start = i
+				continue
+			}
+		case rest[0] == '`':
+			if end := strings.IndexAny(rest[1:], "`\n"); end > 0 && rest[1+end] == '`' {
+				flush(i)
+				r.raw("<code>" + html.EscapeString(rest[1:1+end]) + "</code>")
+				i += end + 2
+				start = i
+				continue
+			}
+		case rest[0] == '[':
+			if n := r.bracket(i, flush); n > 0 {
+				i += n
+				start = i
+				continue
+			}
+		case rest[0] == '*':
+			if n := r.star(i, flush); n > 0 {
+				i += n
+				start = i
+				continue
+			}
+		case strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://"):
+			if n := linkLength(rest); n > 0 {
+				flush(i)
+				u := html.EscapeString(rest[:n])
+				r.raw(`<a href="` + u + `" rel="nofollow noreferrer" class="external">` + u + `</a>`)
+				i += n
+				start = i
+				continue
+			}
+		}
+
+		i++
+	}
+
+	flush(len(s))
+	r.close("quote")
+}
+
+// tryCite handles a cite at i, and returns how many bytes it spans.
+func (r *renderer) tryCite(i int, flush func(int)) int {
+	rest := r.src[i:]
+	if r.cite == nil || !strings.HasPrefix(rest, ">>") {
+		return 0
+	}
+
+	h, n := r.cite(rest)
+	if n > 0 {
+		flush(i)
+		r.raw(h)
+	}
+
+	return n
+}
+
+// bracket handles BBCode-style tags at i, and returns how many bytes they
+// span.
+func (r *renderer) bracket(i int, flush func(int)) int {
+	rest := r.src[i:]
+
+	for _, t := range tags {
+		if strings.HasPrefix(rest, t.open) {
+			flush(i)
+			r.open(t.name, t.open, t.html)
+			return len(t.open)
+		} else if strings.HasPrefix(rest, t.shut) {
+			flush(i)
+			if !r.close(t.name) {
+				r.text(t.shut)
+			}
+			return len(t.shut)
+		}
+	}
+
+	return 0
+}
+
+// star handles **bold** and *italic* at i, and returns how many bytes it
+// spans.
+// Stars only open at the start of a word and close at the end of one, so that
+// things like 2*3*4 are left alone.
+func (r *renderer) star(i int, flush func(int)) int {
+	s := r.src
+
+	n, name, tag := 1, "*", "<i>"
+	if strings.HasPrefix(s[i:], "**") {
+		n, name, tag = 2, "**", "<b>"
+	}
+
+	before, after := byte(' '), byte(' ')
+	if i > 0 {
+		before = s[i-1]
+	}
+	if i+n < len(s) {
+		after = s[i+n]
+	}
+
+	if r.find(name) != -1 && !isSpace(before) && !isWord(after) {
+		flush(i)
+		r.close(name)
+		return n
+	} else if !isWord(before) && !isSpace(after) && after != '*' {
+		flush(i)
+		r.open(name, name, tag)
+		return n
+	}
+
+	return 0
+}
+
+// linkLength returns how long the link at the start of s is.
+// Punctuation at the end is left out, as it's most likely part of the
+// sentence.
+func linkLength(s string) int {
+	n := strings.IndexAny(s, " \t\n<>\"'`[]")
+	if n == -1 {
+		n = len(s)
+	}
+
+	for n > 0 && strings.IndexByte(".,;:!?)", s[n-1]) != -1 {
+		n--
+	}
+
+	if n <= strings.Index(s, "://")+3 {
+		// Nothing after the scheme
+		return 0
+	}
+
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isWord(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
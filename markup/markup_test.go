@@ -0,0 +1,142 @@
+package markup
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testCiteRegex = regexp.MustCompile(`^>>(\d+)`)
+
+// testCite understands >>number and nothing else.
+func testCite(s string) (string, int) {
+	m := testCiteRegex.FindStringSubmatch(s)
+	if m == nil {
+		return "", 0
+	}
+
+	return `<a href="#p` + m[1] + `" class="cite">&gt;&gt;` + m[1] + `</a>`, len(m[0])
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"newlines", "a\nb\r\nc", "a<br/>b<br/>c"},
+		{"greentext", ">implying\nno", `<span class="quote">&gt;implying</span><br/>no`},
+		{"lone arrow", ">\n>", "&gt;<br/>&gt;"},
+		{"cite", ">>12 is right", `<a href="#p12" class="cite">&gt;&gt;12</a> is right`},
+		{"cite in greentext", ">what >>12", `<span class="quote">&gt;what <a href="#p12" class="cite">&gt;&gt;12</a></span>`},
+		{"not a cite", ">>nope", `<span class="quote">&gt;&gt;nope</span>`},
+		{"code", "[code]\nint main() {\n\treturn 0;\n}\n[/code]\nafter",
+			"<pre class=\"code\"><code>int main() {\n\treturn 0;\n}</code></pre>after"},
+		{"code keeps markup", "[code]>>12 **no** [b]x[/b][/code]",
+			`<pre class="code"><code>&gt;&gt;12 **no** [b]x[/b]</code></pre>`},
+		{"unclosed code", "[code]x", "[code]x"},
+		{"inline code", "use `a < b` here", "use <code>a &lt; b</code> here"},
+		{"inline code across lines", "`a\nb`", "`a<br/>b`"},
+		{"spoiler", "[spoiler]it was him[/spoiler]", `<span class="spoiler">it was him</span>`},
+		{"spoiler across lines", "[spoiler]a\nb[/spoiler]", `<span class="spoiler">a<br/>b</span>`},
+		{"unclosed spoiler", "[spoiler]a", "[spoiler]a"},
+		{"stray close", "a[/b]", "a[/b]"},
+		{"bbcode", "[b]bold[/b] [i]italic[/i]", "<b>bold</b> <i>italic</i>"},
+		{"nesting", "[b][i]x[/i][/b]", "<b><i>x</i></b>"},
+		{"misnested", "[b]x[i]y[/b]z[/i]", "<b>x[i]y</b>z[/i]"},
+		{"stars", "**bold** and *italic*", "<b>bold</b> and <i>italic</i>"},
+		{"math", "2*3*4 and a * b", "2*3*4 and a * b"},
+		{"unclosed star", "*a", "*a"},
+		{"spoiler in greentext", ">[spoiler]a\nb[/spoiler]", `<span class="quote">&gt;[spoiler]a</span><br/>b[/spoiler]`},
+		{"close across greentext", "[spoiler]a\n>b[/spoiler]\nc[/spoiler]",
+			`<span class="spoiler">a<br/><span class="quote">&gt;b[/spoiler]</span><br/>c</span>`},
+		{"link", "see https://example.com/a?b=c&d=e.",
+			`see <a href="https://example.com/a?b=c&amp;d=e" rel="nofollow noreferrer" class="external">https://example.com/a?b=c&amp;d=e</a>.`},
+		{"link in tag", "[b]http://example.com[/b]",
+			`<b><a href="http://example.com" rel="nofollow noreferrer" class="external">http://example.com</a></b>`},
+		{"no host", "https://", "https://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := Render(tt.in, testCite); out != tt.out {
+				t.Errorf("Render(%q):\ngot  %s\nwant %s", tt.in, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestRenderXSS(t *testing.T) {
+	tests := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[code]</code></pre><script>alert(1)</script>[/code]`,
+		"`<script>alert(1)</script>`",
+		`[spoiler]<script>alert(1)</script>[/spoiler]`,
+		`[b]<img src=x onerror=alert(1)>`,
+		`https://example.com/"><script>alert(1)</script>`,
+		`https://example.com/'onmouseover='alert(1)`,
+		`https://example.com/<script>`,
+		`javascript:alert(1)`,
+		`>>12"><script>alert(1)</script>`,
+		`>[i]<script>alert(1)</script>`,
+		`*<script>alert(1)</script>*`,
+	}
+
+	// Every tag in the output has to be one of these, and a link's address
+	// can't break out of its attribute.
+	allowed := regexp.MustCompile(`^(<br/>|</?(b|i|code)>|<pre class="code">|</pre>|<span class="(quote|spoiler)">|</span>|<a href="#p\d+" class="cite">|<a href="https?://[^"<>' ]+" rel="nofollow noreferrer" class="external">|</a>)$`)
+	tagRegex := regexp.MustCompile(`<[^>]*>?`)
+
+	for _, in := range tests {
+		out := Render(in, testCite)
+
+		for _, tag := range tagRegex.FindAllString(out, -1) {
+			if !allowed.MatchString(tag) {
+				t.Errorf("Render(%q) = %s, which has %s in it", in, out, tag)
+			}
+		}
+
+		if strings.Contains(out, `href="javascript`) {
+			t.Errorf("Render(%q) = %s, which links to javascript", in, out)
+		}
+	}
+}
+
+func TestRenderWellFormed(t *testing.T) {
+	// Whatever goes in, every tag that is opened must be closed in order.
+	inputs := []string{
+		"[b][i][spoiler]x",
+		"[b]a\n>b[/b]\n[/i]",
+		"**a *b** c*",
+		"[spoiler]**a[/spoiler]**",
+		">*a\nb*",
+		"[i][code]x[/code][/i]",
+		"`[b]`[/b]",
+	}
+
+	tagRegex := regexp.MustCompile(`</?([a-z]+)[^>]*>`)
+
+	for _, in := range inputs {
+		out := Render(in, testCite)
+
+		stack := []string{}
+		for _, m := range tagRegex.FindAllStringSubmatch(out, -1) {
+			if m[1] == "br" {
+				continue
+			}
+
+			if !strings.HasPrefix(m[0], "</") {
+				stack = append(stack, m[1])
+			} else if len(stack) == 0 || stack[len(stack)-1] != m[1] {
+				t.Errorf("Render(%q) = %s, which closes %s out of order", in, out, m[1])
+				break
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		}
+
+		if len(stack) != 0 {
+			t.Errorf("Render(%q) = %s, which leaves %v open", in, out, stack)
+		}
+	}
+}
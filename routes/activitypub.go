@@ -1,14 +1,12 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -32,7 +30,7 @@ type link struct {
 
 type webfingerResp struct {
 	Subject string `json:"subject"`
-	Links   []link
+	Links   []link `json:"links"`
 }
 
 func Webfinger(c *fiber.Ctx) error {
@@ -54,6 +52,18 @@ func Webfinger(c *fiber.Ctx) error {
 		return errjsonc(c, 404, "not found")
 	}
 
+	if toks[0] == config.FQDN {
+		// The instance actor
+		return c.JSON(webfingerResp{
+			Subject: fmt.Sprintf("acct:%s@%s", config.FQDN, config.FQDN),
+			Links: []link{{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: fmt.Sprintf("%s://%s", config.TransportProtocol, config.FQDN),
+			}},
+		})
+	}
+
 	if board, err := DB.Board(c.Context(), toks[0]); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return errjsonc(c, 404, "not found")
@@ -62,7 +72,7 @@ func Webfinger(c *fiber.Ctx) error {
 		return errjson(c, err)
 	} else {
 		return c.JSON(webfingerResp{
-			Subject: fmt.Sprintf("acct:/%s@%s", board.ID, config.FQDN),
+			Subject: fmt.Sprintf("acct:%s@%s", board.ID, config.FQDN),
 			Links: []link{{
 				Rel:  "self",
 				Type: "application/activity+json",
@@ -72,37 +82,28 @@ func Webfinger(c *fiber.Ctx) error {
 	}
 }
 
+// PostBoardInbox receives activities sent to a board.
+// They are processed later by processBoardActivity; see receive.
 func PostBoardInbox(c *fiber.Ctx) error {
 	board, err := board(c)
 	if err != nil {
 		return errjson(c, err)
 	}
 
-	act := fedi.Activity{}
-	if err := json.Unmarshal(c.Body(), &act); err != nil {
-		return errjson(c, err)
-	}
-
-	if act.Actor == nil || act.Actor.ID == "" || act.Object == nil {
-		return errjsonc(c, 400, "missing attributes")
-	}
-
-	log.Printf("received activity from %s: %s", c.IP(), string(c.Body()))
-
-	// Another sanity check
-	if err := fedi.CheckHeaders(c, act.Actor.ID); err != nil {
-		return errjson(c, err)
-	}
+	return receive(c, board.ID)
+}
 
+// processBoardActivity does what an activity sent to a board asks for.
+func processBoardActivity(ctx context.Context, board database.Board, act fedi.Activity) error {
 	if act.Type == "Follow" {
 		if act.ObjectProp == nil {
-			return errjsonc(c, 400, "need target")
+			return errors.New("need target")
 		}
 
 		// Accept it
-		// TODO: Blacklist
-		if err := DB.AddFollow(c.Context(), act.Actor.ID, board.ID); err != nil {
-			return errjson(c, err)
+		added, err := DB.AddFollow(ctx, act.Actor.ID, board.ID)
+		if err != nil {
+			return err
 		}
 
 		log.Printf("Accepted follow from %s to board %s", act.Actor.ID, board.ID)
@@ -111,38 +112,58 @@ func PostBoardInbox(c *fiber.Ctx) error {
 			Actor: &fedi.LinkActor{Object: &fedi.Object{Type: "Group", ID: act.Actor.ID}},
 			Type:  "Follow",
 		}
-		accept, err := fedi.GenerateAccept(c.Context(), board, act.Actor.ID, obj)
+		accept, err := fedi.GenerateAccept(ctx, board, act.Actor.ID, obj)
 		if err != nil {
-			return errjson(c, err)
+			return err
 		}
 
-		if err := fedi.SendActivity(c.Context(), accept); err != nil {
-			return errjson(c, err)
+		if err := fedi.SendActivity(ctx, accept); err != nil {
+			return err
+		}
+
+		if board.Push > 0 && added {
+			// This takes a while, so don't hold up everything else they
+			// send.
+			go func(follower string) {
+				if err := fedi.PushThreads(context.Background(), board, follower); err != nil {
+					log.Printf("unable to push threads of %s to %s: %s", board.ID, follower, err)
+				}
+			}(act.Actor.ID)
 		}
 	} else if act.Type == "Create" {
 		// TODO: Redo this.
 
-		if act.Object == nil || act.To == nil || act.ObjectProp == nil {
-			return errjsonc(c, 400, "missing needed attributes")
+		if act.Object == nil || act.ObjectProp == nil {
+			return errors.New("missing needed attributes")
 		}
 
 		// Do a quick sanity check
 		if !util.EqualDomains(act.Actor.ID, act.ObjectProp.ID) {
 			// TODO: Reject
-			return errjsonc(c, 400, "rejecting; may be spoofed")
+			return errors.New("rejecting; may be spoofed")
 		}
 
-		// Check what board it should go to
+		if act.ObjectProp.Actor == nil {
+			// Only FChannel and us put the actor on the Note itself.
+			act.ObjectProp.Actor = act.Actor
+		}
+
+		// Check what board it should go to.
+		// Mastodon and friends put who they mention in cc, and if nobody
+		// seems to be us, it goes to the board whose inbox this is.
 		// TODO: Improve upon this. It kinda sucks.
-		var board database.Board
+		inbox := board
+		board = database.Board{}
 		start := fmt.Sprintf("%s://%s/", config.TransportProtocol, config.FQDN)
-		for _, t := range act.To {
+		for _, t := range append(act.To, act.Cc...) {
 			if strings.HasPrefix(t.ID, start) {
 				// That's us!
 				var err error
-				board, err = DB.Board(c.Context(), t.ID[len(start):])
-				if err != nil {
-					return errjson(c, err)
+				board, err = DB.Board(ctx, t.ID[len(start):])
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				} else if err != nil {
+					return err
 				}
 
 				break
@@ -150,26 +171,74 @@ func PostBoardInbox(c *fiber.Ctx) error {
 		}
 
 		if board.ID == "" {
-			return errjsonc(c, 404, "not found")
+			board = inbox
 		}
 
 		// This does some checking to ensure that the thread exists if it's in reply to one.
-		// We don't care about threads we don't know about.
-		post, err := act.ObjectProp.AsPost(c.Context(), board.ID)
+		post, err := act.ObjectProp.AsPost(ctx, board.ID)
+		if errors.Is(err, fedi.ErrNoThread) {
+			// We don't have the thread, so go get it.
+			if err := fedi.Backfill(ctx, board.ID, *act.ObjectProp); err != nil {
+				log.Printf("unable to backfill thread for %s: %s", act.ObjectProp.ID, err)
+				return errors.New("thread not found")
+			}
+
+			// The thread we just got may have had this post in it already.
+			if _, err := DB.FindAPID(ctx, board.ID, act.ObjectProp.ID); err == nil {
+				return nil
+			}
+
+			post, err = act.ObjectProp.AsPost(ctx, board.ID)
+		}
 		if err != nil {
-			return errjson(c, err)
+			return err
 		}
 
-		if err := DB.SavePost(c.Context(), board.ID, &post); err != nil {
-			return errjson(c, err)
+		if err := DB.SavePost(ctx, board.ID, &post); err != nil {
+			return err
 		}
 
 		go post.Notify(DB, board.ID)
+	} else if act.Type == "Flag" {
+		// A report from another instance.
+		// The objects may be anything, but we only care about our posts.
+		reason := util.Trim(act.Content, config.ReportCutoff)
+		filed := 0
+
+		for _, obj := range act.Objects {
+			post, err := DB.FindAPID(ctx, board.ID, obj.ID)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			rep := database.Report{
+				Source: act.Actor.ID,
+				Board:  board.ID,
+				Post:   post.ID,
+				Reason: reason,
+				Date:   time.Now().UTC(),
+			}
+
+			if err := DB.FileReport(ctx, rep); err != nil {
+				return err
+			}
+
+			go rep.Notify(DB)
+			filed++
+		}
+
+		if filed == 0 {
+			return errors.New("not found")
+		}
+
+		log.Printf("Received a report from %s on %d posts on board %s", act.Actor.ID, filed, board.ID)
 	} else if act.Type == "Delete" {
 		// TODO: Redo this.
 
 		if act.Object == nil || act.Actor == nil || act.To == nil || act.ObjectProp == nil || act.ObjectProp.ID == "" {
-			return errjsonc(c, 400, "missing needed attributes")
+			return errors.New("missing needed attributes")
 		}
 
 		// Check what board it should go to
@@ -179,9 +248,9 @@ func PostBoardInbox(c *fiber.Ctx) error {
 		for _, t := range act.To {
 			if strings.HasPrefix(t.ID, start) {
 				// That's us!
-				board, err := DB.Board(c.Context(), t.ID[len(start):])
+				board, err := DB.Board(ctx, t.ID[len(start):])
 				if err != nil {
-					return errjson(c, err)
+					return err
 				}
 
 				boards = append(boards, board)
@@ -189,49 +258,271 @@ func PostBoardInbox(c *fiber.Ctx) error {
 		}
 
 		if len(boards) == 0 {
-			return errjsonc(c, 404, "not found")
+			return errors.New("not found")
+		}
+
+		deleted := 0
+		for _, b := range boards {
+			// Check if the post exists in our database.
+			post, err := DB.FindAPID(ctx, b.ID, act.ObjectProp.ID)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if !util.EqualDomains(post.APID, act.Actor.ID) {
+				// TODO: Reject
+				return errors.New("attempted to delete object that you don't own")
+			}
+
+			// Delete it
+			action := database.ModerationAction{
+				Author: act.Actor.ID,
+				Type:   database.ModActionDelete,
+				Board:  b.ID,
+				Post:   post.ID,
+				Reason: "Externally deleted.",
+				Date:   time.Now().UTC(),
+			}
+
+			if post.Thread == 0 {
+				err = DB.DeleteThread(ctx, b.ID, post.ID, action)
+			} else {
+				err = DB.DeletePost(ctx, b.ID, post.ID, action)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			deleted++
+		}
+
+		if deleted == 0 {
+			return errors.New("not found")
+		}
+	} else if act.Type == "Update" {
+		if act.ObjectProp == nil || act.ObjectProp.ID == "" {
+			return errors.New("missing needed attributes")
+		}
+
+		if act.ObjectProp.ID == act.Actor.ID {
+			// An actor updating itself, probably because it has a new key.
+			fedi.Forget(act.Actor.ID)
+			return nil
+		}
+
+		if act.ObjectProp.Type != "Note" {
+			log.Printf("%s sent Update for unknown type %s", act.Actor.ID, act.ObjectProp.Type)
+			return nil
 		}
 
-		// Check if the post exists in our database.
-		post, err := DB.FindAPID(c.Context(), board.ID, act.ObjectProp.ID)
+		// Only the instance a post came from may edit it.
+		if !util.EqualDomains(act.Actor.ID, act.ObjectProp.ID) {
+			return errors.New("attempted to update object that you don't own")
+		}
+
+		post, err := DB.FindAPID(ctx, board.ID, act.ObjectProp.ID)
 		if err != nil {
-			return errjson(c, err)
+			return err
 		}
 
 		if !util.EqualDomains(post.APID, act.Actor.ID) {
-			// TODO: Reject
-			return errjsonc(c, 403, "attempted to delete object that you don't own")
+			return errors.New("attempted to update object that you don't own")
+		}
+
+		if act.ObjectProp.Actor == nil {
+			// See Create.
+			act.ObjectProp.Actor = act.Actor
+		}
+
+		post.Subject = act.ObjectProp.Name
+		post.Raw = act.ObjectProp.Text()
+
+		if err := DB.EditPost(ctx, board.ID, &post, act.Actor.ID); err != nil {
+			return err
+		}
+	} else if act.Type == "Accept" || act.Type == "Reject" {
+		if ok, err := relayReply(ctx, board.ID, act); ok {
+			return err
 		}
 
-		// Delete it
-		action := database.ModerationAction{
-			Author: act.Actor.ID,
-			Type:   database.ModActionDelete,
-			Board:  board.ID,
-			Post:   post.ID,
-			Reason: "Externally deleted.",
-			Date:   time.Now().UTC(),
+		if act.ObjectProp == nil {
+			return errors.New("need object")
 		}
 
-		if post.Thread == 0 {
-			fmt.Println("delete thread")
-			err = DB.DeleteThread(c.Context(), board.ID, post.ID, action)
-		} else {
-			err = DB.DeletePost(c.Context(), board.ID, post.ID, action)
+		// Our follows don't have IDs, so the best we can do is check that it
+		// is in fact about a follow and that it was sent to us.
+		if act.ObjectProp.Type != "" && act.ObjectProp.Type != "Follow" {
+			log.Printf("%s sent %s for unknown type %s", act.Actor.ID, act.Type, act.ObjectProp.Type)
+			return nil
+		} else if act.ObjectProp.Actor != nil && act.ObjectProp.Actor.Object != nil && act.ObjectProp.Actor.ID != fedi.TransformBoard(board).ID {
+			return errors.New("follow was not sent by this board")
 		}
 
+		follows, err := DB.FollowRequests(ctx, board.ID)
 		if err != nil {
-			return errjson(c, err)
-		} else {
-			return c.SendStatus(200)
+			return err
+		}
+
+		found := false
+		for _, f := range follows {
+			if f.Target == act.Actor.ID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return errors.New("no follow request for this actor")
+		}
+
+		state := database.FollowAccepted
+		if act.Type == "Reject" {
+			state = database.FollowRejected
+		}
+
+		if err := DB.AddFollowing(ctx, board.ID, act.Actor.ID, state); err != nil {
+			return err
 		}
-	} else { // TODO: FChannel doesn't send back an accept, so assume it's fine?
-		log.Printf("%s sent unknown activity type %s", c.IP(), act.Type)
 
-		_, err = os.Stdout.Write(c.Body())
+		log.Printf("Follow from board %s to %s is now %s", board.ID, act.Actor.ID, state)
+	} else if act.Type == "Undo" {
+		if act.ObjectProp == nil {
+			return errors.New("need object")
+		}
+
+		// We only keep track of follows, so nothing else can be undone.
+		// Some send only a link to what they undo; we don't keep the IDs of
+		// follows, but from a follower it can only be their follow.
+		if act.ObjectProp.Type == "" {
+			followers, err := DB.Followers(ctx, board.ID)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for _, f := range followers {
+				if f == act.Actor.ID {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				log.Printf("%s sent Undo for unknown object %s", act.Actor.ID, act.ObjectProp.ID)
+				return nil
+			}
+		} else if act.ObjectProp.Type != "Follow" {
+			log.Printf("%s sent Undo for unknown type %s", act.Actor.ID, act.ObjectProp.Type)
+			return nil
+		}
+
+		if err := DB.DeleteFollow(ctx, act.Actor.ID, board.ID); err != nil {
+			return err
+		}
+
+		log.Printf("%s unfollowed board %s", act.Actor.ID, board.ID)
+	} else if act.Type == "Announce" {
+		return relayAnnounce(ctx, board.ID, act)
+	} else {
+		log.Printf("%s sent unknown activity type %s", act.Actor.ID, act.Type)
+	}
+
+	return nil
+}
+
+// relayReply handles an Accept or Reject from a relay that board, or the
+// instance if it is empty, subscribed to.
+// It returns false if act didn't come from one.
+func relayReply(ctx context.Context, board string, act fedi.Activity) (bool, error) {
+	relay, err := DB.Relay(ctx, board, act.Actor.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+
+	relay.State = database.FollowAccepted
+	if act.Type == "Reject" {
+		relay.State = database.FollowRejected
+	}
+
+	if err := DB.SaveRelay(ctx, relay); err != nil {
+		return true, err
+	}
+
+	log.Printf("Subscription of %q to relay %s is now %s", board, act.Actor.ID, relay.State)
+	return true, nil
+}
+
+// relayAnnounce imports a post announced by a relay that board, or the
+// instance if it is empty, subscribed to.
+func relayAnnounce(ctx context.Context, board string, act fedi.Activity) error {
+	relay, err := DB.Relay(ctx, board, act.Actor.ID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && relay.State != database.FollowAccepted) {
+		return errors.New("not subscribed")
+	} else if err != nil {
+		return err
+	}
+
+	if act.ObjectProp == nil || act.ObjectProp.ID == "" {
+		return errors.New("need object")
+	}
+
+	post, err := fedi.ImportAnnounce(ctx, board, act.ObjectProp.ID)
+	if errors.Is(err, fedi.ErrDuplicate) {
+		return nil
+	} else if err != nil {
+		log.Printf("unable to import %s announced by %s: %s", act.ObjectProp.ID, act.Actor.ID, err)
+		return err
+	}
+
+	if config.Debug {
+		log.Printf("imported %s from relay %s", post.APID, act.Actor.ID)
 	}
 
-	return err
+	return nil
+}
+
+// PostInstanceInbox receives activities sent to the instance actor.
+// They are processed later by processInstanceActivity; see receive.
+func PostInstanceInbox(c *fiber.Ctx) error {
+	return receive(c, "")
+}
+
+// processInstanceActivity does what an activity sent to the instance actor
+// asks for.
+// Only actors announcing changes to themselves, and relays, are understood so
+// far.
+func processInstanceActivity(ctx context.Context, act fedi.Activity) error {
+	if act.Type == "Update" && act.ObjectProp != nil && act.ObjectProp.ID == act.Actor.ID {
+		// See processBoardActivity.
+		fedi.Forget(act.Actor.ID)
+	} else if act.Type == "Accept" || act.Type == "Reject" {
+		if ok, err := relayReply(ctx, "", act); ok {
+			return err
+		}
+	} else if act.Type == "Announce" {
+		return relayAnnounce(ctx, "", act)
+	} else if config.Debug {
+		log.Printf("instance received %s from %s", act.Type, act.Actor.ID)
+	}
+
+	return nil
+}
+
+// GetInstanceOutbox returns the outbox of the instance actor, which is always
+// empty.
+func GetInstanceOutbox(c *fiber.Ctx) error {
+	return jsonresp(c, fedi.OrderedCollection{
+		Object: &fedi.Object{
+			Context: fedi.Context,
+			ID:      fmt.Sprintf("%s://%s/outbox", config.TransportProtocol, config.FQDN),
+			Type:    "OrderedCollection",
+		},
+	})
 }
 
 func GetBoardActor(c *fiber.Ctx) error {
@@ -249,6 +540,10 @@ func GetBoardOutbox(c *fiber.Ctx) error {
 		return errjson(c, err)
 	}
 
+	if ok, err := checkFetch(c); !ok {
+		return err
+	}
+
 	// Check if we don't need to do anything.
 	if hdr, ok := c.GetReqHeaders()["If-Modified-Since"]; ok {
 		t, err := time.Parse(time.RFC1123, hdr)
@@ -279,33 +574,31 @@ func GetBoardOutbox(c *fiber.Ctx) error {
 }
 
 func GetBoardNote(c *fiber.Ctx) error {
-	// Correct me if I'm wrong, but I don't think we're supposed to return an OrderedCollection here.
-	// Anyways, this is what FChannel does.
-	// I thought we should return the Note representation...?
+	// FChannel expects the post wrapped in an OrderedCollection, so that's
+	// what it gets.
+	// Everything else gets the Note itself.
 
 	board, err := board(c)
 	if err != nil {
 		return errjson(c, err)
 	}
 
-	actor := fedi.TransformBoard(board)
+	if ok, err := checkFetch(c); !ok {
+		return err
+	}
 
-	var post database.Post
+	actor := fedi.TransformBoard(board)
 
-	pid, err := strconv.Atoi(c.Params("thread"))
-	if err != nil {
-		// It's probably ActivityPub
-		q := fmt.Sprintf("%s://%s/%s/%s", config.TransportProtocol, config.FQDN, board.ID, c.Params("thread"))
-		post, err = DB.FindAPID(c.Context(), board.ID, q)
-		if err != nil {
-			return errjson(c, err)
-		}
-	} else {
-		// It's a post number of ours
-		post, err = DB.Post(c.Context(), board.ID, database.PostID(pid))
-		if err != nil {
-			return errjson(c, err)
+	post, err := findPost(c, board, c.Params("thread"))
+	if errors.Is(err, sql.ErrNoRows) {
+		// It may have been deleted.
+		if t, terr := findTombstone(c, board, c.Params("thread")); terr == nil {
+			return jsonresp(c.Status(410), fedi.TransformTombstone(t))
 		}
+
+		return errjson(c, err)
+	} else if err != nil {
+		return errjson(c, err)
 	}
 
 	// Check if we don't need to do anything.
@@ -320,6 +613,19 @@ func GetBoardNote(c *fiber.Ctx) error {
 		}
 	}
 
+	if !isFChannel(c) {
+		var thread *database.Post
+		if post.Thread != 0 {
+			t, err := DB.Post(c.Context(), board.ID, post.Thread)
+			if err != nil {
+				return errjson(c, err)
+			}
+			thread = &t
+		}
+
+		return jsonresp(c, fedi.TransformNote(&actor, post, thread))
+	}
+
 	// I could probably make this much more dense but eh
 
 	if post.Thread == 0 {
@@ -382,12 +688,62 @@ func GetBoardNote(c *fiber.Ctx) error {
 	})
 }
 
+// GetBoardReplies returns the collection of replies to a post.
+// Replies to a thread are every post in it.
+func GetBoardReplies(c *fiber.Ctx) error {
+	board, err := board(c)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if ok, err := checkFetch(c); !ok {
+		return err
+	}
+
+	post, err := findPost(c, board, c.Params("thread"))
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	var posts []database.Post
+	if post.Thread == 0 {
+		posts, err = DB.Thread(c.Context(), board.ID, post.ID, 0, false)
+		if len(posts) > 0 {
+			posts = posts[1:] // Skip OP
+		}
+	} else {
+		posts, err = DB.Replies(c.Context(), board.ID, post.ID, false)
+	}
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	items := make([]fedi.LinkObject, 0, len(posts))
+	for _, p := range posts {
+		items = append(items, fedi.LinkObject{Type: "Link", ID: p.APID})
+	}
+
+	return jsonresp(c, fedi.OrderedCollection{
+		Object: &fedi.Object{
+			Context: fedi.Context,
+			ID:      fedi.RepliesURL(board.ID, post),
+			Type:    "OrderedCollection",
+		},
+		TotalItems:   len(items),
+		OrderedItems: items,
+	})
+}
+
 func GetBoardFollowers(c *fiber.Ctx) error {
 	board, err := board(c)
 	if err != nil {
 		return errjson(c, err)
 	}
 
+	if ok, err := checkFetch(c); !ok {
+		return err
+	}
+
 	followers, err := DB.Followers(c.Context(), board.ID)
 	if err != nil {
 		return errjson(c, err)
@@ -414,6 +770,10 @@ func GetBoardFollowing(c *fiber.Ctx) error {
 		return errjson(c, err)
 	}
 
+	if ok, err := checkFetch(c); !ok {
+		return err
+	}
+
 	following, err := DB.Following(c.Context(), board.ID)
 	if err != nil {
 		return errjson(c, err)
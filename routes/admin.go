@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -79,8 +80,23 @@ func GetAdmin(c *fiber.Ctx) error {
 		return errhtml(c, err, "/admin")
 	}
 
+	blocks, err := DB.Blocks(c.Context())
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	syncs, err := DB.Syncs(c.Context(), 20)
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	relays, err := DB.Relays(c.Context())
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
 	followers := [][]string{}
-	following := [][]string{}
+	following := []database.Follow{}
 
 	for _, board := range boards {
 		fin, err := DB.Followers(c.Context(), board.ID)
@@ -88,7 +104,7 @@ func GetAdmin(c *fiber.Ctx) error {
 			return errhtml(c, err, "/admin")
 		}
 
-		fout, err := DB.Following(c.Context(), board.ID)
+		fout, err := DB.FollowRequests(c.Context(), board.ID)
 		if err != nil {
 			return errhtml(c, err, "/admin")
 		}
@@ -97,9 +113,7 @@ func GetAdmin(c *fiber.Ctx) error {
 			followers = append(followers, []string{board.ID, source})
 		}
 
-		for _, target := range fout {
-			following = append(following, []string{board.ID, target})
-		}
+		following = append(following, fout...)
 	}
 
 	return render(c, "Admin Area", "admin/index", fiber.Map{
@@ -107,6 +121,9 @@ func GetAdmin(c *fiber.Ctx) error {
 		"news":      news,
 		"mods":      mods,
 		"regexps":   rxps,
+		"blocks":    blocks,
+		"syncs":     syncs,
+		"relays":    relays,
 		"followers": followers,
 		"following": following,
 
@@ -142,7 +159,7 @@ func GetAdminBoard(c *fiber.Ctx) error {
 		return errhtml(c, fmt.Errorf("error fetching followers: %w", err), "/admin")
 	}
 
-	following, err := DB.Following(c.Context(), board.ID)
+	following, err := DB.FollowRequests(c.Context(), board.ID)
 	if err != nil {
 		return errhtml(c, fmt.Errorf("error fetching following: %w", err), "/admin")
 	}
@@ -173,14 +190,20 @@ func PostBoard(c *fiber.Ctx) error {
 		return errhtmlc(c, "No ID was specified in your request.", 400, "/admin")
 	} else if !util.IsAlnum(board.ID) {
 		return errhtmlc(c, "The board ID must be alphanumeric.", 400, "/admin")
+	} else if board.Push < 0 {
+		return errhtmlc(c, "The number of threads pushed to new followers can't be negative.", 400, "/admin")
 	}
 
 	if err := DB.SaveBoard(c.Context(), board); err != nil {
 		return err
 	}
 
-	// Create keys
-	if _, err := fedi.CreatePem(board.ID); err != nil {
+	// Create keys, unless we're updating a board that already has them
+	if _, err := fedi.PublicKey(board.ID); errors.Is(err, sql.ErrNoRows) {
+		if err := fedi.CreateKey(c.Context(), board.ID); err != nil {
+			return err
+		}
+	} else if err != nil {
 		return err
 	}
 
@@ -484,9 +507,14 @@ func GetAdminFollow(c *fiber.Ctx) error {
 		return errhtml(c, err, "/admin")
 	}
 
-	// TODO: Only do this when we receive an Accept.
-	// This should go in PostInbox, however FChannel doesn't send one.
-	if err := DB.AddFollowing(c.Context(), board.ID, target.String()); err != nil {
+	// The follow stays pending until we receive an Accept, unless we've been
+	// told not to wait for one because FChannel doesn't send them.
+	state := database.FollowPending
+	if config.CompatFollow {
+		state = database.FollowAccepted
+	}
+
+	if err := DB.AddFollowing(c.Context(), board.ID, target.String(), state); err != nil {
 		return errhtml(c, err, "/admin")
 	}
 
@@ -496,17 +524,17 @@ func GetAdminFollow(c *fiber.Ctx) error {
 
 		go func() {
 			// Give the request a reasonable amount of time to complete.
-			ctx, cancel := context.WithTimeout(context.Background(), config.MaxReqTime)
+			ctx, cancel := context.WithTimeout(context.Background(), fedi.Proxy.MaxTime(target.String()))
 			defer cancel()
 
-			ob, err := fedi.FetchOutbox(ctx, target.String())
+			ob, err := fedi.FetchOutbox(ctx, board.ID, target.String())
 			if err != nil {
 				log.Printf("error fetching outbox of %s: %s", target.String(), err)
 				return
 			}
 
 			// Don't worry about times here.
-			if err := fedi.MergeOutbox(context.Background(), board.ID, ob); err != nil {
+			if _, err := fedi.MergeOutbox(context.Background(), board.ID, ob, time.Time{}); err != nil {
 				log.Printf("error merging outbox of %s to %s: %s", target.String(), board.ID, err)
 			}
 		}()
@@ -543,19 +571,19 @@ func GetAdminFetch(c *fiber.Ctx) error {
 	// TODO: database is locked almost the entire time.
 	go func() {
 		// Give the request a reasonable amount of time to complete.
-		ctx, cancel := context.WithTimeout(context.Background(), config.MaxReqTime)
+		ctx, cancel := context.WithTimeout(context.Background(), fedi.Proxy.MaxTime(target.String()))
 		defer cancel()
 
 		log.Printf("Fetching outbox of %s for %s", target.String(), board.ID)
 
-		ob, err := fedi.FetchOutbox(ctx, target.String())
+		ob, err := fedi.FetchOutbox(ctx, board.ID, target.String())
 		if err != nil {
 			log.Printf("error fetching outbox of %s: %s", target.String(), err)
 			return
 		}
 
 		// Don't worry about times here.
-		if err := fedi.MergeOutbox(context.Background(), board.ID, ob); err != nil {
+		if _, err := fedi.MergeOutbox(context.Background(), board.ID, ob, time.Time{}); err != nil {
 			log.Printf("error merging outbox of %s to %s: %s", target.String(), board.ID, err)
 		}
 	}()
@@ -563,6 +591,71 @@ func GetAdminFetch(c *fiber.Ctx) error {
 	return c.Redirect("/admin")
 }
 
+// GetAdminRotate gives a board a new key and tells its followers about it.
+func GetAdminRotate(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	boardReq := strings.TrimSpace(c.Query("board"))
+	if boardReq == "" {
+		return errhtmlc(c, "You must specify a board.", 400, "/admin")
+	}
+
+	board, err := DB.Board(c.Context(), boardReq)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return errhtmlc(c, "That board does not exist.", 404, "/admin")
+	} else if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	if err := fedi.RotateKey(c.Context(), board.ID); err != nil {
+		return errhtml(c, err, "/admin/"+board.ID)
+	}
+
+	log.Printf("Rotated the key of %s", board.ID)
+
+	go func() {
+		if err := fedi.ActorUpdate(context.Background(), board); err != nil {
+			log.Printf("error sending new actor of %s: %s", board.ID, err)
+		}
+	}()
+
+	return c.Redirect("/admin/" + board.ID)
+}
+
+func GetAdminRerender(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	boardReq := strings.TrimSpace(c.Query("board"))
+	if boardReq == "" {
+		return errhtmlc(c, "You must specify a board.", 400, "/admin")
+	}
+
+	board, err := DB.Board(c.Context(), boardReq)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return errhtmlc(c, "That board does not exist.", 404, "/admin")
+	} else if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	go func() {
+		n, err := DB.RenderPosts(context.Background(), board.ID)
+		if err != nil {
+			log.Printf("error formatting posts of %s again: %s", board.ID, err)
+			return
+		}
+
+		log.Printf("Formatted %d posts of %s again", n, board.ID)
+	}()
+
+	return c.Redirect("/admin/" + board.ID)
+}
+
 func GetAdminResend(c *fiber.Ctx) error {
 	// TODO: Probably doesn't work for threads and we don't check.
 
@@ -652,6 +745,81 @@ func GetAdminUnfollow(c *fiber.Ctx) error {
 	return c.Redirect("/admin")
 }
 
+// relayParams reads the board and relay for GetAdminRelay and
+// GetAdminUnrelay.
+// An empty board is the instance; if the relay is empty, the request was
+// already answered with an error.
+func relayParams(c *fiber.Ctx) (string, string, error) {
+	boardReq := strings.TrimSpace(c.Query("board"))
+	targetReq := strings.TrimSpace(c.Query("target"))
+	if targetReq == "" {
+		return "", "", errhtmlc(c, "You must specify a relay.", 400, "/admin")
+	}
+
+	target, err := url.Parse(targetReq)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return "", "", errhtmlc(c, "The relay link is invalid.", 400, "/admin")
+	}
+
+	if boardReq != "" {
+		if _, err := DB.Board(c.Context(), boardReq); err != nil && errors.Is(err, sql.ErrNoRows) {
+			return "", "", errhtmlc(c, "That board does not exist.", 404, "/admin")
+		} else if err != nil {
+			return "", "", errhtml(c, err, "/admin")
+		}
+	}
+
+	return boardReq, target.String(), nil
+}
+
+// GetAdminRelay subscribes a board, or the instance, to a relay.
+func GetAdminRelay(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	board, target, err := relayParams(c)
+	if target == "" {
+		return err
+	}
+
+	// Relays send activities as their actor, so that's what we need to know
+	// who they're from.
+	if strings.HasSuffix(strings.TrimSuffix(target, "/"), "/inbox") {
+		return errhtmlc(c, "That looks like an inbox. Give the relay's actor instead, which usually ends in /actor.", 400, "/admin")
+	}
+
+	log.Printf("Subscribing %q to relay %s", board, target)
+
+	if err := fedi.RelayFollow(c.Context(), board, target); err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return c.Redirect("/admin")
+}
+
+// GetAdminUnrelay unsubscribes a board, or the instance, from a relay.
+func GetAdminUnrelay(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	board, target, err := relayParams(c)
+	if target == "" {
+		return err
+	}
+
+	log.Printf("Unsubscribing %q from relay %s", board, target)
+
+	if err := fedi.RelayUnfollow(c.Context(), board, target); err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return c.Redirect("/admin")
+}
+
 func PostRegexp(c *fiber.Ctx) error {
 	ok := hasPriv(c, database.ModTypeMod)
 	if !ok {
@@ -691,3 +859,223 @@ func GetRegexpDelete(c *fiber.Ctx) error {
 	// Redirect back to the admin panel
 	return c.Redirect("/admin")
 }
+
+func PostBlock(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	host := strings.TrimSpace(c.FormValue("host"))
+	reason := strings.TrimSpace(c.FormValue("reason"))
+
+	// Be nice and accept links too
+	if u, err := url.Parse(host); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return errhtmlc(c, "Need a valid host.", 400, "/admin")
+	}
+
+	if err := DB.AddBlock(c.Context(), database.Block{Host: host, Reason: reason}); err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return c.Redirect("/admin")
+}
+
+func GetBlockDelete(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/")
+	}
+
+	if err := DB.DeleteBlock(c.Context(), c.Params("host")); err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return c.Redirect("/admin")
+}
+
+// GetAdminTokens lists API tokens.
+func GetAdminTokens(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/admin")
+	}
+
+	return renderTokens(c, "")
+}
+
+// renderTokens renders the token page, showing secret if a token was just
+// made.
+func renderTokens(c *fiber.Ctx, secret string) error {
+	tokens, err := DB.Tokens(c.Context())
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return render(c, "API tokens", "admin/tokens", fiber.Map{
+		"tokens": tokens,
+		"secret": secret,
+	})
+}
+
+// PostAdminTokens makes a new API token.
+func PostAdminTokens(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/admin")
+	}
+
+	token := database.Token{Name: strings.TrimSpace(c.FormValue("name"))}
+	if token.Name == "" {
+		return errhtmlc(c, "The token needs a name.", 400, "/admin/tokens")
+	}
+
+	for _, b := range strings.FieldsFunc(c.FormValue("boards"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, err := DB.Board(c.Context(), b); errors.Is(err, sql.ErrNoRows) {
+			return errhtmlc(c, fmt.Sprintf("/%s/ does not exist.", b), 400, "/admin/tokens")
+		} else if err != nil {
+			return errhtml(c, err, "/admin/tokens")
+		}
+
+		token.Boards = append(token.Boards, b)
+	}
+
+	for scope, name := range map[database.TokenScope]string{
+		database.ScopePost:   "post",
+		database.ScopeReport: "report",
+		database.ScopeDelete: "delete",
+	} {
+		if c.FormValue(name) != "" {
+			token.Scopes |= scope
+		}
+	}
+
+	rate, err := strconv.Atoi(c.FormValue("rate", "10"))
+	if err != nil || rate < 1 {
+		return errhtmlc(c, "The rate limit must be at least 1.", 400, "/admin/tokens")
+	}
+	token.Rate = rate
+
+	secret, err := DB.SaveToken(c.Context(), &token)
+	if err != nil {
+		return errhtml(c, err, "/admin/tokens")
+	}
+
+	return renderTokens(c, secret)
+}
+
+func GetAdminTokenDelete(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/admin")
+	}
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return errhtmlc(c, "Bad token.", 400, "/admin/tokens")
+	}
+
+	if err := DB.DeleteToken(c.Context(), id); err != nil {
+		return errhtml(c, err, "/admin/tokens")
+	}
+
+	forgetToken(id)
+	return c.Redirect("/admin/tokens")
+}
+
+// GetAdminActivities shows the activities we received most recently, and
+// what became of them.
+func GetAdminActivities(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeAdmin)
+	if !ok {
+		return errpriv(c, database.ModTypeAdmin, "/admin")
+	}
+
+	acts, err := DB.Activities(c.Context(), 100)
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return render(c, "Received activities", "admin/activities", fiber.Map{
+		"activities": acts,
+	})
+}
+
+// federationPeer is a row of the federation page.
+type federationPeer struct {
+	fedi.PeerStats
+
+	// Following are the follows our boards sent to the host, and Followers
+	// are [board, follower] pairs of its actors that follow our boards.
+	Following []database.Follow
+	Followers [][2]string
+}
+
+// GetAdminFederation shows how federating with every instance we know of is
+// going.
+// Stats are saved every few minutes, and only for instances we follow, that
+// follow us, or that are relays.
+func GetAdminFederation(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeMod)
+	if !ok {
+		return errpriv(c, database.ModTypeMod, "/")
+	}
+
+	boards, err := DB.Boards(c.Context())
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	peers := map[string]*federationPeer{}
+	get := func(host string) *federationPeer {
+		p, ok := peers[host]
+		if !ok {
+			p = &federationPeer{PeerStats: fedi.PeerStats{Host: host}}
+			peers[host] = p
+		}
+		return p
+	}
+
+	for _, p := range fedi.Peers() {
+		get(p.Host).PeerStats = p
+	}
+
+	for _, board := range boards {
+		following, err := DB.FollowRequests(c.Context(), board.ID)
+		if err != nil {
+			return errhtml(c, err, "/admin")
+		}
+
+		followers, err := DB.Followers(c.Context(), board.ID)
+		if err != nil {
+			return errhtml(c, err, "/admin")
+		}
+
+		for _, f := range following {
+			p := get(fedi.PeerHost(f.Target))
+			p.Following = append(p.Following, f)
+		}
+
+		for _, f := range followers {
+			p := get(fedi.PeerHost(f))
+			p.Followers = append(p.Followers, [2]string{board.ID, f})
+		}
+	}
+
+	list := make([]*federationPeer, 0, len(peers))
+	for _, p := range peers {
+		list = append(list, p)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+
+	return render(c, "Federation", "admin/federation", fiber.Map{
+		"peers": list,
+	})
+}
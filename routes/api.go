@@ -51,6 +51,24 @@ func GetCaptcha(c *fiber.Ctx) error {
 	})
 }
 
+// submitPost saves a new post and sends it out.
+func submitPost(c *fiber.Ctx, board database.Board, post *database.Post) error {
+	if err := DB.SavePost(c.Context(), board.ID, post); err != nil {
+		return err
+	}
+
+	go post.Notify(DB, board.ID)
+
+	p := *post
+	go func() {
+		if err := fedi.PostOut(context.Background(), board, p); err != nil {
+			log.Printf("fedi.PostOut for /%s/%d: error: %s", board.ID, p.ID, err)
+		}
+	}()
+
+	return nil
+}
+
 func Post(c *fiber.Ctx) error {
 	isBot := isStreams(c)
 
@@ -179,7 +197,7 @@ func Post(c *fiber.Ctx) error {
 		post.Thread = thread.ID
 	}
 
-	if err := DB.SavePost(c.Context(), board.ID, &post); err != nil {
+	if err := submitPost(c, board, &post); err != nil {
 		// TODO: update
 
 		if isBot {
@@ -189,15 +207,7 @@ func Post(c *fiber.Ctx) error {
 		}
 	}
 
-	go post.Notify(DB, board.ID)
-
-	// TODO: FBI anon asks for outputting the AP object upon response.
-
-	go func() {
-		if err := fedi.PostOut(context.Background(), board, post); err != nil {
-			log.Printf("fedi.PostOut for /%s/%d: error: %s", board.ID, post.ID, err)
-		}
-	}()
+	// Bots wanting the post back should use /api/v1/post.
 
 	// Redirect to the newly created thread if not a bot, and noko
 	if !isBot && noko {
@@ -212,3 +222,170 @@ func Post(c *fiber.Ctx) error {
 
 	return c.SendStatus(200)
 }
+
+// apiRequest is what the write API takes.
+// Posts can be given by our number for them or their ActivityPub ID.
+type apiRequest struct {
+	Board string `json:"board"`
+
+	// For /api/v1/post
+	Thread  string `json:"thread"` // Empty for a new thread
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Comment string `json:"comment"`
+	Sage    bool   `json:"sage"`
+
+	// For /api/v1/report and /api/v1/delete
+	Post    string `json:"post"`
+	Reason  string `json:"reason"`
+	Forward bool   `json:"forward"`
+}
+
+// apiPostResult is what /api/v1/post answers with.
+type apiPostResult struct {
+	ID     database.PostID `json:"id"`
+	Thread database.PostID `json:"thread"`
+	APID   string          `json:"apid"`
+
+	// Object is the post as it is sent to other instances.
+	Object fedi.Note `json:"object"`
+}
+
+// apiBoard reads a request to the write API, finds the board it is for, and
+// checks that it may be made from where it came from.
+// A response has already been sent if it fails.
+func apiBoard(c *fiber.Ctx, scope database.TokenScope) (apiRequest, database.Board, error) {
+	req := apiRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return req, database.Board{}, errjsonc(c, 400, "bad request")
+	}
+
+	board, err := DB.Board(c.Context(), req.Board)
+	if err != nil {
+		return req, board, errjson(c, err)
+	}
+
+	t := c.Locals("token").(database.Token)
+	if !t.Can(scope, board.ID) {
+		return req, board, errjsonc(c, 403, "token can't be used on this board")
+	}
+
+	// A token doesn't get around a ban on where it is used from.
+	// We can't ban people in private mode.
+	if !config.Private {
+		ok, _, _, err := DB.Banned(c.Context(), c.IP())
+		if err != nil {
+			return req, board, errjson(c, err)
+		} else if !ok {
+			return req, board, errjsonc(c, 403, "banned")
+		}
+	}
+
+	return req, board, nil
+}
+
+// PostAPIPost makes a post, and answers with it.
+func PostAPIPost(c *fiber.Ctx) error {
+	req, board, err := apiBoard(c, database.ScopePost)
+	if err != nil {
+		return err
+	}
+
+	if req.Name == "" {
+		req.Name = "Anonymous"
+	}
+
+	name := util.Trim(req.Name, config.NameCutoff)
+	subject := util.Trim(req.Subject, config.SubjectCutoff)
+	content := util.Trim(req.Comment, config.PostCutoff)
+	if content == "" {
+		return errjsonc(c, 400, "Comment must not be empty.")
+	}
+
+	var trip string
+	name, trip = crypto.DoTrip(name)
+	if trip == "mod" {
+		// Tokens aren't moderators
+		trip = ""
+	}
+
+	post := database.Post{
+		Bumpdate: time.Now().UTC(),
+		Name:     name,
+		Raw:      content,
+		Source:   getIP(c),
+		Subject:  subject,
+		Tripcode: trip,
+		SJIS:     util.IsJapanese(content),
+		Sage:     req.Sage && req.Thread != "",
+	}
+
+	var thread *database.Post
+	if req.Thread != "" {
+		t, err := resolvePost(c, board, req.Thread)
+		if err != nil {
+			return errjson(c, err)
+		} else if t.Thread != 0 {
+			return errjsonc(c, 400, "The thread you are posting to is actually a post.")
+		}
+
+		post.Thread = t.ID
+		thread = &t
+	}
+
+	if err := submitPost(c, board, &post); err != nil {
+		return errjson(c, err)
+	}
+
+	actor := fedi.TransformBoard(board)
+	return c.Status(201).JSON(apiPostResult{
+		ID:     post.ID,
+		Thread: post.Thread,
+		APID:   post.APID,
+		Object: fedi.TransformNote(&actor, post, thread),
+	})
+}
+
+// PostAPIReport reports a post.
+func PostAPIReport(c *fiber.Ctx) error {
+	req, board, err := apiBoard(c, database.ScopeReport)
+	if err != nil {
+		return err
+	}
+
+	post, err := resolvePost(c, board, req.Post)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if err := fileReport(c, board, post, util.Trim(req.Reason, config.ReportCutoff), req.Forward); err != nil {
+		return errjson(c, err)
+	}
+
+	return c.SendStatus(204)
+}
+
+// PostAPIDelete deletes a post, or a thread.
+func PostAPIDelete(c *fiber.Ctx) error {
+	req, board, err := apiBoard(c, database.ScopeDelete)
+	if err != nil {
+		return err
+	}
+
+	post, err := resolvePost(c, board, req.Post)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "No reason provided."
+	}
+
+	t := c.Locals("token").(database.Token)
+	if err := deletePost(c, board, post, t.Name+" (token)", reason); err != nil {
+		return errjson(c, err)
+	}
+
+	return c.SendStatus(204)
+}
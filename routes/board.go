@@ -43,7 +43,31 @@ func board(c *fiber.Ctx) (database.Board, error) {
 	return board, err
 }
 
+// resolvePost finds a post given its ActivityPub ID, our ID for it, or the
+// last part of its ActivityPub ID.
+// If the post was deleted, database.ErrPostDeleted is returned.
 func resolvePost(c *fiber.Ctx, board database.Board, match string) (database.Post, error) {
+	post, err := findPost(c, board, match)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, terr := findTombstone(c, board, match); terr == nil {
+			err = database.ErrPostDeleted
+		}
+	}
+
+	return post, err
+}
+
+// findTombstone is resolvePost for deleted posts.
+func findTombstone(c *fiber.Ctx, board database.Board, match string) (database.Tombstone, error) {
+	if _, err := strconv.Atoi(match); err != nil && !strings.HasPrefix(match, "http") {
+		// See findPost.
+		match = fmt.Sprintf("%s://%s/%s/%s", config.TransportProtocol, config.FQDN, board.ID, match)
+	}
+
+	return DB.Tombstone(c.Context(), board.ID, match)
+}
+
+func findPost(c *fiber.Ctx, board database.Board, match string) (database.Post, error) {
 	var post database.Post
 	var err error
 
@@ -254,6 +278,35 @@ func GetBoardReport(c *fiber.Ctx) error {
 	})
 }
 
+// fileReport reports a post to the moderators, and if forward is set, to the
+// instance it came from too.
+func fileReport(c *fiber.Ctx, board database.Board, post database.Post, reason string, forward bool) error {
+	rep := database.Report{
+		Source: getIP(c),
+		Board:  board.ID,
+		Post:   post.ID,
+		Reason: reason,
+		Date:   time.Now().UTC(),
+	}
+
+	if err := DB.FileReport(c.Context(), rep); err != nil {
+		return err
+	}
+
+	go rep.Notify(DB)
+
+	if forward && !post.IsLocal() {
+		// Let the moderators of where it came from know too
+		go func() {
+			if err := fedi.ReportOut(context.Background(), board, post, reason); err != nil {
+				log.Printf("failed to forward report on %s: %v", post.APID, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
 func PostBoardReport(c *fiber.Ctx) error {
 	board, err := board(c)
 	if err != nil {
@@ -277,28 +330,52 @@ func PostBoardReport(c *fiber.Ctx) error {
 	}
 
 	// Ensure it exists
-	_, err = DB.Post(c.Context(), board.ID, database.PostID(pid))
+	post, err := DB.Post(c.Context(), board.ID, database.PostID(pid))
 	if err != nil {
 		return errhtmlc(c, "Post was not found.", 404, "/"+board.ID)
 	}
 
 	reason := util.Trim(c.FormValue("reason"), config.ReportCutoff)
-	rep := database.Report{
-		Source: getIP(c),
+	if err := fileReport(c, board, post, reason, c.FormValue("forward") != ""); err != nil {
+		return errhtml(c, err)
+	}
+
+	// Redirect back to the index
+	return c.Redirect("/" + board.ID)
+}
+
+// deletePost deletes a post, or a thread and every post in it, and tells
+// everyone else if it was made here.
+func deletePost(c *fiber.Ctx, board database.Board, post database.Post, author, reason string) error {
+	action := database.ModerationAction{
+		Author: author,
+		Type:   database.ModActionDelete,
 		Board:  board.ID,
-		Post:   database.PostID(pid),
+		Post:   post.ID,
 		Reason: reason,
 		Date:   time.Now().UTC(),
 	}
 
-	if err := DB.FileReport(c.Context(), rep); err != nil {
-		return errhtml(c, err)
+	if post.Thread == 0 {
+		if err := DB.DeleteThread(c.Context(), board.ID, post.ID, action); err != nil {
+			return err
+		}
+	} else {
+		if err := DB.DeletePost(c.Context(), board.ID, post.ID, action); err != nil {
+			return err
+		}
 	}
 
-	go rep.Notify(DB)
+	// Tell everyone else if it's local
+	if post.IsLocal() {
+		go func() {
+			if err := fedi.PostDel(context.Background(), board, post); err != nil {
+				log.Printf("fedi.PostDel for /%s/%d: error: %s", board.ID, post.ID, err)
+			}
+		}()
+	}
 
-	// Redirect back to the index
-	return c.Redirect("/" + board.ID)
+	return nil
 }
 
 func GetDelete(c *fiber.Ctx) error {
@@ -331,37 +408,8 @@ func GetDelete(c *fiber.Ctx) error {
 
 	hasConfirmed := strings.TrimSpace(c.Query("confirm", "")) == "1"
 	if hasConfirmed {
-		if post.Thread == 0 {
-			if err := DB.DeleteThread(c.Context(), board.ID, post.ID, database.ModerationAction{
-				Author: c.Locals("username").(string),
-				Type:   database.ModActionDelete,
-				Board:  board.ID,
-				Post:   post.ID,
-				Reason: c.Query("reason", "No reason provided."),
-				Date:   time.Now().UTC(),
-			}); err != nil {
-				return errhtml(c, err)
-			}
-		} else {
-			if err := DB.DeletePost(c.Context(), board.ID, post.ID, database.ModerationAction{
-				Author: c.Locals("username").(string),
-				Type:   database.ModActionDelete,
-				Board:  board.ID,
-				Post:   post.ID,
-				Reason: c.Query("reason", "No reason provided."),
-				Date:   time.Now().UTC(),
-			}); err != nil {
-				return errhtml(c, err)
-			}
-		}
-
-		// Tell everyone else if it's local
-		if post.IsLocal() {
-			go func() {
-				if err := fedi.PostDel(context.Background(), board, post); err != nil {
-					log.Printf("fedi.PostDel for /%s/%d: error: %s", board.ID, post.ID, err)
-				}
-			}()
+		if err := deletePost(c, board, post, c.Locals("username").(string), c.Query("reason", "No reason provided.")); err != nil {
+			return errhtml(c, err)
 		}
 
 		return c.Redirect("/" + board.ID)
@@ -372,3 +420,96 @@ func GetDelete(c *fiber.Ctx) error {
 		"post":  post,
 	})
 }
+
+func GetEdit(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeMod)
+	if !ok {
+		return errpriv(c, database.ModTypeMod, "/")
+	}
+
+	boardReq := strings.TrimSpace(c.Query("board"))
+	postReq := strings.TrimSpace(c.Query("post"))
+
+	board, err := DB.Board(c.Context(), boardReq)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return errhtmlc(c, "That board does not exist.", 404, "/admin")
+	} else if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	pid, err := strconv.Atoi(postReq)
+	if err != nil {
+		return errhtmlc(c, "Bad post number.", 400, fmt.Sprintf("/%s", board.ID))
+	}
+
+	post, err := DB.Post(c.Context(), board.ID, database.PostID(pid))
+	if err != nil {
+		return errhtmlc(c, "The post you are looking for doesn't exist.", 404, fmt.Sprintf("/%s", board.ID))
+	}
+
+	revs, err := DB.Revisions(c.Context(), board.ID, post.ID)
+	if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	return render(c, fmt.Sprintf("Edit Post /%s/%d", board.ID, pid), "admin/edit", fiber.Map{
+		"board":     board,
+		"post":      post,
+		"revisions": revs,
+	})
+}
+
+func PostEdit(c *fiber.Ctx) error {
+	ok := hasPriv(c, database.ModTypeMod)
+	if !ok {
+		return errpriv(c, database.ModTypeMod, "/")
+	}
+
+	boardReq := strings.TrimSpace(c.FormValue("board"))
+	postReq := strings.TrimSpace(c.FormValue("post"))
+
+	board, err := DB.Board(c.Context(), boardReq)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return errhtmlc(c, "That board does not exist.", 404, "/admin")
+	} else if err != nil {
+		return errhtml(c, err, "/admin")
+	}
+
+	pid, err := strconv.Atoi(postReq)
+	if err != nil {
+		return errhtmlc(c, "Bad post number.", 400, fmt.Sprintf("/%s", board.ID))
+	}
+
+	post, err := DB.Post(c.Context(), board.ID, database.PostID(pid))
+	if err != nil {
+		return errhtmlc(c, "The post you are looking for doesn't exist.", 404, fmt.Sprintf("/%s", board.ID))
+	}
+
+	ret := fmt.Sprintf("/admin/edit?board=%s&post=%d", board.ID, post.ID)
+
+	post.Subject = util.Trim(c.FormValue("subject"), config.SubjectCutoff)
+	post.Raw = util.Trim(c.FormValue("comment"), config.PostCutoff)
+	if post.Raw == "" {
+		return errhtmlc(c, "Comment must not be empty.", 400, ret)
+	}
+
+	if err := DB.EditPost(c.Context(), board.ID, &post, c.Locals("username").(string)); err != nil {
+		return errhtml(c, err, ret)
+	}
+
+	// Tell everyone else if it's local
+	if post.IsLocal() {
+		go func() {
+			if err := fedi.PostUpdate(context.Background(), board, post); err != nil {
+				log.Printf("fedi.PostUpdate for /%s/%d: error: %s", board.ID, post.ID, err)
+			}
+		}()
+	}
+
+	thread := post.Thread
+	if thread == 0 {
+		thread = post.ID
+	}
+
+	return c.Redirect(fmt.Sprintf("/%s/%d#p%d", board.ID, thread, post.ID))
+}
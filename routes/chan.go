@@ -0,0 +1,355 @@
+package routes
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// This file serves boards in the shape of 4chan's read-only JSON API, so that
+// readers and archivers made for it work here too.
+// See https://github.com/4chan/4chan-API.
+
+// chanTail is how many of the last replies of a thread are shown on pages and
+// in the catalog.
+const chanTail = 5
+
+// chanPost is a post as 4chan's API shows it.
+type chanPost struct {
+	No      database.PostID `json:"no"`
+	Resto   database.PostID `json:"resto"`
+	Now     string          `json:"now"`
+	Time    int64           `json:"time"`
+	Name    string          `json:"name"`
+	Trip    string          `json:"trip,omitempty"`
+	Capcode string          `json:"capcode,omitempty"`
+	Sub     string          `json:"sub,omitempty"`
+	Com     string          `json:"com"`
+}
+
+// chanOP is the opening post of a thread, which also describes the thread.
+type chanOP struct {
+	chanPost
+
+	Replies      int        `json:"replies"`
+	UniqueIPs    int        `json:"unique_ips"`
+	LastModified int64      `json:"last_modified"`
+	OmittedPosts int        `json:"omitted_posts,omitempty"`
+	LastReplies  []chanPost `json:"last_replies,omitempty"`
+}
+
+// chanPage is a page of threads, as found in threads.json and catalog.json.
+type chanPage[T any] struct {
+	Page    int `json:"page"`
+	Threads []T `json:"threads"`
+}
+
+// chanThreadEntry is a thread as found in threads.json.
+type chanThreadEntry struct {
+	No           database.PostID `json:"no"`
+	LastModified int64           `json:"last_modified"`
+	Replies      int             `json:"replies"`
+}
+
+type chanPosts struct {
+	Posts []any `json:"posts"`
+}
+
+type chanBoard struct {
+	Board           string `json:"board"`
+	Title           string `json:"title"`
+	MetaDescription string `json:"meta_description"`
+	WSBoard         int    `json:"ws_board"`
+	PerPage         int    `json:"per_page"`
+	Pages           int    `json:"pages"`
+	MaxCommentChars int    `json:"max_comment_chars"`
+}
+
+func toChanPost(p database.Post) chanPost {
+	cp := chanPost{
+		No:   p.ID,
+		Now:  p.Date.Format("01/02/06(Mon)15:04:05"),
+		Time: p.Date.Unix(),
+		Name: p.Name,
+		Sub:  p.Subject,
+		Com:  p.Content,
+	}
+
+	// Threads and Thread fill in Thread for threads too
+	if p.Thread != p.ID {
+		cp.Resto = p.Thread
+	}
+
+	// Capcodes are tripcodes starting with a #, but only ours
+	if p.IsLocal() && strings.HasPrefix(p.Tripcode, "#") {
+		cp.Capcode = strings.ToLower(p.Tripcode[1:])
+	} else {
+		cp.Trip = p.Tripcode
+	}
+
+	return cp
+}
+
+// chanThread fetches a thread and its last tail replies, or every reply if
+// tail is 0.
+func chanThread(c *fiber.Ctx, board string, thread database.PostID, tail int) (chanOP, []chanPost, error) {
+	posts, err := DB.Thread(c.Context(), board, thread, tail, false)
+	if err != nil {
+		return chanOP{}, nil, err
+	}
+
+	nposts, posters, err := DB.ThreadStat(c.Context(), board, thread)
+	if err != nil {
+		return chanOP{}, nil, err
+	}
+
+	modified, err := DB.LastModified(c.Context(), board, thread)
+	if err != nil {
+		return chanOP{}, nil, err
+	}
+
+	replies := make([]chanPost, 0, len(posts)-1)
+	for _, p := range posts[1:] {
+		replies = append(replies, toChanPost(p))
+	}
+
+	op := chanOP{
+		chanPost:     toChanPost(posts[0]),
+		Replies:      nposts - 1,
+		UniqueIPs:    posters,
+		LastModified: modified.Unix(),
+		OmittedPosts: nposts - len(posts),
+	}
+
+	return op, replies, nil
+}
+
+// chanPages fetches every thread on board with its last tail replies, split
+// into pages.
+func chanPages(c *fiber.Ctx, board string, tail int) ([]chanPage[chanOP], error) {
+	threads, err := DB.Threads(c.Context(), board, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := []chanPage[chanOP]{}
+
+	for i, thread := range threads {
+		if i%config.ThreadsPerPage == 0 {
+			pages = append(pages, chanPage[chanOP]{Page: len(pages) + 1, Threads: []chanOP{}})
+		}
+
+		op, replies, err := chanThread(c, board, thread.ID, tail)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(replies) > 0 {
+			op.LastReplies = replies
+		}
+
+		page := &pages[len(pages)-1]
+		page.Threads = append(page.Threads, op)
+	}
+
+	return pages, nil
+}
+
+// notModified sets the Last-Modified header to t, and reports whether the
+// client already has what it asked for according to If-Modified-Since.
+func notModified(c *fiber.Ctx, t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+
+	c.Set(fiber.HeaderLastModified, t.UTC().Format(http.TimeFormat))
+
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+
+	return !t.Truncate(time.Second).After(since)
+}
+
+func GetChanBoards(c *fiber.Ctx) error {
+	boards, err := DB.Boards(c.Context())
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	res := struct {
+		Boards []chanBoard `json:"boards"`
+	}{[]chanBoard{}}
+
+	for _, b := range boards {
+		// Boards doesn't count threads
+		b, err := DB.Board(c.Context(), b.ID)
+		if err != nil {
+			return errjson(c, err)
+		}
+
+		res.Boards = append(res.Boards, chanBoard{
+			Board:           b.ID,
+			Title:           b.Title,
+			MetaDescription: b.Description,
+			WSBoard:         1,
+			PerPage:         config.ThreadsPerPage,
+			Pages:           int(math.Max(1, math.Ceil(float64(b.Threads)/config.ThreadsPerPage))),
+			MaxCommentChars: config.PostCutoff,
+		})
+	}
+
+	return c.JSON(res)
+}
+
+func GetChanThreads(c *fiber.Ctx) error {
+	board, err := board(c)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	modified, err := DB.LastModified(c.Context(), board.ID, 0)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if notModified(c, modified) {
+		return c.SendStatus(304)
+	}
+
+	threads, err := DB.ThreadActivity(c.Context(), board.ID)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	res := []chanPage[chanThreadEntry]{}
+	for i, t := range threads {
+		if i%config.ThreadsPerPage == 0 {
+			res = append(res, chanPage[chanThreadEntry]{Page: len(res) + 1, Threads: []chanThreadEntry{}})
+		}
+
+		page := &res[len(res)-1]
+		page.Threads = append(page.Threads, chanThreadEntry{t.ID, t.LastModified.Unix(), t.Replies})
+	}
+
+	return c.JSON(res)
+}
+
+func GetChanCatalog(c *fiber.Ctx) error {
+	board, err := board(c)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	modified, err := DB.LastModified(c.Context(), board.ID, 0)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if notModified(c, modified) {
+		return c.SendStatus(304)
+	}
+
+	pages, err := chanPages(c, board.ID, chanTail)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	return c.JSON(pages)
+}
+
+func GetChanPage(c *fiber.Ctx) error {
+	board, err := board(c)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	page, err := strconv.Atoi(c.Params("page"))
+	if err != nil || page < 1 {
+		return errjsonc(c, 404, "not found")
+	}
+
+	// Anything changing on the board can move threads between pages.
+	modified, err := DB.LastModified(c.Context(), board.ID, 0)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if notModified(c, modified) {
+		return c.SendStatus(304)
+	}
+
+	threads, err := DB.Threads(c.Context(), board.ID, page)
+	if err != nil {
+		return errjson(c, err)
+	} else if len(threads) == 0 && page > 1 {
+		return errjsonc(c, 404, "not found")
+	}
+
+	res := struct {
+		Threads []chanPosts `json:"threads"`
+	}{[]chanPosts{}}
+
+	for _, thread := range threads {
+		op, replies, err := chanThread(c, board.ID, thread.ID, chanTail)
+		if err != nil {
+			return errjson(c, err)
+		}
+
+		posts := chanPosts{Posts: []any{op}}
+		for _, p := range replies {
+			posts.Posts = append(posts.Posts, p)
+		}
+
+		res.Threads = append(res.Threads, posts)
+	}
+
+	return c.JSON(res)
+}
+
+func GetChanThread(c *fiber.Ctx) error {
+	board, err := board(c)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	id, err := strconv.Atoi(c.Params("thread"))
+	if err != nil {
+		return errjsonc(c, 404, "not found")
+	}
+
+	if op, err := DB.Post(c.Context(), board.ID, database.PostID(id)); err != nil {
+		return errjson(c, err)
+	} else if op.Thread != 0 {
+		return errjsonc(c, 404, fmt.Sprintf("%d is not a thread", id))
+	}
+
+	modified, err := DB.LastModified(c.Context(), board.ID, database.PostID(id))
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	if notModified(c, modified) {
+		return c.SendStatus(304)
+	}
+
+	op, replies, err := chanThread(c, board.ID, database.PostID(id), 0)
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	res := chanPosts{Posts: []any{op}}
+	for _, p := range replies {
+		res.Posts = append(res.Posts, p)
+	}
+
+	return c.JSON(res)
+}
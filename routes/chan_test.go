@@ -0,0 +1,400 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// chanDB is just enough of a database for the 4chan API.
+// It has one board, prog, where thread n has n-1 replies and threads are
+// bumped in order, so that thread 1 is last.
+type chanDB struct {
+	database.Database
+
+	threads  [][]database.Post
+	modified time.Time
+
+	// calls counts the queries that fetch posts.
+	calls int
+}
+
+func newChanDB(threads int) *chanDB {
+	db := &chanDB{modified: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	id := database.PostID(1)
+	for i := 0; i < threads; i++ {
+		op := database.Post{ID: id, Name: "Anonymous", Raw: "op", Content: "op", Source: "127.0.0.1", Date: db.modified}
+		op.Thread = op.ID
+		id++
+
+		posts := []database.Post{op}
+		for j := 0; j < i; j++ {
+			posts = append(posts, database.Post{ID: id, Thread: op.ID, Name: "Anonymous", Raw: "reply", Content: "reply", Source: fmt.Sprintf("10.0.0.%d", j), Date: db.modified})
+			id++
+		}
+
+		db.threads = append([][]database.Post{posts}, db.threads...)
+	}
+
+	return db
+}
+
+func (db *chanDB) Board(ctx context.Context, board string) (database.Board, error) {
+	if board != "prog" {
+		return database.Board{}, sql.ErrNoRows
+	}
+	return database.Board{ID: "prog", Title: "Programming", Threads: len(db.threads)}, nil
+}
+
+func (db *chanDB) Boards(ctx context.Context) ([]database.Board, error) {
+	return []database.Board{{ID: "prog", Title: "Programming"}}, nil
+}
+
+func (db *chanDB) thread(id database.PostID) []database.Post {
+	for _, t := range db.threads {
+		if t[0].ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (db *chanDB) Threads(ctx context.Context, board string, page int) ([]database.Post, error) {
+	db.calls++
+
+	threads := db.threads
+	if page > 0 {
+		start := (page - 1) * config.ThreadsPerPage
+		if start > len(threads) {
+			start = len(threads)
+		}
+		threads = threads[start:]
+
+		if len(threads) > config.ThreadsPerPage {
+			threads = threads[:config.ThreadsPerPage]
+		}
+	}
+
+	ops := []database.Post{}
+	for _, t := range threads {
+		ops = append(ops, t[0])
+	}
+	return ops, nil
+}
+
+func (db *chanDB) Thread(ctx context.Context, board string, thread database.PostID, tail int, replies bool) ([]database.Post, error) {
+	db.calls++
+
+	t := db.thread(thread)
+	if t == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	if tail > 0 && len(t)-1 > tail {
+		return append([]database.Post{t[0]}, t[len(t)-tail:]...), nil
+	}
+	return t, nil
+}
+
+func (db *chanDB) ThreadStat(ctx context.Context, board string, thread database.PostID) (int, int, error) {
+	t := db.thread(thread)
+	return len(t), len(t), nil
+}
+
+func (db *chanDB) LastModified(ctx context.Context, board string, thread database.PostID) (time.Time, error) {
+	if thread != 0 && db.thread(thread) == nil {
+		return time.Time{}, nil
+	}
+	return db.modified, nil
+}
+
+func (db *chanDB) ThreadActivity(ctx context.Context, board string) ([]database.ThreadActivity, error) {
+	db.calls++
+
+	threads := []database.ThreadActivity{}
+	for _, t := range db.threads {
+		threads = append(threads, database.ThreadActivity{ID: t[0].ID, Replies: len(t) - 1, LastModified: db.modified})
+	}
+	return threads, nil
+}
+
+func (db *chanDB) Post(ctx context.Context, board string, post database.PostID) (database.Post, error) {
+	for _, t := range db.threads {
+		for _, p := range t {
+			if p.ID == post {
+				if p.ID == p.Thread {
+					p.Thread = 0
+				}
+				return p, nil
+			}
+		}
+	}
+	return database.Post{}, sql.ErrNoRows
+}
+
+// setupChan sets up the 4chan API with a board of n threads.
+func setupChan(t *testing.T, n int) (*chanDB, *fiber.App) {
+	t.Helper()
+
+	old := DB
+	t.Cleanup(func() { DB = old })
+
+	db := newChanDB(n)
+	DB = db
+
+	app := newTestApp()
+	app.Get("/boards.json", GetChanBoards)
+	app.Get("/:board/threads.json", GetChanThreads)
+	app.Get("/:board/catalog.json", GetChanCatalog)
+	app.Get("/:board/thread/:thread.json", GetChanThread)
+	app.Get("/:board/:page.json", GetChanPage)
+
+	return db, app
+}
+
+// getJSON fetches path from app, checks the status, and decodes the response
+// into v if it is 200.
+func getJSON(t *testing.T, app *fiber.App, path string, status int, v any) {
+	t.Helper()
+
+	res, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != status {
+		t.Fatalf("GET %s: got status %d, want %d", path, res.StatusCode, status)
+	}
+
+	if status == 200 && v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+}
+
+func TestChanBoards(t *testing.T) {
+	_, app := setupChan(t, config.ThreadsPerPage+1)
+
+	var res struct {
+		Boards []chanBoard `json:"boards"`
+	}
+	getJSON(t, app, "/boards.json", 200, &res)
+
+	if len(res.Boards) != 1 {
+		t.Fatalf("got %d boards, want 1", len(res.Boards))
+	}
+
+	b := res.Boards[0]
+	if b.Board != "prog" || b.Title != "Programming" || b.Pages != 2 || b.PerPage != config.ThreadsPerPage {
+		t.Errorf("got %+v", b)
+	}
+}
+
+func TestChanThreads(t *testing.T) {
+	db, app := setupChan(t, config.ThreadsPerPage+2)
+
+	var res []chanPage[chanThreadEntry]
+	getJSON(t, app, "/prog/threads.json", 200, &res)
+
+	if db.calls != 1 {
+		t.Errorf("threads.json made %d queries for posts, want 1", db.calls)
+	}
+
+	if len(res) != 2 || len(res[0].Threads) != config.ThreadsPerPage || len(res[1].Threads) != 2 {
+		t.Fatalf("got %+v, want two pages of %d and 2 threads", res, config.ThreadsPerPage)
+	}
+
+	for i, page := range res {
+		if page.Page != i+1 {
+			t.Errorf("page %d is numbered %d", i+1, page.Page)
+		}
+	}
+
+	// The last thread has no replies
+	last := res[1].Threads[1]
+	if last.No != 1 || last.Replies != 0 || last.LastModified != db.modified.Unix() {
+		t.Errorf("last thread is %+v", last)
+	}
+
+	first := res[0].Threads[0]
+	if want := db.threads[0][0].ID; first.No != want || first.Replies != config.ThreadsPerPage+1 {
+		t.Errorf("first thread is %+v, want %d with %d replies", first, want, config.ThreadsPerPage+1)
+	}
+
+	getJSON(t, app, "/nope/threads.json", 404, nil)
+}
+
+func TestChanCatalog(t *testing.T) {
+	db, app := setupChan(t, chanTail+3)
+
+	var res []chanPage[chanOP]
+	getJSON(t, app, "/prog/catalog.json", 200, &res)
+
+	if len(res) != 1 || len(res[0].Threads) != chanTail+3 {
+		t.Fatalf("got %+v, want one page of %d threads", res, chanTail+3)
+	}
+
+	op := res[0].Threads[0]
+	replies := len(db.threads[0]) - 1
+	if op.Replies != replies || op.OmittedPosts != replies-chanTail || len(op.LastReplies) != chanTail {
+		t.Errorf("got %d replies, %d omitted and %d shown; want %d, %d and %d", op.Replies, op.OmittedPosts, len(op.LastReplies), replies, replies-chanTail, chanTail)
+	}
+
+	if last := op.LastReplies[len(op.LastReplies)-1]; last.No != db.threads[0][replies].ID || last.Resto != op.No {
+		t.Errorf("last reply is %+v, want %d replying to %d", last, db.threads[0][replies].ID, op.No)
+	}
+
+	if op.Resto != 0 {
+		t.Errorf("OP replies to %d", op.Resto)
+	}
+
+	if empty := res[0].Threads[len(res[0].Threads)-1]; empty.LastReplies != nil || empty.OmittedPosts != 0 {
+		t.Errorf("thread without replies is %+v", empty)
+	}
+}
+
+func TestChanPage(t *testing.T) {
+	_, app := setupChan(t, config.ThreadsPerPage+1)
+
+	var res struct {
+		Threads []struct {
+			Posts []chanOP `json:"posts"`
+		} `json:"threads"`
+	}
+
+	getJSON(t, app, "/prog/1.json", 200, &res)
+	if len(res.Threads) != config.ThreadsPerPage {
+		t.Errorf("page 1 has %d threads, want %d", len(res.Threads), config.ThreadsPerPage)
+	}
+
+	getJSON(t, app, "/prog/2.json", 200, &res)
+	if len(res.Threads) != 1 || len(res.Threads[0].Posts) != 1 || res.Threads[0].Posts[0].No != 1 {
+		t.Errorf("page 2 is %+v, want thread 1", res.Threads)
+	}
+
+	getJSON(t, app, "/prog/3.json", 404, nil)
+	getJSON(t, app, "/prog/0.json", 404, nil)
+	getJSON(t, app, "/nope/1.json", 404, nil)
+
+	// An empty board still has a first page
+	_, app = setupChan(t, 0)
+	getJSON(t, app, "/prog/1.json", 200, &res)
+	if len(res.Threads) != 0 {
+		t.Errorf("empty board has %d threads", len(res.Threads))
+	}
+}
+
+func TestChanThread(t *testing.T) {
+	db, app := setupChan(t, 3)
+	thread := db.threads[0]
+
+	var res struct {
+		Posts []chanOP `json:"posts"`
+	}
+	getJSON(t, app, fmt.Sprintf("/prog/thread/%d.json", thread[0].ID), 200, &res)
+
+	if len(res.Posts) != len(thread) {
+		t.Fatalf("got %d posts, want %d", len(res.Posts), len(thread))
+	}
+
+	if op := res.Posts[0]; op.No != thread[0].ID || op.Replies != len(thread)-1 || op.UniqueIPs != len(thread) || op.Com != "op" {
+		t.Errorf("OP is %+v", op)
+	}
+
+	for i, p := range res.Posts[1:] {
+		if p.No != thread[i+1].ID || p.Resto != thread[0].ID {
+			t.Errorf("reply %d is %+v", i, p)
+		}
+	}
+
+	getJSON(t, app, fmt.Sprintf("/prog/thread/%d.json", thread[1].ID), 404, nil) // A reply
+	getJSON(t, app, "/prog/thread/999.json", 404, nil)
+	getJSON(t, app, "/prog/thread/x.json", 404, nil)
+}
+
+func TestChanCapcode(t *testing.T) {
+	db, app := setupChan(t, 2)
+	thread := db.threads[0]
+	thread[0].Tripcode = "#Admin"
+	thread[1].Tripcode = "#Admin"
+	thread[1].Source = "https://example.com/prog"
+
+	var res struct {
+		Posts []chanPost `json:"posts"`
+	}
+	getJSON(t, app, fmt.Sprintf("/prog/thread/%d.json", thread[0].ID), 200, &res)
+
+	if p := res.Posts[0]; p.Capcode != "admin" || p.Trip != "" {
+		t.Errorf("local post has capcode %q and trip %q, want capcode admin", p.Capcode, p.Trip)
+	}
+
+	// Only we give out capcodes
+	if p := res.Posts[1]; p.Capcode != "" || p.Trip != "#Admin" {
+		t.Errorf("remote post has capcode %q and trip %q, want trip #Admin", p.Capcode, p.Trip)
+	}
+}
+
+func TestChanNotModified(t *testing.T) {
+	db, app := setupChan(t, 3)
+	thread := db.threads[0][0].ID
+
+	for _, path := range []string{
+		"/prog/threads.json",
+		"/prog/catalog.json",
+		"/prog/1.json",
+		fmt.Sprintf("/prog/thread/%d.json", thread),
+	} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", path, nil)
+			res, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			modified := res.Header.Get(fiber.HeaderLastModified)
+			if want := db.modified.Format(http.TimeFormat); modified != want {
+				t.Fatalf("Last-Modified is %q, want %q", modified, want)
+			}
+
+			db.calls = 0
+			req = httptest.NewRequest("GET", path, nil)
+			req.Header.Set(fiber.HeaderIfModifiedSince, modified)
+			res, err = app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != 304 {
+				t.Errorf("got status %d, want 304", res.StatusCode)
+			} else if db.calls != 0 {
+				t.Errorf("made %d queries for posts before answering 304", db.calls)
+			}
+
+			req = httptest.NewRequest("GET", path, nil)
+			req.Header.Set(fiber.HeaderIfModifiedSince, db.modified.Add(-time.Second).Format(http.TimeFormat))
+			res, err = app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != 200 {
+				t.Errorf("got status %d for an older copy, want 200", res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/KushBlazingJudah/feditext/fedi"
+	"github.com/KushBlazingJudah/feditext/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// activityTimeout is how long processing one activity may take.
+	activityTimeout = 2 * time.Minute
+
+	// activityRetention is how long processed activities are kept around for
+	// debugging.
+	activityRetention = 7 * 24 * time.Hour
+
+	// activityPruneTick is how often old activities are pruned.
+	activityPruneTick = time.Hour
+
+	// activityAttempts is how many times processing an activity is tried
+	// before we give up on it, unless it is sent to us again.
+	activityAttempts = 3
+
+	// activityRetryTick is how often activities that failed are tried again.
+	activityRetryTick = 15 * time.Minute
+
+	// inboxQueueSize is how many activities may wait for one worker before
+	// more are turned away.
+	inboxQueueSize = 1000
+)
+
+// inboxQueue holds activities waiting to be processed by one worker.
+// Every activity from a host goes into the same queue, so they are processed
+// in the order they were received.
+type inboxQueue struct {
+	mu   sync.Mutex
+	acts []database.Activity
+	wake chan struct{}
+}
+
+var inboxQueues []*inboxQueue
+
+func (q *inboxQueue) push(act database.Activity) {
+	q.mu.Lock()
+	q.acts = append(q.acts, act)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// Already woken up
+	}
+}
+
+// full checks if there are too many activities waiting already.
+// push doesn't check this, so that activities that were already saved are
+// never lost.
+func (q *inboxQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.acts) >= inboxQueueSize
+}
+
+func (q *inboxQueue) pop() (database.Activity, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.acts) == 0 {
+		return database.Activity{}, false
+	}
+
+	act := q.acts[0]
+	q.acts[0] = database.Activity{}
+	q.acts = q.acts[1:]
+	return act, true
+}
+
+func (q *inboxQueue) run(ctx context.Context) {
+	for {
+		act, ok := q.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+
+			continue
+		}
+
+		handleActivity(ctx, act)
+	}
+}
+
+// queueFor returns the queue of the worker responsible for actor.
+func queueFor(actor string) *inboxQueue {
+	host := actor
+	if u, err := url.Parse(actor); err == nil {
+		host = u.Hostname()
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return inboxQueues[h.Sum32()%uint32(len(inboxQueues))]
+}
+
+// StartInbox starts the workers that process activities received in our
+// inboxes, and picks up where the last run left off.
+// This must be called before any activities are received.
+func StartInbox(ctx context.Context) {
+	inboxQueues = make([]*inboxQueue, config.InboxWorkers)
+	for i := range inboxQueues {
+		inboxQueues[i] = &inboxQueue{wake: make(chan struct{}, 1)}
+		go inboxQueues[i].run(ctx)
+	}
+
+	pending, err := DB.PendingActivities(ctx)
+	if err != nil {
+		log.Printf("unable to fetch pending activities: %s", err)
+	} else if len(pending) > 0 {
+		log.Printf("Resuming %d pending activities", len(pending))
+	}
+
+	for _, act := range pending {
+		queueFor(act.Actor).push(act)
+	}
+
+	go pruneActivities(ctx)
+	go retryActivities(ctx)
+}
+
+// retryActivities periodically tries activities that failed again, until
+// they have been tried activityAttempts times.
+func retryActivities(ctx context.Context) {
+	t := time.NewTicker(activityRetryTick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		failed, err := DB.FailedActivities(ctx, activityAttempts)
+		if err != nil {
+			log.Printf("unable to fetch failed activities: %s", err)
+			continue
+		}
+
+		for _, act := range failed {
+			q := queueFor(act.Actor)
+			if q.full() {
+				// Next time.
+				continue
+			}
+
+			if err := DB.SetActivityState(ctx, act.ID, database.ActivityPending, ""); err != nil {
+				log.Printf("unable to retry activity %d: %s", act.ID, err)
+				continue
+			}
+
+			q.push(act)
+		}
+	}
+}
+
+func pruneActivities(ctx context.Context) {
+	t := time.NewTicker(activityPruneTick)
+	defer t.Stop()
+
+	for {
+		if err := DB.PruneActivities(ctx, time.Now().Add(-activityRetention)); err != nil {
+			log.Printf("unable to prune activities: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleActivity processes an activity and records how it went.
+func handleActivity(ctx context.Context, act database.Activity) {
+	state, reason := database.ActivityDone, ""
+
+	func() {
+		ctx, cancel := context.WithTimeout(ctx, activityTimeout)
+		defer cancel()
+
+		defer func() {
+			if r := recover(); r != nil {
+				state, reason = database.ActivityFailed, fmt.Sprintf("panic: %v", r)
+			}
+		}()
+
+		if err := processActivity(ctx, act); err != nil {
+			state, reason = database.ActivityFailed, err.Error()
+		}
+	}()
+
+	if state == database.ActivityFailed && config.Debug {
+		log.Printf("unable to process %s %s from %s: %s", act.Type, act.APID, act.Actor, reason)
+	}
+
+	// The context of the activity may have expired by now.
+	if err := DB.SetActivityState(context.Background(), act.ID, state, reason); err != nil {
+		log.Printf("unable to update state of activity %d: %s", act.ID, err)
+	}
+}
+
+func processActivity(ctx context.Context, rec database.Activity) error {
+	act := fedi.Activity{}
+	if err := json.Unmarshal([]byte(rec.Body), &act); err != nil {
+		return err
+	}
+
+	if rec.Board == "" {
+		return processInstanceActivity(ctx, act)
+	}
+
+	board, err := DB.Board(ctx, rec.Board)
+	if err != nil {
+		return err
+	}
+
+	return processBoardActivity(ctx, board, act)
+}
+
+// activityKey returns what tells an activity apart from others, so that it
+// is only processed once.
+// IDs are only trusted if they are on the same host as the actor, otherwise
+// anyone could stop an activity from being processed by sending theirs first
+// with the same ID.
+// Anything else is known by a hash of what was sent.
+func activityKey(act fedi.Activity, body []byte) string {
+	if act.ID != "" && util.EqualDomains(act.ID, act.Actor.ID) {
+		return act.ID
+	}
+
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// receive takes an activity sent to the inbox of board, or of the instance if
+// it is empty.
+// Once it's known who it came from, it is recorded and answered with 202
+// Accepted right away, and processed later.
+// Activities that were already received are dropped, unless processing them
+// failed.
+// If too many activities from the same host are waiting already, it is
+// answered with 503 Service Unavailable, so that it is sent again later.
+func receive(c *fiber.Ctx, board string) error {
+	body := c.Body()
+
+	act := fedi.Activity{}
+	if err := json.Unmarshal(body, &act); err != nil {
+		return errjson(c, err)
+	}
+
+	if act.Actor == nil || act.Actor.ID == "" || act.Object == nil {
+		return errjsonc(c, 400, "missing attributes")
+	}
+
+	if blocked, err := fedi.Blocked(c.Context(), act.Actor.ID); err != nil {
+		return errjson(c, err)
+	} else if blocked {
+		return errjsonc(c, 403, "blocked")
+	}
+
+	// Another sanity check
+	if err := fedi.CheckHeaders(c, act.Actor.ID); err != nil {
+		return errjson(c, err)
+	}
+
+	fedi.RecordInbound(act.Actor.ID)
+
+	q := queueFor(act.Actor.ID)
+	if q.full() {
+		c.Set(fiber.HeaderRetryAfter, "60")
+		return errjsonc(c, 503, "too many activities are waiting; try again later")
+	}
+
+	rec := database.Activity{
+		Board: board,
+		APID:  activityKey(act, body),
+		Actor: act.Actor.ID,
+		Type:  act.Type,
+		Body:  string(body),
+		State: database.ActivityPending,
+	}
+
+	if err := DB.SaveActivity(c.Context(), &rec); errors.Is(err, database.ErrActivityExists) {
+		if config.Debug {
+			log.Printf("dropped duplicate %s %s from %s", rec.Type, rec.APID, rec.Actor)
+		}
+
+		return c.SendStatus(202)
+	} else if err != nil {
+		return errjson(c, err)
+	}
+
+	q.push(rec)
+	return c.SendStatus(202)
+}
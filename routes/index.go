@@ -5,10 +5,15 @@ import (
 	"errors"
 
 	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/KushBlazingJudah/feditext/fedi"
 	"github.com/gofiber/fiber/v2"
 )
 
 func GetIndex(c *fiber.Ctx) error {
+	if isStreams(c) {
+		return jsonresp(c, fedi.InstanceActor())
+	}
+
 	news, err := DB.News(c.Context())
 	if err != nil {
 		return err
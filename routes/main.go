@@ -17,6 +17,7 @@ import (
 	"github.com/KushBlazingJudah/feditext/captcha"
 	"github.com/KushBlazingJudah/feditext/config"
 	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/KushBlazingJudah/feditext/fedi"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html"
 )
@@ -209,6 +210,20 @@ func isStreams(c *fiber.Ctx) bool {
 	return streamsRegex.MatchString(str)
 }
 
+// isFChannel guesses if a request comes from FChannel, or something that
+// expects what FChannel sends.
+// FChannel doesn't say who it is and uses Go's default user agent, and Feditext
+// gets the same thing as only it carries the names of posters; anyone else can
+// ask for it with the fchannel query parameter.
+func isFChannel(c *fiber.Ctx) bool {
+	if c.Query("fchannel") != "" {
+		return true
+	}
+
+	ua := strings.ToLower(c.Get("User-Agent"))
+	return strings.Contains(ua, "fchannel") || strings.HasPrefix(ua, "feditext/") || strings.HasPrefix(ua, "go-http-client/")
+}
+
 // (*fiber.Ctx).JSON doesn't let me not escape HTML.
 // I also didn't look.
 func jsonresp(c *fiber.Ctx, data any) error {
@@ -253,6 +268,31 @@ func redirBanned(c *fiber.Ctx) (bool, error) {
 	return true, nil
 }
 
+// checkFetch checks the signature on a request for an ActivityPub object when
+// secure mode is on.
+// Like redirBanned, if it returns false, a response has already been sent.
+func checkFetch(c *fiber.Ctx) (bool, error) {
+	if !config.SecureMode {
+		return true, nil
+	}
+
+	actor, err := fedi.CheckSignature(c)
+	if err != nil {
+		if config.Debug {
+			log.Printf("rejecting fetch from %s: %s", c.IP(), err)
+		}
+		return false, errjsonc(c, 401, "valid signature required")
+	}
+
+	if blocked, err := fedi.Blocked(c.Context(), actor); err != nil {
+		return false, errjson(c, err)
+	} else if blocked {
+		return false, errjsonc(c, 403, "blocked")
+	}
+
+	return true, nil
+}
+
 func errhtml(c *fiber.Ctx, _err error, ret ...string) error {
 	retu := ""
 	if len(ret) == 1 {
@@ -281,6 +321,9 @@ func errhtml(c *fiber.Ctx, _err error, ret ...string) error {
 	} else if errors.Is(err, database.ErrPostRejected) {
 		status = 400
 		text = "Your post was rejected!"
+	} else if errors.Is(err, database.ErrPostDeleted) {
+		status = 410
+		text = "This post has been deleted."
 	} else if errors.Is(err, ErrInvalidID) {
 		status = 404
 		text = "Invalid post ID."
@@ -348,6 +391,10 @@ func errjson(c *fiber.Ctx, err error) error {
 		_ = c.Status(400).JSON(map[string]string{
 			"error": "post was rejected",
 		})
+	} else if errors.Is(err, database.ErrPostDeleted) {
+		_ = c.Status(410).JSON(map[string]string{
+			"error": "post was deleted",
+		})
 	} else if _, ok := err.(*time.ParseError); ok {
 		_ = c.Status(400).JSON(map[string]string{
 			"error": "invalid time",
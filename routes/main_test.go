@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Templates and themes are loaded from the working directory when the package
+// is initialized, so run the tests from the root of the repository like
+// feditext is.
+// Package variables are initialized before init is called.
+var _ = func() bool {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+
+	return true
+}()
+
+// newTestApp makes an app for testing handlers.
+// Like the logger in feditext, it leaves the response alone when a handler
+// returns an error, since errjson and friends have answered already.
+func newTestApp() *fiber.App {
+	return fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return nil
+		},
+	})
+}
@@ -0,0 +1,167 @@
+package routes
+
+import (
+	"fmt"
+
+	"github.com/KushBlazingJudah/feditext/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// https://github.com/jhass/nodeinfo/blob/main/PROTOCOL.md
+
+const nodeinfoSchema = "http://nodeinfo.diaspora.software/ns/schema/"
+
+type nodeinfoLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+type nodeinfoSoftware struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository,omitempty"`
+	Homepage   string `json:"homepage,omitempty"`
+}
+
+type nodeinfo struct {
+	Version           string           `json:"version"`
+	Software          nodeinfoSoftware `json:"software"`
+	Protocols         []string         `json:"protocols"`
+	Services          nodeinfoServices `json:"services"`
+	OpenRegistrations bool             `json:"openRegistrations"`
+	Usage             nodeinfoUsage    `json:"usage"`
+	Metadata          nodeinfoMetadata `json:"metadata"`
+}
+
+type nodeinfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type nodeinfoUsage struct {
+	Users struct {
+		Total int `json:"total"`
+	} `json:"users"`
+	LocalPosts int `json:"localPosts"`
+}
+
+type nodeinfoMetadata struct {
+	Title     string `json:"nodeName"`
+	FQDN      string `json:"fqdn"`
+	Private   bool   `json:"private"`
+	TextLimit int    `json:"textLimit"`
+	Boards    int    `json:"boards"`
+}
+
+type instanceBoard struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Actor       string `json:"actor"`
+}
+
+type instance struct {
+	Title     string          `json:"title"`
+	FQDN      string          `json:"fqdn"`
+	Version   string          `json:"version"`
+	Private   bool            `json:"private"`
+	TextLimit int             `json:"textLimit"`
+	Boards    []instanceBoard `json:"boards"`
+}
+
+func GetNodeinfoWellKnown(c *fiber.Ctx) error {
+	base := fmt.Sprintf("%s://%s/nodeinfo/", config.TransportProtocol, config.FQDN)
+
+	return c.JSON(map[string][]nodeinfoLink{
+		"links": {
+			{Rel: nodeinfoSchema + "2.0", Href: base + "2.0"},
+			{Rel: nodeinfoSchema + "2.1", Href: base + "2.1"},
+		},
+	})
+}
+
+func GetNodeinfo(c *fiber.Ctx) error {
+	version := c.Params("version")
+	if version != "2.0" && version != "2.1" {
+		return errjsonc(c, 404, "not found")
+	}
+
+	boards, err := DB.Boards(c.Context())
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	posts := 0
+	for _, board := range boards {
+		n, err := DB.PostCount(c.Context(), board.ID, true)
+		if err != nil {
+			return errjson(c, err)
+		}
+		posts += n
+	}
+
+	ni := nodeinfo{
+		Version: version,
+		Software: nodeinfoSoftware{
+			Name:    "feditext",
+			Version: config.Version,
+		},
+		Protocols: []string{"activitypub"},
+		Services: nodeinfoServices{
+			Inbound:  []string{},
+			Outbound: []string{},
+		},
+		OpenRegistrations: false,
+		Metadata: nodeinfoMetadata{
+			Title:     config.Title,
+			FQDN:      config.FQDN,
+			Private:   config.Private,
+			TextLimit: config.PostCutoff,
+			Boards:    len(boards),
+		},
+	}
+
+	// Boards are the only actors we have.
+	ni.Usage.Users.Total = len(boards)
+	ni.Usage.LocalPosts = posts
+
+	if version == "2.1" {
+		ni.Software.Repository = "https://github.com/KushBlazingJudah/feditext"
+	}
+
+	if err := c.JSON(ni); err != nil {
+		return err
+	}
+
+	c.Set("Content-Type", fmt.Sprintf(`application/json; profile="%s%s#"`, nodeinfoSchema, version))
+	return nil
+}
+
+// GetInstance returns information about this instance and its boards, for
+// directory listings.
+func GetInstance(c *fiber.Ctx) error {
+	boards, err := DB.Boards(c.Context())
+	if err != nil {
+		return errjson(c, err)
+	}
+
+	inst := instance{
+		Title:     config.Title,
+		FQDN:      config.FQDN,
+		Version:   config.Version,
+		Private:   config.Private,
+		TextLimit: config.PostCutoff,
+		Boards:    make([]instanceBoard, 0, len(boards)),
+	}
+
+	for _, board := range boards {
+		inst.Boards = append(inst.Boards, instanceBoard{
+			ID:          board.ID,
+			Title:       board.Title,
+			Description: board.Description,
+			Actor:       fmt.Sprintf("%s://%s/%s", config.TransportProtocol, config.FQDN, board.ID),
+		})
+	}
+
+	return c.JSON(inst)
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// tokenWindow counts the requests made with a token in the current minute.
+type tokenWindow struct {
+	start time.Time
+	n     int
+}
+
+var (
+	tokenWindows = map[int]*tokenWindow{}
+	tokenLock    sync.Mutex
+)
+
+// allowToken checks if another request may be made with t right now.
+// If not, it returns how long until one can be.
+func allowToken(t database.Token) (bool, time.Duration) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	now := time.Now()
+
+	w, ok := tokenWindows[t.ID]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		w = &tokenWindow{start: now}
+		tokenWindows[t.ID] = w
+	}
+
+	if w.n >= t.Rate {
+		return false, w.start.Add(time.Minute).Sub(now)
+	}
+
+	w.n++
+	return true, 0
+}
+
+// TokenAuth makes sure that requests carry an API token that may be used for
+// scope, as "Authorization: Bearer <token>", and that it isn't being used too
+// often.
+// The token is put in the "token" local.
+// Which boards it may be used on is left to the handler.
+func TokenAuth(scope database.TokenScope) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		auth := c.Get(fiber.HeaderAuthorization)
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errjsonc(c, 401, "missing token")
+		}
+
+		t, err := DB.UseToken(c.Context(), strings.TrimPrefix(auth, "Bearer "))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errjsonc(c, 401, "bad token")
+		} else if err != nil {
+			return errjson(c, err)
+		}
+
+		if t.Scopes&scope != scope {
+			return errjsonc(c, 403, "token can't be used for this")
+		}
+
+		if ok, wait := allowToken(t); !ok {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+			return errjsonc(c, 429, "slow down")
+		}
+
+		c.Locals("token", t)
+		return c.Next()
+	}
+}
+
+// forgetToken drops the rate limit state of a revoked token.
+func forgetToken(id int) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	delete(tokenWindows, id)
+}
@@ -0,0 +1,177 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/feditext/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// tokenDB is just enough of a database for the write API to check tokens.
+type tokenDB struct {
+	database.Database
+
+	tokens map[string]database.Token
+	banned map[string]bool
+}
+
+func (db *tokenDB) UseToken(ctx context.Context, secret string) (database.Token, error) {
+	t, ok := db.tokens[secret]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (db *tokenDB) Board(ctx context.Context, board string) (database.Board, error) {
+	if board != "prog" && board != "tech" {
+		return database.Board{}, sql.ErrNoRows
+	}
+	return database.Board{ID: board}, nil
+}
+
+func (db *tokenDB) Banned(ctx context.Context, source string) (bool, time.Time, string, error) {
+	if db.banned[source] {
+		return false, time.Time{}, "spam", nil
+	}
+	return true, time.Time{}, "", nil
+}
+
+// setupTokens sets up the write API with a few tokens.
+// Requests that get through to PostAPIPost are refused for having no comment.
+func setupTokens(t *testing.T) (*tokenDB, *fiber.App) {
+	t.Helper()
+
+	old := DB
+	t.Cleanup(func() {
+		DB = old
+
+		tokenLock.Lock()
+		tokenWindows = map[int]*tokenWindow{}
+		tokenLock.Unlock()
+	})
+
+	db := &tokenDB{
+		tokens: map[string]database.Token{
+			"poster":   {ID: 1, Name: "poster", Scopes: database.ScopePost, Rate: 100},
+			"reporter": {ID: 2, Name: "reporter", Scopes: database.ScopeReport, Rate: 100},
+			"prog":     {ID: 3, Name: "prog", Scopes: database.ScopePost, Boards: []string{"prog"}, Rate: 100},
+			"slow":     {ID: 4, Name: "slow", Scopes: database.ScopePost, Rate: 2},
+		},
+		banned: map[string]bool{},
+	}
+	DB = db
+
+	app := newTestApp()
+	app.Post("/api/v1/post", TokenAuth(database.ScopePost), PostAPIPost)
+
+	return db, app
+}
+
+// postAPI makes a post through the write API, and returns the status and error
+// it was answered with.
+func postAPI(t *testing.T, app *fiber.App, token, board string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/api/v1/post", strings.NewReader(`{"board":"`+board+`"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body := map[string]string{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	return res.StatusCode, body["error"]
+}
+
+func TestTokenAuth(t *testing.T) {
+	_, app := setupTokens(t)
+
+	tests := []struct {
+		name   string
+		token  string
+		board  string
+		status int
+	}{
+		{"allowed", "poster", "tech", 400},
+		{"allowed on its board", "prog", "prog", 400},
+		{"no token", "", "prog", 401},
+		{"bad token", "nope", "prog", 401},
+		{"wrong scope", "reporter", "prog", 403},
+		{"another board", "prog", "tech", 403},
+		{"missing board", "poster", "nope", 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, msg := postAPI(t, app, tt.token, tt.board)
+			if status != tt.status {
+				t.Errorf("got status %d (%s), want %d", status, msg, tt.status)
+			}
+		})
+	}
+}
+
+func TestTokenRate(t *testing.T) {
+	_, app := setupTokens(t)
+
+	for i := 0; i < 2; i++ {
+		if status, msg := postAPI(t, app, "slow", "prog"); status != 400 {
+			t.Fatalf("request %d: got status %d (%s), want 400", i+1, status, msg)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/post", strings.NewReader(`{"board":"prog"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer slow")
+
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 429 {
+		t.Errorf("got status %d, want 429", res.StatusCode)
+	} else if wait := res.Header.Get(fiber.HeaderRetryAfter); wait == "" || wait == "0" {
+		t.Errorf("Retry-After is %q", wait)
+	}
+
+	// Other tokens have their own limits
+	if status, msg := postAPI(t, app, "poster", "prog"); status != 400 {
+		t.Errorf("another token: got status %d (%s), want 400", status, msg)
+	}
+}
+
+func TestTokenBanned(t *testing.T) {
+	db, app := setupTokens(t)
+
+	// app.Test sends requests from 0.0.0.0
+	db.banned["0.0.0.0"] = true
+
+	if status, msg := postAPI(t, app, "poster", "prog"); status != 403 || msg != "banned" {
+		t.Errorf("got status %d (%s), want 403 (banned)", status, msg)
+	}
+
+	delete(db.banned, "0.0.0.0")
+	db.banned["10.0.0.1"] = true
+
+	if status, msg := postAPI(t, app, "poster", "prog"); status != 400 {
+		t.Errorf("after another address was banned: got status %d (%s), want 400", status, msg)
+	}
+}
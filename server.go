@@ -44,15 +44,39 @@ func Startup() {
 		}
 	}
 
+	if err := fedi.ImportKeys(context.Background()); err != nil {
+		log.Fatalf("Unable to import keys: %v", err)
+	}
+
+	if err := fedi.CreateInstanceKey(context.Background()); err != nil {
+		log.Fatalf("Unable to create the instance key: %v", err)
+	}
+
 	// Setup Fedi proxy
 	var err error
-	fedi.Proxy, err = fedi.NewProxy(config.ProxyUrl)
+	fedi.Proxy, err = fedi.NewProxy(config.ProxyUrl, config.Routes)
 	if err != nil {
 		panic(err)
 	}
+
+	if err := fedi.LoadPeers(context.Background()); err != nil {
+		log.Printf("Unable to load peer stats: %v", err)
+	}
+	go fedi.KeepPeers(context.Background())
+
+	routes.StartInbox(context.Background())
+
+	// Keep up with what our boards follow
+	if config.PollInterval > 0 || len(config.PollIntervals) > 0 {
+		go fedi.Poll(context.Background())
+	}
 }
 
 func Close() {
+	if err := fedi.SavePeers(context.Background()); err != nil {
+		log.Printf("Error saving peer stats: %v", err)
+	}
+
 	if err := DB.Close(); err != nil {
 		log.Printf("Error closing database: %v", err)
 	}
@@ -218,6 +242,16 @@ Disallow: /
 	app.Get("/faq", routes.GetFAQ)
 
 	app.Get("/.well-known/webfinger", routes.Webfinger)
+	app.Get("/.well-known/nodeinfo", routes.GetNodeinfoWellKnown)
+	app.Get("/nodeinfo/:version", routes.GetNodeinfo)
+	app.Get("/api/instance", routes.GetInstance)
+
+	// 4chan's API; these have to come before the routes for boards
+	app.Get("/boards.json", routes.GetChanBoards)
+	app.Get("/:board/threads.json", routes.GetChanThreads)
+	app.Get("/:board/catalog.json", routes.GetChanCatalog)
+	app.Get("/:board/thread/:thread.json", routes.GetChanThread)
+	app.Get("/:board/:page.json", routes.GetChanPage)
 
 	// Admin
 	app.Get("/admin", routes.GetAdmin)
@@ -236,15 +270,37 @@ Disallow: /
 	app.Post("/admin/board", routes.PostBoard)
 	app.Get("/admin/follow", routes.GetAdminFollow)
 	app.Get("/admin/unfollow", routes.GetAdminUnfollow)
+	app.Get("/admin/relay", routes.GetAdminRelay)
+	app.Get("/admin/unrelay", routes.GetAdminUnrelay)
+	app.Get("/admin/activities", routes.GetAdminActivities)
+	app.Get("/admin/tokens", routes.GetAdminTokens)
+	app.Post("/admin/tokens", routes.PostAdminTokens)
+	app.Get("/admin/tokens/delete/:id", routes.GetAdminTokenDelete)
+	app.Get("/admin/federation", routes.GetAdminFederation)
 	app.Get("/admin/fetch", routes.GetAdminFetch)
 	app.Get("/admin/resend", routes.GetAdminResend)
+	app.Get("/admin/rotate", routes.GetAdminRotate)
+	app.Get("/admin/rerender", routes.GetAdminRerender)
 	app.Get("/admin/delete", routes.GetDelete)
+	app.Get("/admin/edit", routes.GetEdit)
+	app.Post("/admin/edit", routes.PostEdit)
 	app.Post("/admin/regexps", routes.PostRegexp)
 	app.Get("/admin/regexps/delete/:id", routes.GetRegexpDelete)
+	app.Post("/admin/blocks", routes.PostBlock)
+	app.Get("/admin/blocks/delete/:host", routes.GetBlockDelete)
 	app.Get("/admin/:board", routes.GetAdminBoard)
 
 	app.Post("/post", routes.Post)
 
+	// Write API
+	app.Post("/api/v1/post", routes.TokenAuth(database.ScopePost), routes.PostAPIPost)
+	app.Post("/api/v1/report", routes.TokenAuth(database.ScopeReport), routes.PostAPIReport)
+	app.Post("/api/v1/delete", routes.TokenAuth(database.ScopeDelete), routes.PostAPIDelete)
+
+	// Instance actor; the actor itself is served by GetIndex
+	app.Post("/inbox", routes.PostInstanceInbox)
+	app.Get("/outbox", routes.GetInstanceOutbox)
+
 	app.Get("/:board", routes.GetBoardIndex)
 
 	// ActivityPub stuff
@@ -258,6 +314,7 @@ Disallow: /
 	app.Post("/:board/report", routes.PostBoardReport)
 
 	app.Get("/:board/:thread", routes.GetBoardThread)
+	app.Get("/:board/:thread/replies", routes.GetBoardReplies)
 
 	app.Listen(config.ListenAddress)
 }
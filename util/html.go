@@ -0,0 +1,139 @@
+package util
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlRegex   = regexp.MustCompile(`(?i)<(p|br|a|span)[\s/>]`)
+	hrefRegex   = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	classRegex  = regexp.MustCompile(`(?i)\bclass\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	spacesRegex = regexp.MustCompile(`[ \t]+\n`)
+	blankRegex  = regexp.MustCompile(`\n{3,}`)
+)
+
+// LooksLikeHTML guesses if s was written as HTML, which is what most of the
+// Fediverse sends.
+// Feditext and FChannel send plain text, where markup like this is rare.
+func LooksLikeHTML(s string) bool {
+	return htmlRegex.MatchString(s)
+}
+
+// attr returns the value of the attribute matched by re in a tag.
+func attr(re *regexp.Regexp, tag string) string {
+	m := re.FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+
+	return html.UnescapeString(m[1] + m[2] + m[3])
+}
+
+// isTagStart reports whether s, which starts with <, starts a tag.
+func isTagStart(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+
+	c := s[1]
+	return c == '/' || c == '!' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// HTMLToText converts the HTML content of a post into plain text.
+// Paragraphs and line breaks are kept, and links are replaced with where they
+// point to, except for mentions and hashtags which keep their text.
+// Every other tag is dropped.
+func HTMLToText(s string) string {
+	out := &strings.Builder{}
+
+	// Where the current link started in out, and where it goes
+	linkStart, href, mention := -1, "", false
+	skip := "" // inside of a tag whose contents are thrown away
+
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			i = len(s)
+		}
+
+		if skip == "" {
+			out.WriteString(html.UnescapeString(s[:i]))
+		}
+		s = s[i:]
+		if s == "" {
+			break
+		}
+
+		if !isTagStart(s) {
+			// A < that doesn't start a tag, like in "1 < 2"
+			if skip == "" {
+				out.WriteByte('<')
+			}
+			s = s[1:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			// Not a tag, just a stray <
+			if skip == "" {
+				out.WriteString(html.UnescapeString(s))
+			}
+			break
+		}
+
+		tag := s[1:end]
+		s = s[end+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if j := strings.IndexAny(name, " \t\n/"); j != -1 {
+			name = name[:j]
+		}
+
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+
+		switch name {
+		case "script", "style":
+			if !closing {
+				skip = name
+			}
+		case "br":
+			out.WriteString("\n")
+		case "p", "div", "blockquote", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+			if closing {
+				out.WriteString("\n\n")
+			}
+		case "a":
+			if !closing {
+				linkStart, href = out.Len(), attr(hrefRegex, tag)
+				class := attr(classRegex, tag)
+				mention = strings.Contains(class, "mention") || strings.Contains(class, "hashtag")
+			} else if linkStart != -1 {
+				text := out.String()[linkStart:]
+				if !mention && !strings.HasPrefix(text, "@") && !strings.HasPrefix(text, "#") &&
+					(strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) {
+					// Use the address itself; the text is often shortened
+					rest := out.String()[:linkStart]
+					out.Reset()
+					out.WriteString(rest)
+					out.WriteString(href)
+				}
+
+				linkStart = -1
+			}
+		}
+	}
+
+	text := strings.ReplaceAll(out.String(), "\r", "")
+	text = spacesRegex.ReplaceAllString(text, "\n")
+	text = blankRegex.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
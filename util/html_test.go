@@ -0,0 +1,152 @@
+package util
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "plain",
+			in:   "hello",
+			out:  "hello",
+		},
+		{
+			name: "paragraphs",
+			in:   "<p>one</p><p>two</p>",
+			out:  "one\n\ntwo",
+		},
+		{
+			name: "line breaks",
+			in:   "<p>one<br>two<br/>three<BR /></p>",
+			out:  "one\ntwo\nthree",
+		},
+		{
+			name: "blank lines",
+			in:   "<p>one</p><p></p><br><br><p>two</p>",
+			out:  "one\n\ntwo",
+		},
+		{
+			name: "trailing spaces",
+			in:   "<p>one   <br>two</p>",
+			out:  "one\ntwo",
+		},
+		{
+			name: "entities",
+			in:   "<p>&gt;implying &amp; &lt;b&gt; &quot;x&quot; &#39;y&#39; &#x263A;</p>",
+			out:  `>implying & <b> "x" 'y' ☺`,
+		},
+		{
+			name: "other tags",
+			in:   "<p><b>bold</b> <span class=\"x\">and</span> <em>more</em></p>",
+			out:  "bold and more",
+		},
+		{
+			name: "script",
+			in:   "<p>a<script>alert('<p>hi</p>')</script>b</p>",
+			out:  "ab",
+		},
+		{
+			name: "style",
+			in:   "<style type=\"text/css\">p { color: red; }</style><p>text</p>",
+			out:  "text",
+		},
+		{
+			name: "link",
+			in:   `<p>see <a href="https://example.com/a/very/long/path" rel="nofollow">example.com/a/very/…</a></p>`,
+			out:  "see https://example.com/a/very/long/path",
+		},
+		{
+			name: "link with entities",
+			in:   `<a href="https://example.com/?a=1&amp;b=2">here</a>`,
+			out:  "https://example.com/?a=1&b=2",
+		},
+		{
+			name: "relative link",
+			in:   `<a href="/tags/x">somewhere</a>`,
+			out:  "somewhere",
+		},
+		{
+			name: "mention",
+			in:   `<p><span class="h-card"><a href="https://example.com/@bob" class="u-url mention">@<span>bob</span></a></span> hi</p>`,
+			out:  "@bob hi",
+		},
+		{
+			name: "mention without a class",
+			in:   `<a href="https://example.com/@bob">@bob</a> hi`,
+			out:  "@bob hi",
+		},
+		{
+			name: "hashtag",
+			in:   `<a href="https://example.com/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a>`,
+			out:  "#go",
+		},
+		{
+			name: "unclosed tag",
+			in:   "<p>one<b",
+			out:  "one<b",
+		},
+		{
+			name: "stray <",
+			in:   "<p>1 < 2</p>",
+			out:  "1 < 2",
+		},
+		{
+			name: "heart",
+			in:   "<p>i <3 go <</p>",
+			out:  "i <3 go <",
+		},
+		{
+			name: "comment",
+			in:   "<p>a<!-- b -->c</p>",
+			out:  "ac",
+		},
+		{
+			name: "unclosed paragraph",
+			in:   "<p>one<p>two",
+			out:  "onetwo",
+		},
+		{
+			name: "unclosed link",
+			in:   `<a href="https://example.com">text`,
+			out:  "text",
+		},
+		{
+			name: "unclosed script",
+			in:   "one<script>two",
+			out:  "one",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := HTMLToText(tt.in); out != tt.out {
+				t.Errorf("HTMLToText(%q) = %q, want %q", tt.in, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestLooksLikeHTML(t *testing.T) {
+	tests := []struct {
+		in   string
+		html bool
+	}{
+		{"<p>hello</p>", true},
+		{"one<br>two", true},
+		{"one<BR/>two", true},
+		{`<a href="x">x</a>`, true},
+		{"hello", false},
+		{">>1 yes", false},
+		{"1 < 2 > 0", false},
+		{"<pre>", false},
+	}
+
+	for _, tt := range tests {
+		if got := LooksLikeHTML(tt.in); got != tt.html {
+			t.Errorf("LooksLikeHTML(%q) = %v, want %v", tt.in, got, tt.html)
+		}
+	}
+}
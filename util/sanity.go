@@ -16,10 +16,12 @@ var privateIPBlocks []*net.IPNet
 
 func init() {
 	for _, cidr := range []string{
+		"0.0.0.0/8",      // RFC1122 "this network"
 		"127.0.0.0/8",    // IPv4 loopback
 		"10.0.0.0/8",     // RFC1918
 		"172.16.0.0/12",  // RFC1918
 		"192.168.0.0/16", // RFC1918
+		"100.64.0.0/10",  // RFC6598 shared address space
 		"169.254.0.0/16", // RFC3927 link-local
 		"::1/128",        // IPv6 loopback
 		"fe80::/10",      // IPv6 link-local
@@ -33,24 +35,36 @@ func init() {
 	}
 }
 
+// ValidHost checks if we are allowed to make requests to host.
+// Only IP addresses can be checked here; hostnames must also be checked with
+// ValidIP once they are resolved.
 func ValidHost(host string) bool {
 	if strings.HasSuffix(host, ".onion") && !config.AllowOnion {
 		return false
 	}
 
+	if ip := net.ParseIP(host); ip != nil {
+		return ValidIP(ip)
+	}
+
+	return true
+}
+
+// ValidIP checks if we are allowed to make requests to ip.
+func ValidIP(ip net.IP) bool {
 	// Skip all of these checks if we don't need to bother with them.
-	if !config.AllowLocal {
-		if ip := net.ParseIP(host); ip != nil {
-			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-				return false
-			}
+	if config.AllowLocal {
+		return true
+	}
 
-			// Check to see if we landed in any of the private blocks
-			for _, block := range privateIPBlocks {
-				if block.Contains(ip) {
-					return false
-				}
-			}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+
+	// Check to see if we landed in any of the private blocks
+	for _, block := range privateIPBlocks {
+		if block.Contains(ip) {
+			return false
 		}
 	}
 